@@ -0,0 +1,505 @@
+// access.go - typed accessors for mapped memory
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+// The accessors below read (or write) fixed width values at arbitrary
+// offsets of the mapping. They are bounds checked and go through
+// encoding/binary; so they're safe for unaligned offsets. The Put
+// variants return ErrReadOnly for mappings without PROT_WRITE.
+
+// Uint8At returns the byte at offset 'off'
+func (p *Mapping) Uint8At(off int64) (uint8, error) {
+	b, err := p.window(off, 1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// PutUint8At writes 'v' at offset 'off'
+func (p *Mapping) PutUint8At(off int64, v uint8) error {
+	b, err := p.wrWindow(off, 1)
+	if err != nil {
+		return err
+	}
+	b[0] = v
+	return nil
+}
+
+// Uint16At returns the uint16 at offset 'off' in byte order 'order'
+func (p *Mapping) Uint16At(off int64, order binary.ByteOrder) (uint16, error) {
+	b, err := p.window(off, 2)
+	if err != nil {
+		return 0, err
+	}
+	return order.Uint16(b), nil
+}
+
+// PutUint16At writes 'v' at offset 'off' in byte order 'order'
+func (p *Mapping) PutUint16At(off int64, order binary.ByteOrder, v uint16) error {
+	b, err := p.wrWindow(off, 2)
+	if err != nil {
+		return err
+	}
+	order.PutUint16(b, v)
+	return nil
+}
+
+// Uint32At returns the uint32 at offset 'off' in byte order 'order'
+func (p *Mapping) Uint32At(off int64, order binary.ByteOrder) (uint32, error) {
+	b, err := p.window(off, 4)
+	if err != nil {
+		return 0, err
+	}
+	return order.Uint32(b), nil
+}
+
+// PutUint32At writes 'v' at offset 'off' in byte order 'order'
+func (p *Mapping) PutUint32At(off int64, order binary.ByteOrder, v uint32) error {
+	b, err := p.wrWindow(off, 4)
+	if err != nil {
+		return err
+	}
+	order.PutUint32(b, v)
+	return nil
+}
+
+// Uint64At returns the uint64 at offset 'off' in byte order 'order'
+func (p *Mapping) Uint64At(off int64, order binary.ByteOrder) (uint64, error) {
+	b, err := p.window(off, 8)
+	if err != nil {
+		return 0, err
+	}
+	return order.Uint64(b), nil
+}
+
+// PutUint64At writes 'v' at offset 'off' in byte order 'order'
+func (p *Mapping) PutUint64At(off int64, order binary.ByteOrder, v uint64) error {
+	b, err := p.wrWindow(off, 8)
+	if err != nil {
+		return err
+	}
+	order.PutUint64(b, v)
+	return nil
+}
+
+// Int16At returns the int16 at offset 'off' in byte order 'order'
+func (p *Mapping) Int16At(off int64, order binary.ByteOrder) (int16, error) {
+	v, err := p.Uint16At(off, order)
+	return int16(v), err
+}
+
+// PutInt16At writes 'v' at offset 'off' in byte order 'order'
+func (p *Mapping) PutInt16At(off int64, order binary.ByteOrder, v int16) error {
+	return p.PutUint16At(off, order, uint16(v))
+}
+
+// Int32At returns the int32 at offset 'off' in byte order 'order'
+func (p *Mapping) Int32At(off int64, order binary.ByteOrder) (int32, error) {
+	v, err := p.Uint32At(off, order)
+	return int32(v), err
+}
+
+// PutInt32At writes 'v' at offset 'off' in byte order 'order'
+func (p *Mapping) PutInt32At(off int64, order binary.ByteOrder, v int32) error {
+	return p.PutUint32At(off, order, uint32(v))
+}
+
+// Int64At returns the int64 at offset 'off' in byte order 'order'
+func (p *Mapping) Int64At(off int64, order binary.ByteOrder) (int64, error) {
+	v, err := p.Uint64At(off, order)
+	return int64(v), err
+}
+
+// PutInt64At writes 'v' at offset 'off' in byte order 'order'
+func (p *Mapping) PutInt64At(off int64, order binary.ByteOrder, v int64) error {
+	return p.PutUint64At(off, order, uint64(v))
+}
+
+// Float32At returns the IEEE 754 float32 at offset 'off' in byte order 'order'
+func (p *Mapping) Float32At(off int64, order binary.ByteOrder) (float32, error) {
+	v, err := p.Uint32At(off, order)
+	return math.Float32frombits(v), err
+}
+
+// PutFloat32At writes 'v' at offset 'off' in byte order 'order'
+func (p *Mapping) PutFloat32At(off int64, order binary.ByteOrder, v float32) error {
+	return p.PutUint32At(off, order, math.Float32bits(v))
+}
+
+// Float64At returns the IEEE 754 float64 at offset 'off' in byte order 'order'
+func (p *Mapping) Float64At(off int64, order binary.ByteOrder) (float64, error) {
+	v, err := p.Uint64At(off, order)
+	return math.Float64frombits(v), err
+}
+
+// PutFloat64At writes 'v' at offset 'off' in byte order 'order'
+func (p *Mapping) PutFloat64At(off int64, order binary.ByteOrder, v float64) error {
+	return p.PutUint64At(off, order, math.Float64bits(v))
+}
+
+// Number is the set of fixed width numeric types read by ReadAt
+type Number interface {
+	~int8 | ~int16 | ~int32 | ~int64 |
+		~uint8 | ~uint16 | ~uint32 | ~uint64 |
+		~float32 | ~float64
+}
+
+// ReadAt returns the value of type T at offset 'off' of the mapping in
+// byte order 'order'; it is the generic form of the accessors above.
+func ReadAt[T Number](p *Mapping, off int64, order binary.ByteOrder) (T, error) {
+	var v T
+
+	b, err := p.window(off, int(unsafe.Sizeof(v)))
+	if err != nil {
+		return v, err
+	}
+
+	if _, err = binary.Decode(b, order, &v); err != nil {
+		return v, fmt.Errorf("mmap: %d bytes at %d: %w", len(b), off, err)
+	}
+	return v, nil
+}
+
+// window returns the 'n' bytes of the mapping at offset 'off'
+func (p *Mapping) window(off int64, n int) ([]byte, error) {
+	b := p.bytes()
+	if off < 0 || off > int64(len(b)-n) {
+		return nil, fmt.Errorf("mmap: %d bytes at %d: out of bounds", n, off)
+	}
+	return b[off : off+int64(n)], nil
+}
+
+// wrWindow is like window but for writable mappings
+func (p *Mapping) wrWindow(off int64, n int) ([]byte, error) {
+	if !p.wr {
+		return nil, fmt.Errorf("mmap: %d bytes at %d: %w", n, off, ErrReadOnly)
+	}
+	return p.window(off, n)
+}
+
+// CompareAndSwapUint64 atomically replaces the uint64 at offset 'off'
+// with 'new' if it holds 'old'; it returns true if the swap happened.
+// The value is in host byte order and 'off' must be 8-byte aligned.
+// Atomic operations on shared mappings are visible across processes.
+func (p *Mapping) CompareAndSwapUint64(off int64, old, new uint64) (bool, error) {
+	v, err := p.atomic64(off)
+	if err != nil {
+		return false, err
+	}
+	return atomic.CompareAndSwapUint64(v, old, new), nil
+}
+
+// AddUint64 atomically adds 'delta' to the uint64 at offset 'off' and
+// returns the new value. The value is in host byte order and 'off'
+// must be 8-byte aligned.
+func (p *Mapping) AddUint64(off int64, delta uint64) (uint64, error) {
+	v, err := p.atomic64(off)
+	if err != nil {
+		return 0, err
+	}
+	return atomic.AddUint64(v, delta), nil
+}
+
+// LoadUint64 atomically loads the uint64 at offset 'off'. The value is
+// in host byte order and 'off' must be 8-byte aligned.
+func (p *Mapping) LoadUint64(off int64) (uint64, error) {
+	v, err := p.load64(off)
+	if err != nil {
+		return 0, err
+	}
+	return atomic.LoadUint64(v), nil
+}
+
+// StoreUint64 atomically stores 'val' in the uint64 at offset 'off'.
+// The value is in host byte order and 'off' must be 8-byte aligned.
+func (p *Mapping) StoreUint64(off int64, val uint64) error {
+	v, err := p.atomic64(off)
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreUint64(v, val)
+	return nil
+}
+
+// SeqBeginRead starts a read of data guarded by a seqlock: a uint64
+// sequence number at offset 'seqOff' that writers increment before and
+// after each update (so, it is odd while a write is in progress). It
+// returns the sequence number and false if a write is in progress (or
+// 'seqOff' is invalid); the caller must then retry. The value is in
+// host byte order and 'seqOff' must be 8-byte aligned.
+//
+// The guarded data must be read (and written) with atomic loads (and
+// stores) such as LoadUint64 (and StoreUint64): on weakly ordered CPUs
+// (eg arm64), plain loads can be reordered past the closing read of
+// the sequence number in SeqEndRead and a torn read would then pass
+// validation.
+func (p *Mapping) SeqBeginRead(seqOff int64) (uint64, bool) {
+	v, err := p.load64(seqOff)
+	if err != nil {
+		return 0, false
+	}
+
+	seq := atomic.LoadUint64(v)
+	return seq, seq&1 == 0
+}
+
+// SeqEndRead finishes a read started with SeqBeginRead; it returns true
+// if the data read in between is consistent - ie no writer intervened.
+// Otherwise the caller must retry the read.
+func (p *Mapping) SeqEndRead(seqOff int64, start uint64) bool {
+	v, err := p.load64(seqOff)
+	if err != nil {
+		return false
+	}
+	return atomic.LoadUint64(v) == start
+}
+
+// FutexWait blocks the caller while the uint32 at offset 'off' holds
+// 'expect' (futex(2) FUTEX_WAIT); another thread or process sharing the
+// mapping wakes it via FutexWake. It returns right away if the value
+// differs and may return spuriously; so callers must recheck the value
+// in a loop. The value is in host byte order and 'off' must be 4-byte
+// aligned. The mapping must be shared for cross-process use. It
+// returns ErrUnsupported on platforms other than Linux.
+func (p *Mapping) FutexWait(off int64, expect uint32) error {
+	v, err := p.load32(off)
+	if err != nil {
+		return err
+	}
+
+	if err := futexWait(v, expect); err != nil {
+		return fmt.Errorf("mmap: futex wait at %d: %w", off, err)
+	}
+	return nil
+}
+
+// FutexWake wakes up to 'n' waiters blocked in FutexWait on the uint32
+// at offset 'off' and returns the number woken. It returns
+// ErrUnsupported on platforms other than Linux.
+func (p *Mapping) FutexWake(off int64, n int) (int, error) {
+	v, err := p.load32(off)
+	if err != nil {
+		return 0, err
+	}
+
+	w, err := futexWake(v, n)
+	if err != nil {
+		return 0, fmt.Errorf("mmap: futex wake at %d: %w", off, err)
+	}
+	return w, nil
+}
+
+// load32 returns a pointer to the aligned uint32 at 'off'
+func (p *Mapping) load32(off int64) (*uint32, error) {
+	b, err := p.window(off, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	ptr := unsafe.Pointer(&b[0])
+	if uintptr(ptr)%4 != 0 {
+		return nil, fmt.Errorf("mmap: 4 bytes at %d: misaligned", off)
+	}
+	return (*uint32)(ptr), nil
+}
+
+// atomic64 returns a pointer to the writable, aligned uint64 at 'off'
+func (p *Mapping) atomic64(off int64) (*uint64, error) {
+	b, err := p.wrWindow(off, 8)
+	if err != nil {
+		return nil, err
+	}
+	return aligned64(b, off)
+}
+
+// load64 returns a pointer to the aligned uint64 at 'off'
+func (p *Mapping) load64(off int64) (*uint64, error) {
+	b, err := p.window(off, 8)
+	if err != nil {
+		return nil, err
+	}
+	return aligned64(b, off)
+}
+
+func aligned64(b []byte, off int64) (*uint64, error) {
+	ptr := unsafe.Pointer(&b[0])
+	if uintptr(ptr)%8 != 0 {
+		return nil, fmt.Errorf("mmap: 8 bytes at %d: misaligned", off)
+	}
+	return (*uint64)(ptr), nil
+}
+
+// Slice returns the contents of the mapping as a []T without copying;
+// the length of the mapping must be a multiple of the size of T and its
+// start must be suitably aligned for T. T must be a fixed size type
+// without pointers (eg integers, floats and arrays or structs of them):
+// the garbage collector doesn't know about mapped memory. The byte
+// order and padding of T are that of the host. The slice is invalid
+// once the mapping is unmapped.
+func Slice[T any](p *Mapping) ([]T, error) {
+	var z T
+
+	typ := reflect.TypeOf(&z).Elem()
+	if !pointerFree(typ) {
+		return nil, fmt.Errorf("mmap: slice of %s: type has pointers", typ)
+	}
+
+	sz := int(unsafe.Sizeof(z))
+	if sz == 0 {
+		return nil, fmt.Errorf("mmap: slice of %s: zero sized type", typ)
+	}
+
+	b := p.bytes()
+	if len(b)%sz != 0 {
+		return nil, fmt.Errorf("mmap: slice of %s: size %d not a multiple of %d", typ, len(b), sz)
+	}
+
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	if p.addr()%unsafe.Alignof(z) != 0 {
+		return nil, fmt.Errorf("mmap: slice of %s: misaligned address %#x", typ, p.addr())
+	}
+	return unsafe.Slice((*T)(unsafe.Pointer(&b[0])), len(b)/sz), nil
+}
+
+// pointerFree returns true if values of type t hold no pointers
+func pointerFree(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return true
+
+	case reflect.Array:
+		return pointerFree(t.Elem())
+
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if !pointerFree(t.Field(i).Type) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// SearchRecords treats the mapping as a sorted array of 'recSize' byte
+// records and binary searches it with 'cmp'; cmp must return a negative
+// number if the record sorts before the key, zero if it matches and a
+// positive number if it sorts after the key. It returns the index of
+// the matching record and true; or if there is no match, the index
+// where the key would be inserted and false. A trailing partial record
+// is ignored.
+func (p *Mapping) SearchRecords(recSize int, cmp func(rec []byte) int) (int64, bool) {
+	if recSize <= 0 {
+		return 0, false
+	}
+
+	b := p.bytes()
+	n := len(b) / recSize
+	rec := func(i int) []byte {
+		return b[i*recSize : (i+1)*recSize]
+	}
+
+	i := sort.Search(n, func(i int) bool {
+		return cmp(rec(i)) >= 0
+	})
+	return int64(i), i < n && cmp(rec(i)) == 0
+}
+
+// SortRecords sorts the file 'fd' in place as an array of 'recSize'
+// byte records ordered by 'less'; the file is mapped writable, sorted
+// in memory and flushed to disk. The file size must be a multiple of
+// the record size. Files larger than the largest mapping
+// (MaxMappingSize) aren't supported.
+func SortRecords(fd *os.File, recSize int, less func(a, b []byte) bool) error {
+	if recSize <= 0 {
+		return fmt.Errorf("mmap: sort %s: invalid record size %d", fd.Name(), recSize)
+	}
+
+	fsz, err := fileSize(fd)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case fsz == 0:
+		return nil
+	case fsz%int64(recSize) != 0:
+		return fmt.Errorf("mmap: sort %s: size %d isn't a multiple of %d byte records", fd.Name(), fsz, recSize)
+	case fsz > _MaxMmapSize:
+		return fmt.Errorf("mmap: sort %s: %d bytes is too large", fd.Name(), fsz)
+	}
+
+	p, err := New(fd).Map(fsz, 0, PROT_RW, 0)
+	if err != nil {
+		return err
+	}
+
+	sort.Sort(&records{
+		b:    p.bytes(),
+		sz:   recSize,
+		less: less,
+		tmp:  make([]byte, recSize),
+	})
+
+	err = p.Flush()
+	if err2 := p.Unmap(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// records is a sort.Interface over an array of fixed size records
+type records struct {
+	b    []byte
+	sz   int
+	less func(a, b []byte) bool
+	tmp  []byte
+}
+
+func (r *records) rec(i int) []byte {
+	return r.b[i*r.sz : (i+1)*r.sz]
+}
+
+func (r *records) Len() int {
+	return len(r.b) / r.sz
+}
+
+func (r *records) Less(i, j int) bool {
+	return r.less(r.rec(i), r.rec(j))
+}
+
+func (r *records) Swap(i, j int) {
+	a, b := r.rec(i), r.rec(j)
+	copy(r.tmp, a)
+	copy(a, b)
+	copy(b, r.tmp)
+}
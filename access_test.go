@@ -0,0 +1,538 @@
+// access_test.go - tests for the typed accessors
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mmap_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/opencoff/go-mmap"
+)
+
+func TestAccessors(t *testing.T) {
+	assert := newAsserter(t)
+
+	m := mmap.NewAnon()
+	p, err := m.Map(2*_PAGE, 0, mmap.PROT_RW, 0)
+	assert(err == nil, "mmap anon: %s", err)
+
+	defer p.Unmap()
+
+	type rt func(p *mmap.Mapping, off int64, o binary.ByteOrder) error
+
+	// each test case writes a value and reads it back
+	tests := []struct {
+		name string
+		sz   int64
+		fp   rt
+	}{
+		{"uint8", 1, func(p *mmap.Mapping, off int64, o binary.ByteOrder) error {
+			return roundTrip(p.PutUint8At, p.Uint8At, off, uint8(0xa5))
+		}},
+		{"uint16", 2, func(p *mmap.Mapping, off int64, o binary.ByteOrder) error {
+			return roundTripOrder(p.PutUint16At, p.Uint16At, off, o, uint16(0xbeef))
+		}},
+		{"uint32", 4, func(p *mmap.Mapping, off int64, o binary.ByteOrder) error {
+			return roundTripOrder(p.PutUint32At, p.Uint32At, off, o, uint32(0xdeadbeef))
+		}},
+		{"uint64", 8, func(p *mmap.Mapping, off int64, o binary.ByteOrder) error {
+			return roundTripOrder(p.PutUint64At, p.Uint64At, off, o, uint64(0xdeadbeefcafef00d))
+		}},
+		{"int16", 2, func(p *mmap.Mapping, off int64, o binary.ByteOrder) error {
+			return roundTripOrder(p.PutInt16At, p.Int16At, off, o, int16(-12345))
+		}},
+		{"int32", 4, func(p *mmap.Mapping, off int64, o binary.ByteOrder) error {
+			return roundTripOrder(p.PutInt32At, p.Int32At, off, o, int32(-123456789))
+		}},
+		{"int64", 8, func(p *mmap.Mapping, off int64, o binary.ByteOrder) error {
+			return roundTripOrder(p.PutInt64At, p.Int64At, off, o, int64(math.MinInt64+7))
+		}},
+		{"float32", 4, func(p *mmap.Mapping, off int64, o binary.ByteOrder) error {
+			return roundTripOrder(p.PutFloat32At, p.Float32At, off, o, float32(-3.25))
+		}},
+		{"float64", 8, func(p *mmap.Mapping, off int64, o binary.ByteOrder) error {
+			return roundTripOrder(p.PutFloat64At, p.Float64At, off, o, math.Pi)
+		}},
+	}
+
+	orders := []binary.ByteOrder{binary.LittleEndian, binary.BigEndian}
+	for _, tc := range tests {
+		// include misaligned offsets and values straddling pages
+		offs := []int64{0, 1, 3, 7, _PAGE - tc.sz/2, 2*_PAGE - tc.sz}
+		for _, off := range offs {
+			for _, o := range orders {
+				err := tc.fp(p, off, o)
+				assert(err == nil, "%s at %d (%s): %s", tc.name, off, o, err)
+			}
+		}
+
+		err := tc.fp(p, 2*_PAGE-tc.sz+1, binary.LittleEndian)
+		assert(err != nil, "%s: out of bounds access succeeded", tc.name)
+
+		err = tc.fp(p, -1, binary.LittleEndian)
+		assert(err != nil, "%s: negative offset succeeded", tc.name)
+	}
+
+	// the byte order must be honored
+	err = p.PutUint32At(0, binary.BigEndian, 0x01020304)
+	assert(err == nil, "put: %s", err)
+	b, _ := p.Uint8At(0)
+	assert(b == 1, "put be: exp 1, saw %d", b)
+
+	// the generic reader agrees with the typed accessors
+	for _, o := range orders {
+		err = p.PutInt32At(3, o, -42)
+		assert(err == nil, "put: %s", err)
+		i32, err := mmap.ReadAt[int32](p, 3, o)
+		assert(err == nil && i32 == -42, "read int32 (%s): exp -42, saw %d: %v", o, i32, err)
+
+		err = p.PutFloat64At(5, o, math.E)
+		assert(err == nil, "put: %s", err)
+		f64, err := mmap.ReadAt[float64](p, 5, o)
+		assert(err == nil && f64 == math.E, "read float64 (%s): exp %v, saw %v: %v", o, math.E, f64, err)
+
+		err = p.PutUint16At(2*_PAGE-2, o, 0xbeef)
+		assert(err == nil, "put: %s", err)
+		u16, err := mmap.ReadAt[uint16](p, 2*_PAGE-2, o)
+		assert(err == nil && u16 == 0xbeef, "read uint16 (%s): exp 0xbeef, saw %#x: %v", o, u16, err)
+	}
+
+	_, err = mmap.ReadAt[uint64](p, 2*_PAGE-7, binary.LittleEndian)
+	assert(err != nil, "generic: out of bounds read succeeded")
+}
+
+func TestAccessorReadOnly(t *testing.T) {
+	assert := newAsserter(t)
+
+	m := mmap.NewAnon()
+	p, err := m.Map(_PAGE, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "mmap anon: %s", err)
+
+	defer p.Unmap()
+
+	v, err := p.Uint64At(8, binary.LittleEndian)
+	assert(err == nil, "read: %s", err)
+	assert(v == 0, "read: exp 0, saw %d", v)
+
+	err = p.PutUint64At(8, binary.LittleEndian, 1)
+	assert(errors.Is(err, mmap.ErrReadOnly), "write: exp read-only error, saw %v", err)
+}
+
+func TestSlice(t *testing.T) {
+	assert := newAsserter(t)
+
+	type rec struct {
+		Id    uint64
+		Count int32
+		Flags [4]uint8
+	}
+
+	n := 2 * _PAGE / 16
+	p, err := mmap.NewAnon().Map(2*_PAGE, 0, mmap.PROT_RW, 0)
+	assert(err == nil, "map anon: %s", err)
+
+	defer p.Unmap()
+
+	recs, err := mmap.Slice[rec](p)
+	assert(err == nil, "slice: %s", err)
+	assert(int64(len(recs)) == n, "slice: exp %d records, saw %d", n, len(recs))
+
+	for i := range recs {
+		recs[i] = rec{Id: uint64(i), Count: int32(-i), Flags: [4]uint8{byte(i), 1, 2, 3}}
+	}
+
+	// read back via a second view and the byte accessors
+	again, err := mmap.Slice[rec](p)
+	assert(err == nil, "slice: %s", err)
+	for i := range again {
+		r := &again[i]
+		assert(r.Id == uint64(i) && r.Count == int32(-i) && r.Flags[0] == byte(i),
+			"rec %d: mismatch %+v", i, *r)
+	}
+
+	v, err := p.Uint64At(16*5, binary.NativeEndian)
+	assert(err == nil, "uint64 at: %s", err)
+	assert(v == 5, "rec 5: exp id 5, saw %d", v)
+
+	_, err = mmap.Slice[[3]byte](p)
+	assert(err != nil, "slice of [3]byte: expected size error")
+
+	_, err = mmap.Slice[*int](p)
+	assert(err != nil, "slice of *int: expected error")
+
+	_, err = mmap.Slice[struct{ S string }](p)
+	assert(err != nil, "slice of struct with string: expected error")
+}
+
+func TestSearchRecords(t *testing.T) {
+	assert := newAsserter(t)
+
+	// sorted even numbers as big-endian uint64 records
+	const n = 1000
+	p, err := mmap.NewAnon().Map(n*8, 0, mmap.PROT_RW, 0)
+	assert(err == nil, "map anon: %s", err)
+
+	defer p.Unmap()
+
+	for i := int64(0); i < n; i++ {
+		err = p.PutUint64At(i*8, binary.BigEndian, uint64(2*i))
+		assert(err == nil, "put %d: %s", i, err)
+	}
+
+	search := func(key uint64) (int64, bool) {
+		return p.SearchRecords(8, func(rec []byte) int {
+			v := binary.BigEndian.Uint64(rec)
+			switch {
+			case v < key:
+				return -1
+			case v > key:
+				return 1
+			}
+			return 0
+		})
+	}
+
+	for _, i := range []int64{0, 1, 499, 998, 999} {
+		idx, ok := search(uint64(2 * i))
+		assert(ok, "key %d: not found", 2*i)
+		assert(idx == i, "key %d: exp index %d, saw %d", 2*i, i, idx)
+	}
+
+	for _, i := range []int64{0, 17, 998} {
+		idx, ok := search(uint64(2*i + 1))
+		assert(!ok, "key %d: unexpectedly found", 2*i+1)
+		assert(idx == i+1, "key %d: exp insert index %d, saw %d", 2*i+1, i+1, idx)
+	}
+
+	idx, ok := search(1 << 40)
+	assert(!ok && idx == n, "key past end: saw %d, %v", idx, ok)
+}
+
+func TestAtomic(t *testing.T) {
+	assert := newAsserter(t)
+
+	fname := tmpName(t)
+	err := createFile(fname, randData(_PAGE))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	// two independent mappings of the same file stand in for two
+	// processes sharing a counter
+	var maps [2]*mmap.MappedFile
+	for i := range maps {
+		maps[i], err = mmap.Open(fname, mmap.PROT_RW)
+		assert(err == nil, "open %s: %s", fname, err)
+		defer maps[i].Close()
+	}
+
+	const off = 64
+	_, err = maps[0].AddUint64(off, -binary.NativeEndian.Uint64(maps[0].Bytes()[off:]))
+	assert(err == nil, "reset: %s", err)
+
+	const n = 10000
+	var wg sync.WaitGroup
+	errs := make(chan error, len(maps))
+	for _, f := range maps {
+		wg.Add(1)
+		go func(f *mmap.MappedFile) {
+			defer wg.Done()
+			for i := 0; i < n; {
+				v, err := f.Uint64At(off, binary.NativeEndian)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				ok, err := f.CompareAndSwapUint64(off, v, v+1)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if ok {
+					i++
+				}
+			}
+		}(f)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert(err == nil, "cas: %s", err)
+	}
+
+	v, err := maps[1].AddUint64(off, 0)
+	assert(err == nil, "add: %s", err)
+	assert(v == 2*n, "counter: exp %d, saw %d", 2*n, v)
+
+	_, err = maps[0].AddUint64(off+4, 1)
+	assert(err != nil, "misaligned add: expected error")
+
+	ro, err := mmap.Open(fname, mmap.PROT_READ)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer ro.Close()
+
+	_, err = ro.CompareAndSwapUint64(off, v, 0)
+	assert(errors.Is(err, mmap.ErrReadOnly), "read-only cas: exp ErrReadOnly, saw %v", err)
+}
+
+func TestSeqlock(t *testing.T) {
+	assert := newAsserter(t)
+
+	fname := tmpName(t)
+	err := createFile(fname, randData(_PAGE))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	w, err := mmap.Open(fname, mmap.PROT_RW)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer w.Close()
+
+	r, err := mmap.Open(fname, mmap.PROT_READ)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer r.Close()
+
+	// a seqlock guarding a pair of values; the second is always the
+	// complement of the first.
+	const seq, a, b = 0, 8, 16
+	ne := binary.NativeEndian
+	assert(w.PutUint64At(seq, ne, 0) == nil, "init seq")
+	assert(w.PutUint64At(a, ne, 0) == nil, "init a")
+	assert(w.PutUint64At(b, ne, ^uint64(0)) == nil, "init b")
+
+	const n = 20000
+	done := make(chan error, 1)
+	go func() {
+		for i := uint64(1); i <= n; i++ {
+			if _, err := w.AddUint64(seq, 1); err != nil {
+				done <- err
+				return
+			}
+			w.StoreUint64(a, i)
+			if i%64 == 0 {
+				runtime.Gosched()
+			}
+			w.StoreUint64(b, ^i)
+			if _, err := w.AddUint64(seq, 1); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	var snaps, retries int
+	for finished := false; !finished; {
+		select {
+		case err := <-done:
+			assert(err == nil, "writer: %s", err)
+			finished = true
+		default:
+		}
+
+		s, ok := r.SeqBeginRead(seq)
+		if !ok {
+			retries++
+			runtime.Gosched()
+			continue
+		}
+
+		x, _ := r.LoadUint64(a)
+		y, _ := r.LoadUint64(b)
+		if !r.SeqEndRead(seq, s) {
+			retries++
+			continue
+		}
+
+		assert(y == ^x, "torn read: %d, %#x", x, y)
+		snaps++
+	}
+	t.Logf("seqlock: %d snapshots, %d retries", snaps, retries)
+
+	s, ok := r.SeqBeginRead(seq)
+	assert(ok && s == 2*n, "seqlock: exp seq %d, saw %d", 2*n, s)
+
+	_, ok = r.SeqBeginRead(4)
+	assert(!ok, "misaligned seqlock: no error")
+}
+
+func TestBitVector(t *testing.T) {
+	assert := newAsserter(t)
+
+	p, err := mmap.NewAnon().Map(_PAGE, 0, mmap.PROT_RW, 0)
+	assert(err == nil, "map: %s", err)
+
+	defer p.Unmap()
+
+	v, err := mmap.NewBitVector(p)
+	assert(err == nil, "bit vector: %s", err)
+	assert(v.Len() == _PAGE*8, "len: exp %d, saw %d", _PAGE*8, v.Len())
+
+	// bits on either side of word boundaries
+	bits := []int64{0, 1, 63, 64, 65, 127, 128, 1000, v.Len() - 1}
+	for _, i := range bits {
+		assert(!v.Test(i), "bit %d: set", i)
+		v.Set(i)
+		assert(v.Test(i), "bit %d: not set", i)
+	}
+
+	for i := int64(0); i < v.Len(); i++ {
+		assert(v.Test(i) == slices.Contains(bits, i), "bit %d: wrong value", i)
+	}
+
+	b := p.Bytes()
+	assert(binary.NativeEndian.Uint64(b[8:]) == 1|1<<1|1<<63, "word 1: %#x", binary.NativeEndian.Uint64(b[8:]))
+
+	v.Clear(64)
+	assert(!v.Test(64) && v.Test(63) && v.Test(65), "clear 64: neighbours changed")
+
+	assert(!v.SetAtomic(63), "set atomic 63: was clear")
+	assert(v.ClearAtomic(63), "clear atomic 63: was clear")
+	assert(!v.Test(63), "clear atomic 63: still set")
+
+	panicked := func(fn func()) (ok bool) {
+		defer func() {
+			ok = recover() != nil
+		}()
+		fn()
+		return false
+	}
+	assert(panicked(func() { v.Test(v.Len()) }), "test out of range: no panic")
+	assert(panicked(func() { v.Set(-1) }), "set out of range: no panic")
+
+	ro, err := mmap.NewAnon().Map(_PAGE, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map: %s", err)
+
+	defer ro.Unmap()
+
+	_, err = mmap.NewBitVector(ro)
+	assert(errors.Is(err, mmap.ErrReadOnly), "read-only: exp ErrReadOnly, saw %v", err)
+}
+
+func TestBitVectorConcurrent(t *testing.T) {
+	assert := newAsserter(t)
+
+	p, err := mmap.NewAnon().Map(_PAGE, 0, mmap.PROT_RW, 0)
+	assert(err == nil, "map: %s", err)
+
+	defer p.Unmap()
+
+	v, err := mmap.NewBitVector(p)
+	assert(err == nil, "bit vector: %s", err)
+
+	// goroutine g owns the bits i where i % n == g; so they all share
+	// every word.
+	const n = 8
+	var wg sync.WaitGroup
+	for g := int64(0); g < n; g++ {
+		wg.Add(1)
+		go func(g int64) {
+			defer wg.Done()
+			for i := g; i < v.Len(); i += n {
+				v.SetAtomic(i)
+			}
+			for i := g; i < v.Len(); i += 2 * n {
+				v.ClearAtomic(i)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for i := int64(0); i < v.Len(); i++ {
+		exp := (i/n)%2 == 1
+		assert(v.Test(i) == exp, "bit %d: exp %v", i, exp)
+	}
+}
+
+func TestSortRecords(t *testing.T) {
+	assert := newAsserter(t)
+
+	// 16 byte records: a big endian key and a payload derived from it
+	const recSize = 16
+	const n = 5000
+
+	keys := make([]uint64, n)
+	for i := range keys {
+		keys[i] = uint64(i) * 7
+	}
+	rand.Shuffle(n, func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+
+	var buf []byte
+	for _, k := range keys {
+		buf = binary.BigEndian.AppendUint64(buf, k)
+		buf = binary.BigEndian.AppendUint64(buf, ^k)
+	}
+
+	fname := tmpName(t)
+	err := os.WriteFile(fname, buf, 0600)
+	assert(err == nil, "write %s: %s", fname, err)
+
+	fd, err := os.OpenFile(fname, os.O_RDWR, 0)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	err = mmap.SortRecords(fd, recSize, func(a, b []byte) bool {
+		return bytes.Compare(a[:8], b[:8]) < 0
+	})
+	assert(err == nil, "sort: %s", err)
+
+	got, err := os.ReadFile(fname)
+	assert(err == nil, "read %s: %s", fname, err)
+	assert(len(got) == n*recSize, "sort: exp %d bytes, saw %d", n*recSize, len(got))
+
+	for i := 0; i < n; i++ {
+		k := binary.BigEndian.Uint64(got[i*recSize:])
+		v := binary.BigEndian.Uint64(got[i*recSize+8:])
+		assert(k == uint64(i)*7, "record %d: exp key %d, saw %d", i, i*7, k)
+		assert(v == ^k, "record %d: payload mismatch", i)
+	}
+
+	err = mmap.SortRecords(fd, 3, func(a, b []byte) bool { return false })
+	assert(err != nil, "sort: partial record: no error")
+}
+
+func roundTrip[T comparable](put func(int64, T) error, get func(int64) (T, error), off int64, v T) error {
+	if err := put(off, v); err != nil {
+		return err
+	}
+
+	r, err := get(off)
+	if err != nil {
+		return err
+	}
+	if r != v {
+		return fmt.Errorf("exp %v, saw %v", v, r)
+	}
+	return nil
+}
+
+func roundTripOrder[T comparable](put func(int64, binary.ByteOrder, T) error,
+	get func(int64, binary.ByteOrder) (T, error), off int64, o binary.ByteOrder, v T) error {
+
+	return roundTrip(func(off int64, v T) error { return put(off, o, v) },
+		func(off int64) (T, error) { return get(off, o) }, off, v)
+}
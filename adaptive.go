@@ -0,0 +1,82 @@
+// adaptive.go - access pattern driven madvise(2)
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mmap
+
+// advice is the OS independent form of the madvise(2) hints
+type advice int
+
+const (
+	adviseNormal advice = iota
+	adviseSequential
+	adviseRandom
+)
+
+// number of consecutive sequential (or scattered) mappings needed to
+// switch the advice
+const adaptRun = 4
+
+// adviseFn issues the advice for a mapping; tests replace it to observe
+// the advice.
+var adviseFn = (*Mapping).advise
+
+// adaptive tracks the pattern of mappings requested from an Mmap
+type adaptive struct {
+	on bool
+
+	// file offset that continues the previous mapping
+	next int64
+
+	// length of the current run of sequential or scattered mappings
+	seq bool
+	run int
+
+	cur advice
+}
+
+// SetAdaptiveAdvice enables (or disables) access pattern detection:
+// when successive calls to Map request adjacent windows of the file,
+// the new mappings are advised as sequential (MADV_SEQUENTIAL) for
+// aggressive readahead; when the windows are scattered, they are
+// advised as random (MADV_RANDOM). The advice only changes after a run
+// of mappings with the new pattern. It must be called before any
+// mappings are created.
+func (m *Mmap) SetAdaptiveAdvice(on bool) {
+	m.adapt = adaptive{on: on}
+}
+
+// adaptTo records the mapping of 'sz' bytes at 'off' and advises the
+// mapping 'p' as per the current access pattern
+func (m *Mmap) adaptTo(p *Mapping, off, sz int64) {
+	m.mu.Lock()
+	a := &m.adapt
+	seq := off == a.next
+	if seq != a.seq {
+		a.seq = seq
+		a.run = 0
+	}
+
+	a.next = off + sz
+	if a.run++; a.run >= adaptRun {
+		a.cur = adviseRandom
+		if seq {
+			a.cur = adviseSequential
+		}
+	}
+	adv := a.cur
+	m.mu.Unlock()
+
+	if adv != adviseNormal {
+		adviseFn(p, adv)
+	}
+}
@@ -0,0 +1,111 @@
+// bitvec.go - a bit vector over a mapping
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mmap
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+// BitVector is a bit vector stored in a writable mapping (eg a
+// persistent allocation bitmap); bit i is bit i%64 of the i/64'th
+// host order uint64 of the mapping. Any trailing bytes of the mapping
+// that don't make up a whole uint64 are unused. The plain methods must
+// not be used concurrently with other updates; the atomic variants can.
+// Indices must be less than Len(); out of range indices panic just like
+// slice indexing.
+type BitVector struct {
+	p *Mapping
+	w []uint64
+}
+
+// NewBitVector returns a bit vector over the writable mapping 'p'
+func NewBitVector(p *Mapping) (*BitVector, error) {
+	if !p.wr {
+		return nil, fmt.Errorf("mmap: bit vector: %w", ErrReadOnly)
+	}
+
+	b := p.bytes()
+	if len(b) < 8 {
+		return nil, fmt.Errorf("mmap: bit vector: mapping of %d bytes is too small", len(b))
+	}
+
+	v := &BitVector{
+		p: p,
+		w: unsafe.Slice((*uint64)(unsafe.Pointer(&b[0])), len(b)/8),
+	}
+	return v, nil
+}
+
+// Len returns the number of bits in the vector
+func (v *BitVector) Len() int64 {
+	return int64(len(v.w)) * 64
+}
+
+// Set sets bit i
+func (v *BitVector) Set(i int64) {
+	w, m := v.word(i)
+	*w |= m
+}
+
+// Clear clears bit i
+func (v *BitVector) Clear(i int64) {
+	w, m := v.word(i)
+	*w &^= m
+}
+
+// Test returns true if bit i is set
+func (v *BitVector) Test(i int64) bool {
+	w, m := v.word(i)
+	return atomic.LoadUint64(w)&m != 0
+}
+
+// SetAtomic atomically sets bit i; it returns true if the bit was
+// previously clear.
+func (v *BitVector) SetAtomic(i int64) bool {
+	w, m := v.word(i)
+	for {
+		old := atomic.LoadUint64(w)
+		if old&m != 0 {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(w, old, old|m) {
+			return true
+		}
+	}
+}
+
+// ClearAtomic atomically clears bit i; it returns true if the bit was
+// previously set.
+func (v *BitVector) ClearAtomic(i int64) bool {
+	w, m := v.word(i)
+	for {
+		old := atomic.LoadUint64(w)
+		if old&m == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(w, old, old&^m) {
+			return true
+		}
+	}
+}
+
+// word returns the word holding bit i and the mask for the bit
+func (v *BitVector) word(i int64) (*uint64, uint64) {
+	if i < 0 || i >= v.Len() {
+		panic(fmt.Sprintf("mmap: bit vector: index %d out of range [0:%d]", i, v.Len()))
+	}
+	return &v.w[i/64], 1 << (i % 64)
+}
@@ -0,0 +1,52 @@
+// caps.go - feature detection
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mmap
+
+import (
+	"sync"
+)
+
+// Caps describes the memory mapping features of the running OS
+type Caps struct {
+	// MapSync is true if the kernel supports MAP_SHARED_VALIDATE and
+	// hence MAP_SYNC. MAP_SYNC additionally needs a file on a DAX
+	// capable filesystem.
+	MapSync bool
+
+	// HugeTLB is true if huge pages are provisioned for F_HUGETLB
+	HugeTLB bool
+
+	// Mincore is true if page residency (Resident) can be queried
+	Mincore bool
+
+	// Mremap is true if mappings can be resized in place
+	Mremap bool
+
+	// SoftDirty is true if the kernel tracks soft-dirty pages
+	SoftDirty bool
+}
+
+var caps struct {
+	sync.Once
+	Caps
+}
+
+// Capabilities returns the features supported by the running OS; they
+// are probed once and cached.
+func Capabilities() Caps {
+	caps.Do(func() {
+		caps.Caps = probeCaps()
+	})
+	return caps.Caps
+}
@@ -0,0 +1,19 @@
+// export_linux_test.go - export linux internals for tests
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+
+package mmap
+
+// IsNetworkFSType classifies a statfs(2) f_type
+var IsNetworkFSType = isNetworkFS
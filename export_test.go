@@ -0,0 +1,61 @@
+// export_test.go - export internals for tests
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mmap
+
+// ForEachLineChunk is ForEachLine with an explicit chunk size
+var ForEachLineChunk = forEachLine
+
+// ForEachVarintRecordChunk is ForEachVarintRecord with an explicit
+// chunk size
+var ForEachVarintRecordChunk = forEachVarintRecord
+
+// Advice exposes the madvise hints issued in adaptive mode
+type Advice = advice
+
+const (
+	AdviseSequential = adviseSequential
+	AdviseRandom     = adviseRandom
+)
+
+// SetLockHook replaces the Lock call of LockAll with fn; a nil fn
+// restores it.
+func SetLockHook(fn func(p *Mapping) error) {
+	if fn == nil {
+		fn = (*Mapping).Lock
+	}
+	lockFn = fn
+}
+
+// SetObserver sets the observer of the mappings of g
+func (g *GrowingMapping) SetObserver(o Observer) {
+	g.m.SetObserver(o)
+}
+
+// SetUnmapHook replaces the unmap call of Reader with fn; a nil fn
+// restores it.
+func SetUnmapHook(fn func(p *Mapping) error) {
+	if fn == nil {
+		fn = (*Mapping).unmap
+	}
+	unmapFn = fn
+}
+
+// SetAdviseHook replaces the madvise call of the adaptive mode with fn;
+// a nil fn restores it.
+func SetAdviseHook(fn func(p *Mapping, a Advice) error) {
+	if fn == nil {
+		fn = (*Mapping).advise
+	}
+	adviseFn = fn
+}
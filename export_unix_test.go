@@ -0,0 +1,19 @@
+// export_unix_test.go - export unix internals for tests
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build darwin || linux || freebsd || openbsd || solaris || netbsd || dragonfly
+
+package mmap
+
+// InjectFault replaces the mmap(2) syscall; nil restores it
+var InjectFault = setFaultInjector
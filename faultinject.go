@@ -0,0 +1,26 @@
+// faultinject.go - fault injection for the mmap syscall layer
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build mmap_faultinject && (darwin || linux || freebsd || openbsd || solaris || netbsd || dragonfly)
+
+package mmap
+
+// SetFaultInjector replaces the mmap(2) syscall used by this package
+// with fn; a nil fn restores the real syscall. fn has the signature of
+// unix.Mmap. This lets downstream code test its error handling (eg by
+// returning unix.ENOMEM) without real resource exhaustion. It is only
+// available when built with the 'mmap_faultinject' tag and is not safe
+// to call concurrently with mappings being created.
+func SetFaultInjector(fn func(fd int, off int64, sz int, prot, flags int) ([]byte, error)) {
+	setFaultInjector(fn)
+}
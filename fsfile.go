@@ -0,0 +1,103 @@
+// fsfile.go - io/fs view of a mapping
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mmap
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+)
+
+// AsFile returns a read-only fs.File over the contents of the mapping;
+// its Stat reports 'name', 'modTime' and the mapping length as the
+// size. The file also implements io.Seeker and io.ReaderAt - so it can
+// be used with http.ServeContent and friends without copies. Closing
+// the file doesn't unmap the mapping; the caller must keep the mapping
+// alive while the file is in use.
+func (p *Mapping) AsFile(name string, modTime time.Time) fs.File {
+	b := p.bytes()
+	f := &mapFile{
+		Reader: bytes.NewReader(b),
+		fi: fileInfo{
+			name: path.Base(name),
+			size: int64(len(b)),
+			mod:  modTime,
+		},
+	}
+	return f
+}
+
+type mapFile struct {
+	*bytes.Reader
+	fi     fileInfo
+	closed bool
+}
+
+var _ fs.File = &mapFile{}
+var _ io.ReadSeeker = &mapFile{}
+var _ io.ReaderAt = &mapFile{}
+
+func (f *mapFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, fs.ErrClosed
+	}
+	return &f.fi, nil
+}
+
+func (f *mapFile) Read(b []byte) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	return f.Reader.Read(b)
+}
+
+func (f *mapFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	return f.Reader.ReadAt(b, off)
+}
+
+func (f *mapFile) Seek(off int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	return f.Reader.Seek(off, whence)
+}
+
+func (f *mapFile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// fileInfo describes a mapFile
+type fileInfo struct {
+	name string
+	size int64
+	mod  time.Time
+}
+
+var _ fs.FileInfo = &fileInfo{}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return 0444 }
+func (fi *fileInfo) ModTime() time.Time { return fi.mod }
+func (fi *fileInfo) IsDir() bool        { return false }
+func (fi *fileInfo) Sys() any           { return nil }
@@ -0,0 +1,28 @@
+// fstype_openbsd.go - filesystem type on OpenBSD
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mmap
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+func fsType(fd *os.File) (string, error) {
+	var st unix.Statfs_t
+
+	if err := unix.Fstatfs(int(fd.Fd()), &st); err != nil {
+		return "", os.NewSyscallError("fstatfs", err)
+	}
+	return unix.ByteSliceToString(st.F_fstypename[:]), nil
+}
@@ -1,5 +1,5 @@
 module github.com/opencoff/go-mmap
 
-go 1.22.2
+go 1.23
 
 require golang.org/x/sys v0.28.0
@@ -0,0 +1,218 @@
+// growing.go - a mapping that grows the file on demand
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mmap
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// GrowingMapping is a writable mapping of a file that behaves like an
+// extensible byte array: writes past the end of the mapping grow the
+// file and remap it. The file is grown in page multiples (at least
+// doubling the mapping to amortize remaps); regions that are never
+// written are sparse holes. Flush only writes back the pages written
+// since the last Flush. Close trims the file to the end of the furthest
+// write. All methods are safe for concurrent use.
+type GrowingMapping struct {
+	mu sync.Mutex
+
+	fd *os.File
+	m  *Mmap
+	p  *Mapping
+
+	// size of the mapping and the end of the furthest write
+	mapped int64
+	size   int64
+
+	// [lo, hi) covers the writes since the last Flush
+	lo, hi int64
+
+	closed bool
+}
+
+var _ io.ReaderAt = &GrowingMapping{}
+var _ io.WriterAt = &GrowingMapping{}
+
+// NewGrowingMapping returns a growing mapping of the file 'fd' which
+// must be opened read-write; the existing contents of the file are
+// preserved.
+func NewGrowingMapping(fd *os.File) (*GrowingMapping, error) {
+	st, err := fd.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("mmap: %w", err)
+	}
+
+	g := &GrowingMapping{
+		fd:   fd,
+		m:    New(fd),
+		size: st.Size(),
+	}
+
+	if g.size > 0 {
+		if err := g.remap(g.size); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// WriteAt writes b at offset 'off', growing the file as needed
+func (g *GrowingMapping) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("mmap: %s: write at %d: invalid offset", g.fd.Name(), off)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return 0, fmt.Errorf("mmap: %s: write at %d: %w", g.fd.Name(), off, os.ErrClosed)
+	}
+
+	end := off + int64(len(b))
+	if end > g.mapped {
+		// g.size covers the case of a failed remap
+		if err := g.remap(max(end, g.size, min(2*g.mapped, _MaxMmapSize))); err != nil {
+			return 0, err
+		}
+	}
+
+	copy(g.p.bytes()[off:end], b)
+	g.size = max(g.size, end)
+
+	if len(b) > 0 {
+		if g.lo >= g.hi {
+			g.lo, g.hi = off, end
+		} else {
+			g.lo, g.hi = min(g.lo, off), max(g.hi, end)
+		}
+	}
+	return len(b), nil
+}
+
+// ReadAt reads len(b) bytes at offset 'off'; it returns io.EOF if it
+// reads past the end of the furthest write.
+func (g *GrowingMapping) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("mmap: %s: read at %d: invalid offset", g.fd.Name(), off)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return 0, fmt.Errorf("mmap: %s: read at %d: %w", g.fd.Name(), off, os.ErrClosed)
+	}
+
+	if off >= g.size {
+		return 0, io.EOF
+	}
+
+	// a failed remap leaves us without a mapping
+	if g.p == nil {
+		if err := g.remap(g.size); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, g.p.bytes()[off:g.size])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Size returns the end of the furthest write
+func (g *GrowingMapping) Size() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.size
+}
+
+// Flush writes the changes since the last Flush to the backing file
+func (g *GrowingMapping) Flush() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return fmt.Errorf("mmap: %s: flush: %w", g.fd.Name(), os.ErrClosed)
+	}
+
+	if g.p == nil || g.lo >= g.hi {
+		return nil
+	}
+
+	if err := g.p.FlushRange(g.lo, g.hi-g.lo); err != nil {
+		return err
+	}
+	g.lo, g.hi = 0, 0
+	return nil
+}
+
+// Close unmaps the file and trims it to the end of the furthest write;
+// the file itself is left open. Later calls other than Close return
+// os.ErrClosed.
+func (g *GrowingMapping) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return nil
+	}
+	g.closed = true
+
+	var err error
+	if g.p != nil {
+		err = g.p.Unmap()
+		g.p, g.mapped = nil, 0
+	}
+
+	if err == nil {
+		err = g.fd.Truncate(g.size)
+	}
+	return err
+}
+
+// remap grows the file to at least 'sz' bytes (rounded up to a page)
+// and maps all of it
+func (g *GrowingMapping) remap(sz int64) error {
+	// pageRound clamps to the largest mapping
+	n := pageRound(sz)
+	if n < sz {
+		return fmt.Errorf("mmap: %s: grow to %d: too large", g.fd.Name(), sz)
+	}
+	sz = n
+
+	if g.p != nil {
+		if err := g.p.Unmap(); err != nil {
+			return err
+		}
+		g.p, g.mapped = nil, 0
+	}
+
+	if err := extend(g.fd, sz); err != nil {
+		return fmt.Errorf("mmap: %s: grow to %d: %w", g.fd.Name(), sz, err)
+	}
+
+	p, err := g.m.Map(sz, 0, PROT_RW, 0)
+	if err != nil {
+		return err
+	}
+
+	g.p, g.mapped = p, sz
+	return nil
+}
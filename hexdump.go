@@ -0,0 +1,63 @@
+// hexdump.go - debug dumps of a mapping
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mmap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// HexDump writes a hex and ASCII dump of the 'n' bytes of the mapping
+// at offset 'off' to w, in the format of xxd(1). The offsets in the
+// dump are offsets into the mapping.
+func (p *Mapping) HexDump(off, n int64, w io.Writer) error {
+	if n < 0 {
+		return fmt.Errorf("mmap: hexdump %d bytes at %d: invalid length", n, off)
+	}
+
+	b, err := p.window(off, int(n))
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	for len(b) > 0 {
+		ln := b[:min(16, len(b))]
+		b = b[len(ln):]
+
+		fmt.Fprintf(bw, "%08x: ", off)
+		for i := 0; i < 16; i++ {
+			if i < len(ln) {
+				fmt.Fprintf(bw, "%02x", ln[i])
+			} else {
+				bw.WriteString("  ")
+			}
+			if i&1 == 1 {
+				bw.WriteByte(' ')
+			}
+		}
+
+		bw.WriteByte(' ')
+		for _, c := range ln {
+			if c < 0x20 || c > 0x7e {
+				c = '.'
+			}
+			bw.WriteByte(c)
+		}
+		bw.WriteByte('\n')
+		off += 16
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,29 @@
+// icache_arm64.go - instruction cache maintenance on arm64
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build arm64 && !windows
+
+package mmap
+
+// syncICache makes the instructions written to [start, end) visible to
+// instruction fetch: arm64 doesn't keep the I-cache coherent with the
+// D-cache.
+//
+//go:noescape
+func syncICache(start, end uintptr)
+
+func (p *Mapping) syncICache(off, n int64) error {
+	start := p.addr() + uintptr(off)
+	syncICache(start, start+uintptr(n))
+	return nil
+}
@@ -0,0 +1,60 @@
+// icache_arm64.s - instruction cache maintenance on arm64
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build arm64 && !windows
+
+#include "textflag.h"
+
+// func syncICache(start, end uintptr)
+//
+// Clean the D-cache lines to the point of unification, then invalidate
+// the I-cache lines; the line sizes come from CTR_EL0.
+TEXT ·syncICache(SB), NOSPLIT, $0-16
+	MOVD	start+0(FP), R0
+	MOVD	end+8(FP), R1
+	MRS	CTR_EL0, R2
+	MOVD	$4, R4
+
+	// D-cache line: 4 << CTR_EL0.DminLine
+	UBFX	$16, R2, $4, R3
+	LSL	R3, R4, R3
+	SUB	$1, R3, R6
+	BIC	R6, R0, R7
+
+dloop:
+	CMP	R1, R7
+	BHS	ddone
+	DC	CVAU, R7
+	ADD	R3, R7
+	B	dloop
+
+ddone:
+	DSB	$0xb // ISH
+
+	// I-cache line: 4 << CTR_EL0.IminLine
+	AND	$0xf, R2, R5
+	LSL	R5, R4, R5
+	SUB	$1, R5, R6
+	BIC	R6, R0, R7
+
+iloop:
+	CMP	R1, R7
+	BHS	idone
+	WORD	$0xd50b7527 // IC IVAU, R7
+	ADD	R5, R7
+	B	iloop
+
+idone:
+	DSB	$0xb // ISH
+	ISB	$0xf
+	RET
@@ -0,0 +1,22 @@
+// icache_other.go - instruction cache maintenance on other archs
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !386 && !amd64 && !arm64 && !windows
+
+package mmap
+
+// XXX these archs need explicit I-cache maintenance that we don't do
+// (yet)
+func (p *Mapping) syncICache(off, n int64) error {
+	return unsupported("sync icache")
+}
@@ -0,0 +1,63 @@
+// icache_test.go - tests for instruction cache maintenance
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build (amd64 || arm64) && (darwin || linux || freebsd || openbsd || netbsd)
+
+package mmap_test
+
+import (
+	"runtime"
+	"testing"
+	"unsafe"
+
+	"github.com/opencoff/go-mmap"
+)
+
+// ret42 is a function returning 42 in the register ABI
+var ret42 = map[string][]byte{
+	// mov eax, 42; ret
+	"amd64": {0xb8, 0x2a, 0x00, 0x00, 0x00, 0xc3},
+
+	// movz x0, #42; ret
+	"arm64": {0x40, 0x05, 0x80, 0xd2, 0xc0, 0x03, 0x5f, 0xd6},
+}
+
+func TestSyncInstructionCache(t *testing.T) {
+	assert := newAsserter(t)
+
+	p, err := mmap.NewAnon().Map(_PAGE, 0, mmap.PROT_RW, mmap.F_COW)
+	assert(err == nil, "map anon: %s", err)
+
+	defer p.Unmap()
+
+	code := ret42[runtime.GOARCH]
+	copy(p.Bytes(), code)
+
+	err = p.SyncInstructionCache(0, int64(len(code)))
+	assert(err == nil, "sync icache: %s", err)
+
+	err = p.SyncInstructionCache(1, _PAGE)
+	assert(err != nil, "sync icache out of bounds: no error")
+
+	if err = p.Protect(mmap.PROT_RX); err != nil {
+		t.Skipf("exec mappings disallowed: %s", err)
+	}
+
+	// a func value points to a word holding the entry point
+	entry := uintptr(unsafe.Pointer(&p.Bytes()[0]))
+	pc := &entry
+	fn := *(*func() int)(unsafe.Pointer(&pc))
+
+	n := fn()
+	assert(n == 42, "jit: exp 42, saw %d", n)
+}
@@ -0,0 +1,21 @@
+// icache_x86.go - instruction cache maintenance on x86
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build (386 || amd64) && !windows
+
+package mmap
+
+// x86 keeps the I-cache coherent with the D-cache
+func (p *Mapping) syncICache(off, n int64) error {
+	return nil
+}
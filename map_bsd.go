@@ -4,8 +4,110 @@
 
 package mmap
 
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
 // Darwin doesn't have these; so we mark them zero
 const (
-	_MAP_HUGETLB  = 0
-	_MAP_POPULATE = 0
+	_MAP_HUGETLB   = 0
+	_MAP_POPULATE  = 0
+	_MAP_NORESERVE = 0
+	_MAP_GROWSDOWN = 0
+
+	_MAP_UNINITIALIZED = 0
+
+	// not all BSDs have RLIMIT_AS
+	_RLIMIT_AS = -1
+
+	_RUSAGE_WHO = unix.RUSAGE_SELF
 )
+
+// XXX each BSD has its own ioctl for the media size
+func getBlockDevSize(fd *os.File) (int64, error) {
+	return 0, fmt.Errorf("block device size: %w", ErrUnsupported)
+}
+
+// spillFile creates an unnamed temp file in dir
+func spillFile(dir string) (*os.File, error) {
+	return unlinkedTempFile(dir)
+}
+
+func (p *Mapping) coreDump(on bool) error {
+	return unsupported("core dump")
+}
+
+// XXX no posix_fadvise(2); we rely on the kernel to evict the pages.
+func dropCache(fd *os.File, off, n int64) error {
+	return nil
+}
+
+// XXX ditto; we rely on the kernel's own readahead.
+func readAhead(fd *os.File, off, n int64) error {
+	return nil
+}
+
+func cloneFile(src, dst string) error {
+	return ErrUnsupported
+}
+
+func networkFS(fd *os.File) (bool, error) {
+	return false, ErrUnsupported
+}
+
+func (p *Mapping) setName(nm string) error {
+	return unsupported("set name")
+}
+
+func (p *Mapping) collapseHuge() error {
+	return unsupported("collapse huge")
+}
+
+func (p *Mapping) populate(write bool) error {
+	return unsupported("populate")
+}
+
+func futexWait(v *uint32, expect uint32) error {
+	return unsupported("futex")
+}
+
+func futexWake(v *uint32, n int) (int, error) {
+	return 0, unsupported("futex")
+}
+
+// XXX no fdatasync(2); fall back to a full sync
+func fdatasync(fd *os.File) error {
+	return fd.Sync()
+}
+
+// canMap is a best-effort check against the physical memory
+func canMap(sz int64) (bool, error) {
+	mem, err := unix.SysctlUint64("hw.physmem64")
+	if err != nil {
+		// FreeBSD calls it hw.physmem
+		if mem, err = unix.SysctlUint64("hw.physmem"); err != nil {
+			return false, fmt.Errorf("mmap: can map: %w", err)
+		}
+	}
+	return uint64(sz) <= mem, nil
+}
+
+func copyRange(src, dst *os.File, off, n int64) error {
+	return unsupported("copy range")
+}
+
+func dioAlign(fd *os.File) (mem, off int64, err error) {
+	return 0, 0, unsupported("direct io align")
+}
+
+func smapsStats(start, end uintptr) (SmapStats, error) {
+	return SmapStats{}, unsupported("smaps")
+}
+
+func probeCaps() Caps {
+	return Caps{
+		Mincore: true,
+	}
+}
@@ -13,8 +13,17 @@ import (
 
 // Darwin doesn't have these; so we mark them zero
 const (
-	_MAP_HUGETLB  = 0
-	_MAP_POPULATE = 0
+	_MAP_HUGETLB   = 0
+	_MAP_POPULATE  = 0
+	_MAP_GROWSDOWN = 0
+
+	_MAP_UNINITIALIZED = 0
+
+	_MAP_NORESERVE = unix.MAP_NORESERVE
+
+	_RLIMIT_AS = unix.RLIMIT_AS
+
+	_RUSAGE_WHO = unix.RUSAGE_SELF
 
 	_DKIOCGETBLOCKSIZE  = 0x40046418
 	_DKIOCGETBLOCKCOUNT = 0x40086419
@@ -40,3 +49,158 @@ func getBlockDevSize(fd *os.File) (int64, error) {
 
 	return int64(lo), nil
 }
+
+// spillFile creates an unnamed temp file in dir
+func spillFile(dir string) (*os.File, error) {
+	return unlinkedTempFile(dir)
+}
+
+func preallocate(fd *os.File, off, n int64) error {
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	// F_PEOFPOSMODE allocates relative to the physical end of file;
+	// so we only ask for what lies beyond it.
+	if more := off + n - fi.Size(); more > 0 {
+		st := unix.Fstore_t{
+			Flags:   unix.F_ALLOCATECONTIG | unix.F_ALLOCATEALL,
+			Posmode: unix.F_PEOFPOSMODE,
+			Offset:  0,
+			Length:  more,
+		}
+
+		// F_PREALLOCATE allocates blocks but doesn't change the file
+		// size; try contiguous blocks first
+		if err := unix.FcntlFstore(fd.Fd(), unix.F_PREALLOCATE, &st); err != nil {
+			st.Flags = unix.F_ALLOCATEALL
+			if err := unix.FcntlFstore(fd.Fd(), unix.F_PREALLOCATE, &st); err != nil {
+				return err
+			}
+		}
+	}
+	return extend(fd, off+n)
+}
+
+func (p *Mapping) coreDump(on bool) error {
+	return unsupported("core dump")
+}
+
+// XXX no posix_fadvise(2); we rely on the kernel to evict the pages.
+func dropCache(fd *os.File, off, n int64) error {
+	return nil
+}
+
+// XXX ditto; we rely on the kernel's own readahead.
+func readAhead(fd *os.File, off, n int64) error {
+	return nil
+}
+
+func cloneFile(src, dst string) error {
+	err := unix.Clonefile(src, dst, 0)
+	switch err {
+	case nil:
+		return nil
+	case unix.ENOTSUP, unix.EXDEV:
+		return fmt.Errorf("%w: %w", ErrUnsupported, err)
+	default:
+		return err
+	}
+}
+
+// networkFS returns true if fd is on a network filesystem
+func networkFS(fd *os.File) (bool, error) {
+	var st unix.Statfs_t
+
+	if err := unix.Fstatfs(int(fd.Fd()), &st); err != nil {
+		return false, os.NewSyscallError("fstatfs", err)
+	}
+
+	switch unix.ByteSliceToString(st.Fstypename[:]) {
+	case "nfs", "smbfs", "afpfs", "webdav":
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p *Mapping) setName(nm string) error {
+	return unsupported("set name")
+}
+
+func (p *Mapping) collapseHuge() error {
+	return unsupported("collapse huge")
+}
+
+func (p *Mapping) populate(write bool) error {
+	return unsupported("populate")
+}
+
+func futexWait(v *uint32, expect uint32) error {
+	return unsupported("futex")
+}
+
+func futexWake(v *uint32, n int) (int, error) {
+	return 0, unsupported("futex")
+}
+
+// XXX no fdatasync(2); fall back to a full sync
+func fdatasync(fd *os.File) error {
+	return fd.Sync()
+}
+
+// canMap is a best-effort check against the physical memory; darwin
+// has dynamic swap and doesn't expose its free memory cheaply.
+func canMap(sz int64) (bool, error) {
+	mem, err := unix.SysctlUint64("hw.memsize")
+	if err != nil {
+		return false, fmt.Errorf("mmap: can map: %w", err)
+	}
+	return uint64(sz) <= mem, nil
+}
+
+func copyRange(src, dst *os.File, off, n int64) error {
+	return unsupported("copy range")
+}
+
+func smapsStats(start, end uintptr) (SmapStats, error) {
+	return SmapStats{}, unsupported("smaps")
+}
+
+func probeCaps() Caps {
+	return Caps{
+		Mincore: true,
+	}
+}
+
+// dioAlign returns the alignment needed for uncached (F_NOCACHE) I/O;
+// it is the block size of the device or filesystem.
+func dioAlign(fd *os.File) (mem, off int64, err error) {
+	st, err := fd.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if st.Mode()&os.ModeDevice != 0 && st.Mode()&os.ModeCharDevice == 0 {
+		bsz, err := unix.IoctlGetInt(int(fd.Fd()), _DKIOCGETBLOCKSIZE)
+		if err != nil {
+			return 0, 0, fmt.Errorf("block size: %w", err)
+		}
+		return int64(bsz), int64(bsz), nil
+	}
+
+	var sfs unix.Statfs_t
+	if err := unix.Fstatfs(int(fd.Fd()), &sfs); err != nil {
+		return 0, 0, os.NewSyscallError("fstatfs", err)
+	}
+	return int64(sfs.Bsize), int64(sfs.Bsize), nil
+}
+
+func fsType(fd *os.File) (string, error) {
+	var st unix.Statfs_t
+
+	if err := unix.Fstatfs(int(fd.Fd()), &st); err != nil {
+		return "", os.NewSyscallError("fstatfs", err)
+	}
+	return unix.ByteSliceToString(st.Fstypename[:]), nil
+}
@@ -5,15 +5,31 @@
 package mmap
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"golang.org/x/sys/unix"
+	"io"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"unsafe"
 )
 
 const (
-	_MAP_HUGETLB  = unix.MAP_HUGETLB
-	_MAP_POPULATE = unix.MAP_POPULATE
+	_MAP_HUGETLB   = unix.MAP_HUGETLB
+	_MAP_POPULATE  = unix.MAP_POPULATE
+	_MAP_NORESERVE = unix.MAP_NORESERVE
+	_MAP_GROWSDOWN = unix.MAP_GROWSDOWN
+
+	// missing in x/sys/unix; see mmap(2)
+	_MAP_UNINITIALIZED = 0x4000000
+
+	_RLIMIT_AS = unix.RLIMIT_AS
+
+	// page faults of the calling thread
+	_RUSAGE_WHO = unix.RUSAGE_THREAD
 )
 
 func getBlockDevSize(fd *os.File) (int64, error) {
@@ -25,3 +41,482 @@ func getBlockDevSize(fd *os.File) (int64, error) {
 	}
 	return sz, nil
 }
+
+// spillFile opens an unnamed O_TMPFILE in dir; it falls back to an
+// unlinked temp file on filesystems that don't support O_TMPFILE.
+func spillFile(dir string) (*os.File, error) {
+	fd, err := unix.Open(dir, unix.O_TMPFILE|unix.O_RDWR|unix.O_CLOEXEC, 0600)
+	switch err {
+	case nil:
+		return os.NewFile(uintptr(fd), filepath.Join(dir, "<spill>")), nil
+	case unix.EOPNOTSUPP, unix.EISDIR, unix.EINVAL:
+		return unlinkedTempFile(dir)
+	default:
+		return nil, err
+	}
+}
+
+func preallocate(fd *os.File, off, n int64) error {
+	return unix.Fallocate(int(fd.Fd()), 0, off, n)
+}
+
+func (p *Mapping) coreDump(on bool) error {
+	adv := unix.MADV_DONTDUMP
+	if on {
+		adv = unix.MADV_DODUMP
+	}
+
+	if err := p.checkHoles("madvise", 0, int64(len(p.buf))); err != nil {
+		return err
+	}
+	if err := unix.Madvise(p.buf, adv); err != nil {
+		return fmt.Errorf("mmap: madvise %d bytes: %w", len(p.buf), err)
+	}
+	return nil
+}
+
+// dropCache evicts the clean pages of the given file range from the
+// page cache
+func dropCache(fd *os.File, off, n int64) error {
+	return unix.Fadvise(int(fd.Fd()), off, n, unix.FADV_DONTNEED)
+}
+
+// readAhead starts reading the given file range into the page cache
+func readAhead(fd *os.File, off, n int64) error {
+	return unix.Fadvise(int(fd.Fd()), off, n, unix.FADV_WILLNEED)
+}
+
+func cloneFile(src, dst string) error {
+	sfd, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer sfd.Close()
+
+	dfd, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = unix.IoctlFileClone(int(dfd.Fd()), int(sfd.Fd()))
+	if err == nil {
+		if st, err := sfd.Stat(); err == nil {
+			dfd.Chmod(st.Mode().Perm())
+		}
+		return dfd.Close()
+	}
+
+	dfd.Close()
+	os.Remove(dst)
+	switch err {
+	case unix.EOPNOTSUPP, unix.EXDEV, unix.EINVAL, unix.ENOTTY:
+		return fmt.Errorf("%w: %w", ErrUnsupported, err)
+	default:
+		return err
+	}
+}
+
+// networkFS returns true if fd is on a network filesystem
+func networkFS(fd *os.File) (bool, error) {
+	var st unix.Statfs_t
+
+	if err := unix.Fstatfs(int(fd.Fd()), &st); err != nil {
+		return false, os.NewSyscallError("fstatfs", err)
+	}
+	return isNetworkFS(uint32(st.Type)), nil
+}
+
+// isNetworkFS returns true if the statfs(2) f_type denotes a network
+// filesystem. NB: f_type is signed on some platforms; so we only look
+// at its lower 32 bits.
+func isNetworkFS(ftype uint32) bool {
+	switch ftype {
+	case unix.NFS_SUPER_MAGIC, unix.SMB_SUPER_MAGIC, unix.SMB2_SUPER_MAGIC,
+		unix.CIFS_SUPER_MAGIC, unix.CEPH_SUPER_MAGIC, unix.V9FS_MAGIC,
+		unix.AFS_SUPER_MAGIC, unix.AFS_FS_MAGIC:
+		return true
+	}
+	return false
+}
+
+func (p *Mapping) setName(nm string) error {
+	if p.m.fd != nil {
+		return fmt.Errorf("mmap: set name: file mapping: %w", ErrUnsupported)
+	}
+
+	if err := p.checkHoles("set name", 0, int64(len(p.buf))); err != nil {
+		return err
+	}
+
+	var ptr *byte
+	if len(nm) > 0 {
+		var err error
+		if ptr, err = unix.BytePtrFromString(nm); err != nil {
+			return fmt.Errorf("mmap: set name %q: %w", nm, err)
+		}
+	}
+
+	err := unix.Prctl(unix.PR_SET_VMA, unix.PR_SET_VMA_ANON_NAME, p.addr(), uintptr(len(p.buf)), uintptr(unsafe.Pointer(ptr)))
+	runtime.KeepAlive(ptr)
+	if err != nil {
+		return fmt.Errorf("mmap: set name %q: %w", nm, err)
+	}
+	return nil
+}
+
+func (p *Mapping) collapseHuge() error {
+	if err := p.checkHoles("collapse huge", 0, int64(len(p.buf))); err != nil {
+		return err
+	}
+
+	err := unix.Madvise(p.buf, unix.MADV_COLLAPSE)
+	switch err {
+	case nil:
+		return nil
+	case unix.EINVAL:
+		// older kernels don't know MADV_COLLAPSE
+		return fmt.Errorf("mmap: collapse huge: %w: %w", ErrUnsupported, err)
+	default:
+		return fmt.Errorf("mmap: collapse huge %d bytes: %w", len(p.buf), err)
+	}
+}
+
+// populate prefaults the mapping for reads or writes without the
+// MAP_POPULATE drawback of doing it at mmap(2) time
+func (p *Mapping) populate(write bool) error {
+	adv := unix.MADV_POPULATE_READ
+	if write {
+		adv = unix.MADV_POPULATE_WRITE
+	}
+
+	if err := p.checkHoles("populate", 0, int64(len(p.buf))); err != nil {
+		return err
+	}
+
+	err := unix.Madvise(p.buf, adv)
+	switch err {
+	case nil:
+		return nil
+	case unix.EINVAL:
+		// older kernels don't know MADV_POPULATE_(READ|WRITE)
+		return fmt.Errorf("mmap: populate: %w: %w", ErrUnsupported, err)
+	default:
+		return fmt.Errorf("mmap: populate %d bytes: %w", len(p.buf), err)
+	}
+}
+
+// futex(2) ops; the non-private forms work across processes
+const (
+	_FUTEX_WAIT = 0
+	_FUTEX_WAKE = 1
+)
+
+func futexWait(v *uint32, expect uint32) error {
+	_, _, e := unix.Syscall6(unix.SYS_FUTEX, uintptr(unsafe.Pointer(v)), _FUTEX_WAIT, uintptr(expect), 0, 0, 0)
+	switch e {
+	case 0, unix.EAGAIN, unix.EINTR:
+		// woken, value changed or interrupted; the caller rechecks
+		return nil
+	default:
+		return e
+	}
+}
+
+func futexWake(v *uint32, n int) (int, error) {
+	r, _, e := unix.Syscall6(unix.SYS_FUTEX, uintptr(unsafe.Pointer(v)), _FUTEX_WAKE, uintptr(n), 0, 0, 0)
+	if e != 0 {
+		return 0, e
+	}
+	return int(r), nil
+}
+
+func fdatasync(fd *os.File) error {
+	return os.NewSyscallError("fdatasync", unix.Fdatasync(int(fd.Fd())))
+}
+
+// canMap consults the overcommit policy: in strict mode (2), the
+// mapping must fit in the remaining commit limit. Otherwise, faulting
+// in the mapping needs as much free memory (or swap).
+func canMap(sz int64) (bool, error) {
+	b, err := os.ReadFile("/proc/sys/vm/overcommit_memory")
+	if err != nil {
+		return false, fmt.Errorf("mmap: can map: %w", err)
+	}
+
+	mi, err := meminfo()
+	if err != nil {
+		return false, fmt.Errorf("mmap: can map: %w", err)
+	}
+
+	var avail int64
+	if string(bytes.TrimSpace(b)) == "2" {
+		avail = mi["CommitLimit"] - mi["Committed_AS"]
+	} else {
+		avail = mi["MemAvailable"] + mi["SwapFree"]
+	}
+	return sz <= avail, nil
+}
+
+// meminfo returns the fields of /proc/meminfo in bytes
+func meminfo() (map[string]int64, error) {
+	b, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+
+	// lines are of the form "MemAvailable:   1234 kB"
+	mi := make(map[string]int64)
+	for _, ln := range bytes.Split(b, []byte("\n")) {
+		k, v, ok := bytes.Cut(ln, []byte(":"))
+		if !ok {
+			continue
+		}
+
+		f := bytes.Fields(v)
+		if len(f) == 0 {
+			continue
+		}
+
+		n, err := strconv.ParseInt(string(f[0]), 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(f) > 1 && string(f[1]) == "kB" {
+			n *= 1024
+		}
+		mi[string(k)] = n
+	}
+	return mi, nil
+}
+
+func probeCaps() Caps {
+	c := Caps{
+		MapSync:   probeMapType(unix.MAP_SHARED_VALIDATE),
+		Mincore:   true,
+		Mremap:    true,
+		SoftDirty: probeSoftDirty(),
+	}
+
+	if mi, err := meminfo(); err == nil {
+		c.HugeTLB = mi["HugePages_Total"] > 0
+	}
+	return c
+}
+
+// probeMapType returns true if the kernel knows the mapping type 'typ';
+// kernels reject unknown types with EINVAL. Anon mappings only allow
+// the legacy types; so we probe with a memfd.
+func probeMapType(typ int) bool {
+	fd, err := unix.MemfdCreate("mmap-probe", unix.MFD_CLOEXEC)
+	if err != nil {
+		return false
+	}
+
+	defer unix.Close(fd)
+
+	pg := os.Getpagesize()
+	if err = unix.Ftruncate(fd, int64(pg)); err != nil {
+		return false
+	}
+
+	b, err := unix.Mmap(fd, 0, pg, unix.PROT_READ, typ)
+	if err != nil {
+		return false
+	}
+
+	unix.Munmap(b)
+	return true
+}
+
+// probeSoftDirty returns true if a freshly written page is marked
+// soft-dirty (bit 55) in /proc/self/pagemap
+func probeSoftDirty() bool {
+	pg := os.Getpagesize()
+	b, err := unix.Mmap(-1, 0, pg, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANON)
+	if err != nil {
+		return false
+	}
+
+	defer unix.Munmap(b)
+
+	b[0] = 1
+
+	fd, err := os.Open("/proc/self/pagemap")
+	if err != nil {
+		return false
+	}
+
+	defer fd.Close()
+
+	var ent [8]byte
+	off := int64(uintptr(unsafe.Pointer(&b[0])) / uintptr(pg) * 8)
+	if _, err := fd.ReadAt(ent[:], off); err != nil {
+		return false
+	}
+	return binary.LittleEndian.Uint64(ent[:])&(1<<55) != 0
+}
+
+// copyRange copies [off, off+n) of src to dst via copy_file_range(2)
+func copyRange(src, dst *os.File, off, n int64) error {
+	soff, doff := off, off
+	for n > 0 {
+		z, err := unix.CopyFileRange(int(src.Fd()), &soff, int(dst.Fd()), &doff, int(min(n, _MaxMmapSize)), 0)
+		switch err {
+		case nil:
+		case unix.ENOSYS, unix.EXDEV, unix.EOPNOTSUPP:
+			return fmt.Errorf("%w: %w", ErrUnsupported, err)
+		default:
+			return os.NewSyscallError("copy_file_range", err)
+		}
+
+		if z == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		n -= int64(z)
+	}
+	return nil
+}
+
+// dioAlign returns the memory and file offset alignment needed for
+// O_DIRECT on fd; zero if fd doesn't support O_DIRECT.
+func dioAlign(fd *os.File) (mem, off int64, err error) {
+	var st unix.Statx_t
+
+	err = unix.Statx(int(fd.Fd()), "", unix.AT_EMPTY_PATH, unix.STATX_TYPE|unix.STATX_DIOALIGN, &st)
+	if err != nil {
+		return 0, 0, os.NewSyscallError("statx", err)
+	}
+
+	if st.Mode&unix.S_IFMT == unix.S_IFBLK {
+		ssz, err := unix.IoctlGetInt(int(fd.Fd()), unix.BLKSSZGET)
+		if err != nil {
+			return 0, 0, fmt.Errorf("logical block size: %w", err)
+		}
+		return int64(ssz), int64(ssz), nil
+	}
+
+	if st.Mask&unix.STATX_DIOALIGN != 0 {
+		return int64(st.Dio_mem_align), int64(st.Dio_offset_align), nil
+	}
+
+	// older kernels; the preferred I/O size is a safe bet
+	return int64(st.Blksize), int64(st.Blksize), nil
+}
+
+// fsNames maps the statfs(2) f_type to filesystem names
+var fsNames = map[uint32]string{
+	unix.EXT4_SUPER_MAGIC:      "ext4",
+	unix.XFS_SUPER_MAGIC:       "xfs",
+	unix.BTRFS_SUPER_MAGIC:     "btrfs",
+	unix.F2FS_SUPER_MAGIC:      "f2fs",
+	unix.BCACHEFS_SUPER_MAGIC:  "bcachefs",
+	unix.NILFS_SUPER_MAGIC:     "nilfs2",
+	unix.ZONEFS_MAGIC:          "zonefs",
+	unix.MSDOS_SUPER_MAGIC:     "vfat",
+	unix.EXFAT_SUPER_MAGIC:     "exfat",
+	unix.ISOFS_SUPER_MAGIC:     "iso9660",
+	unix.SQUASHFS_MAGIC:        "squashfs",
+	unix.TMPFS_MAGIC:           "tmpfs",
+	unix.RAMFS_MAGIC:           "ramfs",
+	unix.HUGETLBFS_MAGIC:       "hugetlbfs",
+	unix.OVERLAYFS_SUPER_MAGIC: "overlay",
+	unix.FUSE_SUPER_MAGIC:      "fuse",
+	unix.ECRYPTFS_SUPER_MAGIC:  "ecryptfs",
+	unix.PROC_SUPER_MAGIC:      "proc",
+	unix.SYSFS_MAGIC:           "sysfs",
+	unix.NFS_SUPER_MAGIC:       "nfs",
+	unix.SMB_SUPER_MAGIC:       "smb",
+	unix.SMB2_SUPER_MAGIC:      "smb2",
+	unix.CIFS_SUPER_MAGIC:      "cifs",
+	unix.CEPH_SUPER_MAGIC:      "ceph",
+	unix.V9FS_MAGIC:            "9p",
+	unix.AFS_SUPER_MAGIC:       "afs",
+	unix.AFS_FS_MAGIC:          "afs",
+	0x2fc12fc1:                 "zfs",
+}
+
+func fsType(fd *os.File) (string, error) {
+	var st unix.Statfs_t
+
+	if err := unix.Fstatfs(int(fd.Fd()), &st); err != nil {
+		return "", os.NewSyscallError("fstatfs", err)
+	}
+
+	ftype := uint32(st.Type)
+	if nm, ok := fsNames[ftype]; ok {
+		return nm, nil
+	}
+	return fmt.Sprintf("%#x", ftype), nil
+}
+
+// smapsStats sums the stats of the regions of /proc/self/smaps that
+// overlap [start, end)
+func smapsStats(start, end uintptr) (SmapStats, error) {
+	var st SmapStats
+
+	b, err := os.ReadFile("/proc/self/smaps")
+	if err != nil {
+		return st, fmt.Errorf("mmap: smaps: %w", err)
+	}
+
+	fields := map[string]*int64{
+		"Rss":           &st.Rss,
+		"Pss":           &st.Pss,
+		"Swap":          &st.Swap,
+		"Shared_Clean":  &st.SharedClean,
+		"Shared_Dirty":  &st.SharedDirty,
+		"Private_Clean": &st.PrivateClean,
+		"Private_Dirty": &st.PrivateDirty,
+	}
+
+	// each region starts with a line of the form "lo-hi perms ..."
+	// followed by lines of the form "Rss:    12 kB". Regions that
+	// overlap the mapping count in full: the kernel doesn't say which
+	// of their pages are in the mapping.
+	var in, found bool
+	for _, ln := range bytes.Split(b, []byte("\n")) {
+		k, v, ok := bytes.Cut(ln, []byte(":"))
+		if !ok || bytes.IndexByte(k, ' ') >= 0 {
+			lo, hi, ok := vmaRange(ln)
+			in = ok && lo < end && hi > start
+			found = found || in
+			continue
+		}
+
+		f, ok := fields[string(k)]
+		if !in || !ok {
+			continue
+		}
+
+		var kb int64
+		if _, err := fmt.Sscanf(string(v), "%d kB", &kb); err == nil {
+			*f += kb * 1024
+		}
+	}
+
+	if !found {
+		return st, fmt.Errorf("mmap: smaps: no mapping at %#x", start)
+	}
+	return st, nil
+}
+
+// vmaRange parses the address range at the start of a line of
+// /proc/<pid>/maps
+func vmaRange(ln []byte) (lo, hi uintptr, ok bool) {
+	r, _, _ := bytes.Cut(ln, []byte(" "))
+	a, b, ok := bytes.Cut(r, []byte("-"))
+	if !ok {
+		return 0, 0, false
+	}
+
+	x, err := strconv.ParseUint(string(a), 16, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	y, err := strconv.ParseUint(string(b), 16, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return uintptr(x), uintptr(y), true
+}
@@ -0,0 +1,31 @@
+// mincore.go - page residency via mincore(2)
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build darwin || linux || freebsd || netbsd || dragonfly || (openbsd && (386 || amd64 || arm))
+
+package mmap
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mincore fills vec with the residency of each page of b
+func mincore(b []byte, vec []byte) error {
+	_, _, e := unix.Syscall(unix.SYS_MINCORE, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), uintptr(unsafe.Pointer(&vec[0])))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+// mincore_other.go - unix targets without mincore(2)
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build solaris || (openbsd && !(386 || amd64 || arm))
+
+package mmap
+
+// XXX x/sys/unix has no mincore(2) syscall number for these targets
+func mincore(b []byte, vec []byte) error {
+	return unsupported("mincore")
+}
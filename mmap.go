@@ -15,8 +15,23 @@
 package mmap
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 )
 
 // Prot describes the protections for a mapping
@@ -26,6 +41,10 @@ const (
 	PROT_READ Prot = 1 << iota
 	PROT_WRITE
 	PROT_EXEC
+
+	// Convenience aliases for common combinations
+	PROT_RW = PROT_READ | PROT_WRITE
+	PROT_RX = PROT_READ | PROT_EXEC
 )
 
 // Flag describes additional properties for a given mapping
@@ -33,23 +52,193 @@ type Flag uint
 
 const (
 	F_COW Flag = 1 << iota
+
+	// F_HUGETLB backs the mapping with huge (large) pages. On Windows,
+	// only anon mappings support large pages; file mappings return
+	// ErrUnsupported.
 	F_HUGETLB
 	F_READAHEAD
+
+	// F_INHERIT makes the mapping inheritable by child processes
+	// across exec: on Unix the mapped file is duplicated into a
+	// descriptor without FD_CLOEXEC that lives as long as the mapping
+	// (see Mapping.InheritedFd), so the child can map the same file;
+	// the caller's fd is untouched. Anon mappings can't survive exec
+	// on Unix and return ErrUnsupported. On Windows, the section (file
+	// mapping) handle is created inheritable; see Mapping.Handle.
+	F_INHERIT
+
+	// F_GROWSDOWN creates an anon mapping that grows downward on
+	// faults below it (MAP_GROWSDOWN); this emulates legacy stack
+	// regions and is rarely what you want. Such mappings are always
+	// private. It is only supported for anon mappings on Linux;
+	// elsewhere Map returns ErrUnsupported.
+	F_GROWSDOWN
+
+	// F_UNINITIALIZED skips zeroing the pages of anon mappings
+	// (MAP_UNINITIALIZED); this is faster but the pages may hold data
+	// left behind by other processes - so it must never be used where
+	// that is a security concern. It only has an effect on (embedded)
+	// Linux kernels built with CONFIG_MMAP_ALLOW_UNINITIALIZED;
+	// elsewhere the pages are zeroed as usual.
+	F_UNINITIALIZED
 )
 
+var protNames = []string{"READ", "WRITE", "EXEC"}
+
+var flagNames = []string{"COW", "HUGETLB", "READAHEAD", "INHERIT", "GROWSDOWN", "UNINITIALIZED"}
+
+// String returns the protections as "READ|WRITE|EXEC"
+func (p Prot) String() string {
+	return bitString(uint(p), protNames)
+}
+
+// String returns the flags as "COW|HUGETLB|READAHEAD"
+func (f Flag) String() string {
+	return bitString(uint(f), flagNames)
+}
+
+// bitString names each set bit of v; bit 'i' is named by names[i]
+// and unknown bits are printed as a single hex value.
+func bitString(v uint, names []string) string {
+	if v == 0 {
+		return "NONE"
+	}
+
+	var s []string
+	for i, nm := range names {
+		if b := uint(1) << i; v&b != 0 {
+			s = append(s, nm)
+			v &^= b
+		}
+	}
+
+	if v != 0 {
+		s = append(s, fmt.Sprintf("%#x", v))
+	}
+	return strings.Join(s, "|")
+}
+
 const (
 	// This represents the largest size of a memory mapped file on this system
 	MaxMappingSize int64 = _MaxMmapSize
 )
 
+// MaxMmapSize returns the largest mapping size usable at runtime. This
+// is the lesser of MaxMappingSize and (on Unix) the address space
+// resource limit (RLIMIT_AS) of the process.
+func MaxMmapSize() int64 {
+	return maxMmapSize()
+}
+
+// CanMap predicts whether an anon mapping of 'sz' bytes would succeed
+// and could be faulted in entirely without running the system out of
+// memory. On Linux it honors the overcommit policy
+// (/proc/sys/vm/overcommit_memory) and the memory available; elsewhere
+// it is a best-effort check against the memory of the system. Memory
+// use by others can change at any time; so the answer is only a hint.
+func CanMap(sz int64) (bool, error) {
+	if sz <= 0 {
+		return false, fmt.Errorf("mmap: can map: invalid size %d", sz)
+	}
+	if sz > maxMmapSize() {
+		return false, nil
+	}
+	return canMap(sz)
+}
+
+// ErrPrivilegeNotHeld is returned on Windows when the process lacks the
+// SeLockMemoryPrivilege needed for large page (F_HUGETLB) anon mappings.
+var ErrPrivilegeNotHeld = errors.New("mmap: SeLockMemoryPrivilege not held")
+
+// ErrReadOnly is returned when writing to a mapping without PROT_WRITE
+var ErrReadOnly = errors.New("mmap: mapping is read-only")
+
+// ErrRaceTruncated is returned by Map when the file shrinks below the
+// requested mapping while it is being mapped.
+var ErrRaceTruncated = errors.New("mmap: file truncated while mapping")
+
+// ErrUnsupported is returned by operations that are not available on
+// the current platform.
+var ErrUnsupported = errors.New("mmap: operation not supported on this platform")
+
+// unsupported returns ErrUnsupported annotated with the operation
+func unsupported(op string) error {
+	return fmt.Errorf("mmap: %s: %w", op, ErrUnsupported)
+}
+
+// ErrWXViolation is returned when W^X enforcement is enabled and a
+// mapping is requested to be both writable and executable.
+var ErrWXViolation = errors.New("mmap: writable and executable mapping disallowed")
+
+// set if W^X protection is enforced
+var enforceWX atomic.Bool
+
+// EnforceWXProtection controls whether mappings that are both
+// writable and executable are rejected with ErrWXViolation. When
+// enabled, callers must use separate writable and executable mappings
+// (or change the protections of a mapping). It is off by default.
+func EnforceWXProtection(v bool) {
+	enforceWX.Store(v)
+}
+
+// checkWX returns an error if the protections violate W^X policy
+func checkWX(prot Prot) error {
+	if prot&(PROT_WRITE|PROT_EXEC) == (PROT_WRITE|PROT_EXEC) && enforceWX.Load() {
+		return ErrWXViolation
+	}
+	return nil
+}
+
 // Mmap describes mappings for a file backed object
 type Mmap struct {
 	fd *os.File
+
+	// retry with MAP_NORESERVE when mmap fails with ENOMEM
+	noreserve bool
+
+	obs Observer
+
+	// called for flushes slower than slowFlush
+	slowFlush time.Duration
+	slowLog   func(d time.Duration, sz int64)
+
+	// set if fd is owned (and closed) by us
+	own bool
+
+	// protects the bookkeeping below
+	mu sync.Mutex
+
+	// cached stat of fd; see SetStatCache() and RefreshStat()
+	cache bool
+	st    os.FileInfo
+
+	// access pattern detection; see SetAdaptiveAdvice()
+	adapt adaptive
+
+	// set if fd is on a network filesystem; see onNetworkFS()
+	netOnce sync.Once
+	netfs   bool
+
+	// live mappings created by this object
+	live map[*Mapping]struct{}
+}
+
+// Observer is notified of activity on mappings created by an Mmap
+// object. Each method is called with the size of the mapping and the
+// time taken by the operation; they are only called when the
+// operation succeeds.
+type Observer interface {
+	OnMap(sz int64, d time.Duration)
+	OnUnmap(sz int64, d time.Duration)
+	OnFlush(sz int64, d time.Duration)
+	OnLock(sz int64, d time.Duration)
 }
 
 // New creates a new memory map object for the given file. It is a
 // runtime error for a file to be opened in RO mode while asking for
-// a PROT_WRITE mapping.
+// a PROT_WRITE mapping. The file is stat'd on every Map unless the
+// stat cache is enabled via SetStatCache.
 func New(fd *os.File) *Mmap {
 	m := &Mmap{
 		fd: fd,
@@ -58,6 +247,13 @@ func New(fd *os.File) *Mmap {
 }
 
 // NewAnon creates a mmemory map object suitable for anon mappings.
+//
+// On Unix, anon mappings are shared (MAP_SHARED) by default: a child
+// created via fork(2) sees the same memory and writes by either process
+// are visible to the other. Mapping with F_COW creates a private anon
+// mapping (MAP_PRIVATE) instead: a forked child gets a copy-on-write
+// snapshot and its writes are never visible to the parent (or vice
+// versa).
 func NewAnon() *Mmap {
 	m := &Mmap{
 		fd: nil,
@@ -65,14 +261,266 @@ func NewAnon() *Mmap {
 	return m
 }
 
-// Map creates a memory mapping at offset 'off' for 'sz' bytes.
+// NewSpill creates a memory map object backed by an unnamed temporary
+// file of 'sz' bytes in 'dir'; this is useful for scratch data that may
+// grow beyond available memory. The file has no name on disk and its
+// storage is reclaimed when it is closed. The returned object owns the
+// file and it must be released via Close() after all its mappings are
+// unmapped.
+func NewSpill(dir string, sz int64) (*Mmap, error) {
+	fd, err := spillFile(dir)
+	if err != nil {
+		return nil, fmt.Errorf("mmap: spill %s: %w", dir, err)
+	}
+
+	if err = fd.Truncate(sz); err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("mmap: spill %s: %w", dir, err)
+	}
+
+	m := New(fd)
+	m.own = true
+	return m, nil
+}
+
+// DupFd duplicates the file descriptor of the memory map object; the
+// object owns the duplicate and uses it for all subsequent operations
+// (including flushing on Unmap). This lets the caller close their file
+// while mappings are still live - which is essential on Windows where
+// unmapping flushes via the file handle. The duplicate is released by
+// Close().
+func (m *Mmap) DupFd() error {
+	if m.fd == nil {
+		return fmt.Errorf("mmap: dup: not a file mapping")
+	}
+
+	if m.own {
+		return nil
+	}
+
+	fd, err := dupFile(m.fd)
+	if err != nil {
+		return fmt.Errorf("%s: dup: %w", m.fd.Name(), err)
+	}
+
+	m.fd = fd
+	m.own = true
+	return nil
+}
+
+// Close releases the file owned by the memory map object (eg one
+// created via NewSpill or duplicated via DupFd). It is a no-op for
+// objects created via New() or NewAnon(); the caller retains ownership
+// of such files.
+func (m *Mmap) Close() error {
+	if !m.own {
+		return nil
+	}
+
+	m.own = false
+	return m.fd.Close()
+}
+
+// FileSize returns the current size of the underlying file; it is
+// re-read on every call and thus reflects the growth of the file since
+// it was mapped.
+func (m *Mmap) FileSize() (int64, error) {
+	if m.fd == nil {
+		return 0, fmt.Errorf("mmap: file size: not a file mapping")
+	}
+	return fileSize(m.fd)
+}
+
+// IsNetworkFS returns true if the underlying file is on a network
+// filesystem (eg NFS or SMB). Such filesystems provide weaker coherence
+// for mappings: changes made by other clients may not be visible in the
+// mapping and msync(2) may not make changes durable on the server. So
+// Flush of writable mappings on network filesystems additionally
+// fsync(2)s the file. It returns ErrUnsupported on the BSDs and Windows.
+func (m *Mmap) IsNetworkFS() (bool, error) {
+	if m.fd == nil {
+		return false, nil
+	}
+
+	ok, err := networkFS(m.fd)
+	if err != nil {
+		return false, fmt.Errorf("%s: network fs: %w", m.fd.Name(), err)
+	}
+	return ok, nil
+}
+
+// FilesystemType returns the name of the filesystem holding the
+// underlying file (eg "ext4", "tmpfs", "nfs", "apfs" or "NTFS"). On
+// Linux the name is derived from the filesystem magic number; unknown
+// filesystems are reported by their magic number in hex.
+func (m *Mmap) FilesystemType() (string, error) {
+	if m.fd == nil {
+		return "", fmt.Errorf("mmap: filesystem type: anon mapping")
+	}
+
+	nm, err := fsType(m.fd)
+	if err != nil {
+		return "", fmt.Errorf("%s: filesystem type: %w", m.fd.Name(), err)
+	}
+	return nm, nil
+}
+
+// onNetworkFS is a cached IsNetworkFS()
+func (m *Mmap) onNetworkFS() bool {
+	m.netOnce.Do(func() {
+		m.netfs, _ = m.IsNetworkFS()
+	})
+	return m.netfs
+}
+
+// Preallocate allocates disk blocks for the byte range [off, off+n) of
+// the underlying file, extending the file if needed. This avoids sparse
+// holes (and the resulting fragmentation) in eg database files that
+// are grown ahead of use. It returns ErrUnsupported on BSDs other than
+// Darwin and 64-bit FreeBSD.
+func (m *Mmap) Preallocate(off, n int64) error {
+	if m.fd == nil {
+		return fmt.Errorf("mmap: preallocate: not a file mapping")
+	}
+
+	if off < 0 || n <= 0 {
+		return fmt.Errorf("%s: preallocate %d at %d: invalid range", m.fd.Name(), n, off)
+	}
+
+	if err := preallocate(m.fd, off, n); err != nil {
+		return fmt.Errorf("%s: preallocate %d at %d: %w", m.fd.Name(), n, off, err)
+	}
+	return nil
+}
+
+// SnapshotTo copies the contents of the underlying file to a new file
+// 'path' using mappings of both files: the destination is preallocated
+// to the size of the source, filled with a single copy of each chunk
+// of the source and flushed before it is closed. On failure, the
+// partially written destination is removed.
+func (m *Mmap) SnapshotTo(path string) error {
+	if m.fd == nil {
+		return fmt.Errorf("mmap: snapshot: not a file mapping")
+	}
+
+	st, err := m.fd.Stat()
+	if err != nil {
+		return fmt.Errorf("%s: snapshot: %w", m.fd.Name(), err)
+	}
+
+	out, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, st.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("%s: snapshot: %w", m.fd.Name(), err)
+	}
+
+	fail := func(err error) error {
+		out.Close()
+		os.Remove(path)
+		return fmt.Errorf("%s: snapshot %s: %w", m.fd.Name(), path, err)
+	}
+
+	sz := st.Size()
+	if sz == 0 {
+		return out.Close()
+	}
+
+	// not all filesystems can preallocate; so we fallback to extending
+	// the file
+	if err = preallocate(out, 0, sz); err != nil {
+		if err = out.Truncate(sz); err != nil {
+			return fail(err)
+		}
+	}
+
+	var off int64
+
+	dst := New(out)
+	_, err = chunks(m.fd, _MaxMmapSize, func(b []byte) error {
+		p, err := dst.mmap(int64(len(b)), off, PROT_RW, 0)
+		if err != nil {
+			return err
+		}
+
+		copy(p.bytes(), b)
+		err = errors.Join(p.flush(), p.unmap())
+		off += int64(len(b))
+		return err
+	})
+	if err != nil {
+		return fail(err)
+	}
+	return out.Close()
+}
+
+// extend grows the file to at least sz bytes
+func extend(fd *os.File, sz int64) error {
+	st, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	if st.Size() < sz {
+		return fd.Truncate(sz)
+	}
+	return nil
+}
+
+// SetNoReserveFallback controls whether a mapping that fails due to
+// overcommit limits (ENOMEM) is retried once with MAP_NORESERVE. This
+// is meant for best-effort large allocations: no swap space is
+// reserved for such mappings and if the system truly runs out of
+// memory, the process will get a SIGSEGV (or be OOM killed) when it
+// touches a page that can't be backed. This is a no-op on platforms
+// without MAP_NORESERVE (including Windows).
+func (m *Mmap) SetNoReserveFallback(v bool) {
+	m.noreserve = v
+}
+
+// SetStatCache controls whether Map caches the stat (size, mode) of the
+// file: with the cache on, the file is stat'd on the first Map and the
+// later ones validate their requests against that stat. This saves a
+// syscall or two per Map in hot loops but the caller must call
+// RefreshStat after the file changes size. The cache is off by default.
+func (m *Mmap) SetStatCache(on bool) {
+	m.mu.Lock()
+	m.cache, m.st = on, nil
+	m.mu.Unlock()
+}
+
+// SetObserver registers 'o' to be notified of activity on all
+// mappings created by this object; a nil observer disables the
+// notifications. It must be called before any mappings are created.
+func (m *Mmap) SetObserver(o Observer) {
+	m.obs = o
+}
+
+// SetSlowFlushThreshold arranges for 'log' to be called with the
+// duration and size of every flush (Flush, FlushRange) that takes
+// longer than 'd'; this helps find fsync stalls. A nil 'log' disables
+// it. It must not be called concurrently with flushes.
+func (m *Mmap) SetSlowFlushThreshold(d time.Duration, log func(d time.Duration, sz int64)) {
+	m.slowFlush = d
+	m.slowLog = log
+}
+
+// Map creates a memory mapping at offset 'off' for 'sz' bytes; a zero
+// 'sz' maps the file from 'off' to its end. The request is validated
+// against the size of the file; unless the stat cache is on (see
+// SetStatCache), the file is stat'd again after mapping to catch a
+// concurrent truncation.
 func (m *Mmap) Map(sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+	if err := checkWX(prot); err != nil {
+		return nil, fmt.Errorf("mmap %d at %d: %w", sz, off, err)
+	}
+
+	t0 := m.start()
+
 	if m.fd == nil {
 		p, err := m.map_anon(sz, off, prot, flags)
-		return p, err
+		return m.mapped(p, err, t0)
 	}
 
-	st, err := m.fd.Stat()
+	st, fresh, err := m.stat()
 	if err != nil {
 		return nil, fmt.Errorf("mmap %d at %d: %w", sz, off, err)
 	}
@@ -99,71 +547,1201 @@ func (m *Mmap) Map(sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
 	}
 
 	p, err := m.mmap(sz, off, prot, flags)
-	return p, err
+	if err != nil {
+		return nil, err
+	}
+
+	// Someone may have truncated the file after we looked at it;
+	// touching pages past the new EOF will SIGBUS. So, look again. A
+	// cached stat is the caller's promise that the file is stable
+	// (see SetStatCache); we don't second guess it.
+	if fresh {
+		if st, err = m.fd.Stat(); err == nil && st.Size() < (sz+off) {
+			err = ErrRaceTruncated
+		}
+
+		if err != nil {
+			p.unmap()
+			return nil, fmt.Errorf("mmap %d at %d: %w", sz, off, err)
+		}
+	}
+
+	if m.adapt.on {
+		m.adaptTo(p, off, sz)
+	}
+	return m.mapped(p, nil, t0)
 }
 
-// Unmap unmaps a given mapping
-func (m *Mmap) Unmap(p *Mapping) error {
-	return p.unmap()
+// MapContext is like Map but prefaults the mapping (F_READAHEAD) in a
+// way that can be cancelled: the mapping is created without
+// MAP_POPULATE and its pages are then touched on a separate goroutine.
+// If ctx is done before all the pages are faulted in, the goroutine
+// stops at the next page, the mapping is unmapped and MapContext
+// returns ctx.Err(). Without F_READAHEAD, it is the same as Map.
+func (m *Mmap) MapContext(ctx context.Context, sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if flags&F_READAHEAD == 0 || prot&PROT_READ == 0 {
+		return m.Map(sz, off, prot, flags)
+	}
+
+	p, err := m.Map(sz, off, prot, flags&^F_READAHEAD)
+	if err != nil {
+		return nil, err
+	}
+
+	var stop atomic.Bool
+	done := make(chan bool, 1)
+	go func() {
+		done <- prefault(p.bytes(), &stop)
+	}()
+
+	select {
+	case <-done:
+		return p, nil
+	case <-ctx.Done():
+		// the goroutine may have finished regardless; either way, it
+		// no longer touches the mapping once we hear from it.
+		stop.Store(true)
+		<-done
+		p.Unmap()
+		return nil, ctx.Err()
+	}
 }
 
-// Bytes returns a byte slice corresponding to the mapping
-func (p *Mapping) Bytes() []byte {
-	return p.bytes()
+// prefault touches every page of b until stopped; it returns false if
+// it was stopped before touching all the pages.
+func prefault(b []byte, stop *atomic.Bool) bool {
+	pg := os.Getpagesize()
+
+	var sum byte
+	for i := 0; i < len(b); i += pg {
+		if stop.Load() {
+			return false
+		}
+		sum += b[i]
+	}
+
+	// keep the compiler from eliding the page touches
+	runtime.KeepAlive(sum)
+	return true
 }
 
-// Flush flushes any changes to the backing disk (or swap for anon mappings)
-func (p *Mapping) Flush() error {
-	return p.flush()
+// RefreshStat re-reads the size and mode of the underlying file into
+// the stat cache; callers must refresh it after the file changes size.
+// It is a no-op if the stat cache is off.
+func (m *Mmap) RefreshStat() error {
+	m.mu.Lock()
+	on := m.cache
+	m.mu.Unlock()
+
+	if m.fd == nil || !on {
+		return nil
+	}
+
+	st, err := m.fd.Stat()
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+
+	m.setStat(st)
+	return nil
 }
 
-// Lock locks the given mappings in memory (prevents page out)
-func (p *Mapping) Lock() error {
-	return p.lock()
+// stat returns the stat of the file; with the stat cache on, the
+// cached stat is returned (and filled on first use). 'fresh' is set
+// if the stat was just read from the file.
+func (m *Mmap) stat() (st os.FileInfo, fresh bool, err error) {
+	m.mu.Lock()
+	st, on := m.st, m.cache
+	m.mu.Unlock()
+
+	if st != nil {
+		return st, false, nil
+	}
+
+	if st, err = m.fd.Stat(); err != nil {
+		return nil, false, err
+	}
+
+	if on {
+		m.setStat(st)
+	}
+	return st, true, nil
 }
 
-// Unlock unlocks the given mappings (enable page out as needed)
-func (p *Mapping) Unlock() error {
-	return p.unlock()
+func (m *Mmap) setStat(st os.FileInfo) {
+	m.mu.Lock()
+	m.st = st
+	m.mu.Unlock()
 }
 
-// Unmap unmaps the given mapping
-func (p *Mapping) Unmap() error {
-	return p.unmap()
+// MapExplicit creates a memory mapping at offset 'off' for exactly 'sz'
+// bytes without deriving or validating the size from the underlying
+// file. This is the escape hatch for special files (eg /dev/mem or
+// device nodes) that report a zero size but are nonetheless mappable.
+func (m *Mmap) MapExplicit(sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+	if err := checkWX(prot); err != nil {
+		return nil, fmt.Errorf("mmap %d at %d: %w", sz, off, err)
+	}
+
+	t0 := m.start()
+
+	if sz <= 0 {
+		return nil, fmt.Errorf("mmap %d at %d: invalid size", sz, off)
+	}
+
+	if sz > _MaxMmapSize {
+		return nil, fmt.Errorf("mmap %d at %d: too large", sz, off)
+	}
+
+	if m.fd == nil {
+		p, err := m.map_anon(sz, off, prot, flags)
+		return m.mapped(p, err, t0)
+	}
+
+	p, err := m.mmap(sz, off, prot, flags)
+	return m.mapped(p, err, t0)
 }
 
-// Reader mmap's chunks of the file and calls the given closure
-// with successive chunks of the file contents until EOF. If the
-// closure returns non-nil error, it breaks the iteration and the
-// error is propogated back to the caller.
-// Reader returns the number of bytes of read.
-func Reader(fd *os.File, fp func(buf []byte) error) (int64, error) {
-	st, err := fd.Stat()
+// MapHint is like MapExplicit but suggests 'addr' as the start address
+// of the mapping. The hint is advisory: unlike MAP_FIXED, it never
+// replaces existing mappings and the system is free to place the
+// mapping elsewhere. 'addr' should be page aligned; it is typically
+// the start of a mapping that was since unmapped.
+func (m *Mmap) MapHint(addr unsafe.Pointer, sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+	if err := checkWX(prot); err != nil {
+		return nil, fmt.Errorf("mmap %d at %d: %w", sz, off, err)
+	}
+
+	t0 := m.start()
+
+	if sz <= 0 {
+		return nil, fmt.Errorf("mmap %d at %d: invalid size", sz, off)
+	}
+
+	if sz > _MaxMmapSize {
+		return nil, fmt.Errorf("mmap %d at %d: too large", sz, off)
+	}
+
+	if m.fd == nil {
+		p, err := m.map_anon_hint(addr, sz, off, prot, flags)
+		return m.mapped(p, err, t0)
+	}
+
+	p, err := m.mmap_hint(addr, sz, off, prot, flags)
+	return m.mapped(p, err, t0)
+}
+
+// start returns the start time of an observed operation
+func (m *Mmap) start() time.Time {
+	if m.obs == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// flushStart returns the start time of a flush if anyone is
+// interested in its duration
+func (m *Mmap) flushStart() time.Time {
+	if m.obs == nil && m.slowLog == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// flushed notifies the observer and the slow flush logger of a flush
+// of 'sz' bytes that started at t0
+func (m *Mmap) flushed(sz int64, t0 time.Time) {
+	if t0.IsZero() {
+		return
+	}
+
+	d := time.Since(t0)
+	if m.obs != nil {
+		m.obs.OnFlush(sz, d)
+	}
+	if m.slowLog != nil && d > m.slowFlush {
+		m.slowLog(d, sz)
+	}
+}
+
+// mapped does the bookkeeping for a newly created mapping
+func (m *Mmap) mapped(p *Mapping, err error, t0 time.Time) (*Mapping, error) {
 	if err != nil {
-		return 0, fmt.Errorf("mmap: %w", err)
+		return nil, err
 	}
 
-	var off, z, fsz int64
+	m.mu.Lock()
+	if m.live == nil {
+		m.live = make(map[*Mapping]struct{})
+	}
+	m.live[p] = struct{}{}
+	m.mu.Unlock()
 
-	m := New(fd)
-	fsz = st.Size()
-	for fsz > 0 {
-		sz := min(fsz, _MaxMmapSize)
-		p, err := m.mmap(sz, off, PROT_READ, F_READAHEAD)
-		if err != nil {
-			return 0, err
-		}
+	if o := m.obs; o != nil {
+		o.OnMap(p.size(), time.Since(t0))
+	}
+	return p, nil
+}
 
-		err = fp(p.bytes())
-		if err != nil {
-			return z, err
-		}
+// Unmap unmaps a given mapping
+func (m *Mmap) Unmap(p *Mapping) error {
+	return p.Unmap()
+}
 
-		p.unmap()
+// Bytes returns a byte slice corresponding to the mapping
+func (p *Mapping) Bytes() []byte {
+	return p.bytes()
+}
+
+// Buffers returns the mapping as net.Buffers; writing it to a network
+// connection (eg *net.TCPConn) uses writev(2) where available and
+// avoids copying the mapped data.
+func (p *Mapping) Buffers() net.Buffers {
+	return net.Buffers{p.bytes()}
+}
+
+// MappedSize returns the size of the mapping
+func (p *Mapping) MappedSize() int64 {
+	return p.size()
+}
+
+// Addr returns the start address of the mapping
+func (p *Mapping) Addr() uintptr {
+	return p.addr()
+}
+
+// PointerAt returns a pointer to offset 'off' of the mapping for
+// passing to C (cgo) code. The pointer refers to memory outside the Go
+// heap; so it's safe to pass to C and the garbage collector never moves
+// it. The pointer is invalid once the mapping is unmapped.
+func (p *Mapping) PointerAt(off int64) (unsafe.Pointer, error) {
+	b := p.bytes()
+	if off < 0 || off >= int64(len(b)) {
+		return nil, fmt.Errorf("mmap: pointer at %d: out of bounds", off)
+	}
+	return unsafe.Pointer(&b[off]), nil
+}
+
+// CopyInto copies the contents of the mapping starting at offset 'off'
+// into 'dst' and returns the number of bytes copied. The copy is
+// short if 'dst' extends past the end of the mapping.
+func (p *Mapping) CopyInto(dst []byte, off int64) (int, error) {
+	b := p.bytes()
+	if off < 0 || off > int64(len(b)) {
+		return 0, fmt.Errorf("mmap: copy at %d: out of bounds", off)
+	}
+	return copy(dst, b[off:]), nil
+}
+
+// Detach returns a copy of the 'n' bytes of the mapping at offset
+// 'off' in freshly allocated memory; unlike Bytes() and Slice(), the
+// copy remains valid after the mapping is unmapped. The copy is short
+// if the region extends past the end of the mapping; it is nil if 'off'
+// is out of bounds.
+func (p *Mapping) Detach(off, n int64) []byte {
+	b := p.bytes()
+	if off < 0 || n < 0 || off > int64(len(b)) {
+		return nil
+	}
+
+	end := off + min(n, int64(len(b))-off)
+	return bytes.Clone(b[off:end])
+}
+
+// Write copies 'b' into the mapping at the write cursor and advances
+// it; the cursor starts at the beginning of the mapping (see Seek). It
+// returns io.ErrShortWrite if the mapping fills up and ErrReadOnly for
+// mappings without PROT_WRITE. Together with ReadFrom, this makes the
+// mapping an io.Writer for io.Copy.
+func (p *Mapping) Write(b []byte) (int, error) {
+	if !p.wr {
+		return 0, fmt.Errorf("mmap: write: %w", ErrReadOnly)
+	}
+
+	n := copy(p.bytes()[p.woff:], b)
+	p.woff += int64(n)
+	if n < len(b) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+// ReadFrom fills the mapping with data read from 'r' - starting at the
+// write cursor; it stops when the mapping is full or 'r' returns
+// io.EOF. It advances the cursor and returns the number of bytes read;
+// io.EOF is not an error. It returns ErrReadOnly for mappings without
+// PROT_WRITE.
+func (p *Mapping) ReadFrom(r io.Reader) (int64, error) {
+	if !p.wr {
+		return 0, fmt.Errorf("mmap: read from: %w", ErrReadOnly)
+	}
+
+	b := p.bytes()
+	start := p.woff
+	for p.woff < int64(len(b)) {
+		m, err := r.Read(b[p.woff:])
+		p.woff += int64(m)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return p.woff - start, err
+		}
+	}
+	return p.woff - start, nil
+}
+
+// Seek sets the write cursor of Write and ReadFrom; it can't move
+// outside the mapping.
+func (p *Mapping) Seek(off int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		off += p.woff
+	case io.SeekEnd:
+		off += p.size()
+	case io.SeekStart:
+	default:
+		return p.woff, fmt.Errorf("mmap: seek: invalid whence %d", whence)
+	}
+
+	if off < 0 || off > p.size() {
+		return p.woff, fmt.Errorf("mmap: seek to %d: out of bounds", off)
+	}
+
+	p.woff = off
+	return off, nil
+}
+
+// Decode decodes the fixed size value 'v' from the mapping at offset
+// 'off' using the encoding/binary rules and byte order 'order'. 'v'
+// must be a pointer to a fixed size value (or a slice of them). Decode
+// returns the offset immediately following the decoded value.
+func (p *Mapping) Decode(off int64, order binary.ByteOrder, v any) (int64, error) {
+	n := binary.Size(v)
+	if n < 0 {
+		return off, fmt.Errorf("mmap: decode %T: not a fixed size value", v)
+	}
+
+	b := p.bytes()
+	end := off + int64(n)
+	if off < 0 || end > int64(len(b)) {
+		return off, fmt.Errorf("mmap: decode %d bytes at %d: out of bounds", n, off)
+	}
+
+	if _, err := binary.Decode(b[off:end], order, v); err != nil {
+		return off, fmt.Errorf("mmap: decode %T at %d: %w", v, off, err)
+	}
+	return end, nil
+}
+
+// Flush flushes any changes to the backing disk; anon mappings have no
+// backing file and on Unix flushing them is a no-op. Writable mappings
+// of files on network filesystems are also fsync(2)ed; see
+// IsNetworkFS().
+func (p *Mapping) Flush() error {
+	t0 := p.m.flushStart()
+	err := p.flush()
+	if err == nil {
+		p.m.flushed(p.size(), t0)
+	}
+	return err
+}
+
+// FlushData flushes the changes in the mapping like Flush and then
+// syncs the file data - but not necessarily its metadata (eg
+// timestamps) - via fdatasync(2) where available; this is cheaper than
+// a full fsync(2). On Windows it is the same as Flush.
+func (p *Mapping) FlushData() error {
+	t0 := p.m.flushStart()
+	err := p.flushData()
+	if err == nil {
+		p.m.flushed(p.size(), t0)
+	}
+	return err
+}
+
+// FlushN flushes any changes to the backing disk like Flush and returns
+// the number of bytes covered by the flush; ranges unmapped via
+// UnmapRange aren't flushed and don't count.
+func (p *Mapping) FlushN() (int64, error) {
+	if err := p.Flush(); err != nil {
+		return 0, err
+	}
+	return p.mappedLen(0, p.size()), nil
+}
+
+// FlushRange flushes changes in the byte range [off, off+n) of the
+// mapping to the backing disk; the start of the range is rounded down
+// to a page boundary. For large mappings where only a small region has
+// been modified, this is much cheaper than Flush.
+func (p *Mapping) FlushRange(off, n int64) error {
+	_, err := p.FlushRangeN(off, n)
+	return err
+}
+
+// FlushRangeN is like FlushRange and returns the number of bytes
+// covered by the flush: the range widened to page boundaries (less any
+// ranges unmapped via UnmapRange).
+func (p *Mapping) FlushRangeN(off, n int64) (int64, error) {
+	if off < 0 || n < 0 || off+n > p.size() {
+		return 0, fmt.Errorf("mmap: flush %d at %d: out of bounds", n, off)
+	}
+
+	pg := int64(os.Getpagesize())
+	start := off &^ (pg - 1)
+	end := min((off+n+pg-1)&^(pg-1), p.size())
+	n = end - start
+
+	t0 := p.m.flushStart()
+	if err := p.flushRange(start, n); err != nil {
+		return 0, err
+	}
+
+	p.m.flushed(n, t0)
+	return p.mappedLen(start, n), nil
+}
+
+// MappingStats summarizes the size and residency of one or more
+// mappings
+type MappingStats struct {
+	Length        int64 // bytes mapped
+	PageCount     int   // pages mapped
+	ResidentPages int   // pages resident in memory
+}
+
+// Stats returns the size and residency of the mapping. It returns
+// ErrUnsupported on Windows.
+func (p *Mapping) Stats() (MappingStats, error) {
+	n, err := p.resident()
+	if err != nil {
+		return MappingStats{}, err
+	}
+
+	pg := int64(os.Getpagesize())
+	st := MappingStats{
+		Length:        p.size(),
+		PageCount:     int((p.size() + pg - 1) / pg),
+		ResidentPages: n,
+	}
+	return st, nil
+}
+
+// TotalStats returns the sum of the stats of all the live mappings
+// created by this object. It returns ErrUnsupported on Windows.
+func (m *Mmap) TotalStats() (MappingStats, error) {
+	// Unmap and UnmapRange take the lock too; so none of the mappings
+	// go away under us.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var tot MappingStats
+	for p := range m.live {
+		st, err := p.Stats()
+		if err != nil {
+			return MappingStats{}, err
+		}
+
+		tot.Length += st.Length
+		tot.PageCount += st.PageCount
+		tot.ResidentPages += st.ResidentPages
+	}
+	return tot, nil
+}
+
+// SmapStats is the memory accounting of a mapping from the kernel;
+// all sizes are in bytes.
+type SmapStats struct {
+	Rss  int64 // resident
+	Pss  int64 // resident, with shared pages divided among their users
+	Swap int64 // swapped out
+
+	SharedClean  int64
+	SharedDirty  int64
+	PrivateClean int64
+	PrivateDirty int64
+}
+
+// SmapsStats returns the memory accounting of the mapping from
+// /proc/self/smaps; if the kernel split the mapping into several
+// regions (eg after Protect of a part of it), their stats are summed.
+// The kernel may also merge the mapping with adjacent ones; the stats
+// then cover the whole merged region and so include its neighbours. It
+// returns ErrUnsupported on platforms other than Linux.
+func (p *Mapping) SmapsStats() (SmapStats, error) {
+	return smapsStats(p.addr(), p.addr()+uintptr(p.size()))
+}
+
+// IsDirectIOCompatible reports whether the mapped memory satisfies the
+// alignment requirements of O_DIRECT I/O on 'fd': its address and
+// length must be multiples of the alignment of the backing filesystem
+// or device (typically its logical block size). It returns false if
+// 'fd' doesn't support direct I/O at all.
+func (p *Mapping) IsDirectIOCompatible(fd *os.File) (bool, error) {
+	mem, off, err := dioAlign(fd)
+	if err != nil {
+		return false, fmt.Errorf("mmap: %s: direct io: %w", fd.Name(), err)
+	}
+
+	if mem == 0 || off == 0 {
+		return false, nil
+	}
+	return p.addr()%uintptr(mem) == 0 && p.size()%off == 0, nil
+}
+
+// Resident returns the number of pages of the mapping that are
+// resident in memory (mincore(2)). It returns ErrUnsupported on Windows.
+func (p *Mapping) Resident() (int, error) {
+	return p.resident()
+}
+
+// Discard tells the kernel that the 'n' bytes at offset 'off' aren't
+// needed anymore (MADV_DONTNEED); only the pages entirely within the
+// range are discarded. Subsequent accesses re-read file backed pages
+// from the file and zero fill private and anon pages. It returns
+// ErrUnsupported on Windows.
+func (p *Mapping) Discard(off, n int64) error {
+	if off < 0 || n < 0 || off+n > p.size() {
+		return fmt.Errorf("mmap: discard %d at %d: out of bounds", n, off)
+	}
+
+	pg := int64(os.Getpagesize())
+	start := (off + pg - 1) &^ (pg - 1)
+	end := off + n
+
+	// the partial page at the end of the mapping is ours too
+	if end < p.size() {
+		end &^= pg - 1
+	}
+	if start >= end {
+		return nil
+	}
+	return p.discard(start, end-start)
+}
+
+// FlushAsync schedules the changes in the mapping to be written to the
+// backing disk and returns without waiting for the writes to complete
+// (msync(2) with MS_ASYNC; FlushViewOfFile on Windows). WaitFlush waits
+// for such writes to complete.
+func (p *Mapping) FlushAsync() error {
+	return p.flushAsync()
+}
+
+// WaitFlush waits for the writeback initiated by prior calls to
+// FlushAsync to complete; on return, the changes are on the backing
+// disk. Durability sensitive code can use this to confirm that an
+// earlier asynchronous flush has landed.
+func (p *Mapping) WaitFlush() error {
+	return p.waitFlush()
+}
+
+// Lock locks the given mappings in memory (prevents page out)
+func (p *Mapping) Lock() error {
+	o := p.m.obs
+	if o == nil {
+		return p.lock()
+	}
+
+	t0 := time.Now()
+	err := p.lock()
+	if err == nil {
+		o.OnLock(p.size(), time.Since(t0))
+	}
+	return err
+}
+
+// FlushAndLock flushes the changes in the mapping to the backing disk
+// and then locks it in memory; the mapping isn't locked if the flush
+// fails.
+func (p *Mapping) FlushAndLock() error {
+	if err := p.Flush(); err != nil {
+		return err
+	}
+	return p.Lock()
+}
+
+// Unlock unlocks the given mappings (enable page out as needed)
+func (p *Mapping) Unlock() error {
+	return p.unlock()
+}
+
+// lockFn locks a mapping for LockAll; tests replace it to inject
+// failures.
+var lockFn = (*Mapping).Lock
+
+// LockAll locks all the given mappings in memory; it is all or
+// nothing: if locking any of them fails, the ones already locked are
+// unlocked before returning the error.
+func LockAll(mappings ...*Mapping) error {
+	for i, p := range mappings {
+		if err := lockFn(p); err != nil {
+			for _, q := range mappings[:i] {
+				q.unlock()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// SetName names an anon mapping; the name shows up in
+// /proc/<pid>/maps as "[anon:name]" and helps identify the mapping
+// while debugging. An empty name removes the name. It needs Linux 5.17+
+// built with CONFIG_ANON_VMA_NAME (6.2+ for shared anon mappings) and
+// returns ErrUnsupported elsewhere and for file mappings.
+func (p *Mapping) SetName(nm string) error {
+	return p.setName(nm)
+}
+
+// CollapseHuge synchronously collapses the mapping into transparent
+// huge pages where possible (MADV_COLLAPSE); this avoids the latency of
+// waiting for khugepaged. It needs Linux 6.1+ and returns ErrUnsupported
+// on older kernels and other platforms.
+func (p *Mapping) CollapseHuge() error {
+	return p.collapseHuge()
+}
+
+// PopulateRead prefaults the pages of the mapping for reading
+// (MADV_POPULATE_READ) without blocking in mmap(2) the way MAP_POPULATE
+// does. It needs Linux 5.14+ and returns ErrUnsupported on older
+// kernels and other platforms.
+func (p *Mapping) PopulateRead() error {
+	return p.populate(false)
+}
+
+// PopulateWrite prefaults the pages of the mapping for writing
+// (MADV_POPULATE_WRITE); this avoids the fault latency of the first
+// write to each page, eg before a latency critical burst of writes. The
+// mapping must be writable. It needs Linux 5.14+ and returns
+// ErrUnsupported on older kernels and other platforms.
+func (p *Mapping) PopulateWrite() error {
+	return p.populate(true)
+}
+
+// ExcludeFromCoreDump excludes the mapping from core dumps of the
+// process (MADV_DONTDUMP); this is useful for mappings that hold
+// secrets. It returns ErrUnsupported on platforms other than Linux.
+func (p *Mapping) ExcludeFromCoreDump() error {
+	return p.coreDump(false)
+}
+
+// IncludeInCoreDump undoes the effect of ExcludeFromCoreDump
+// (MADV_DODUMP). It returns ErrUnsupported on platforms other than Linux.
+func (p *Mapping) IncludeInCoreDump() error {
+	return p.coreDump(true)
+}
+
+// Protect changes the protections of the mapping to 'prot'; eg a
+// read-mostly mapping can be made writable in place when needed.
+// Making a shared file mapping writable needs the file to be opened
+// for writing; Protect returns an error naming the open mode of the
+// file otherwise. Writable and executable protections are subject to
+// W^X enforcement (see EnforceWXProtection).
+func (p *Mapping) Protect(prot Prot) error {
+	if err := checkWX(prot); err != nil {
+		return fmt.Errorf("mmap: protect %s: %w", prot, err)
+	}
+
+	if err := p.protect(prot); err != nil {
+		return fmt.Errorf("mmap: protect %s: %w", prot, err)
+	}
+
+	p.wr = prot&PROT_WRITE != 0
+	return nil
+}
+
+// SyncInstructionCache makes the instructions written to the 'n' bytes
+// at offset 'off' visible to instruction fetch; JIT compilers must call
+// it after writing code and before executing it. It does the needed
+// cache maintenance on arm64 (whose I-cache isn't coherent with the
+// D-cache) and is a no-op on x86. It returns ErrUnsupported on the
+// other archs.
+func (p *Mapping) SyncInstructionCache(off, n int64) error {
+	if off < 0 || n < 0 || off+n > p.size() {
+		return fmt.Errorf("mmap: sync icache %d at %d: out of bounds", n, off)
+	}
+
+	if n == 0 {
+		return nil
+	}
+	return p.syncICache(off, n)
+}
+
+// UnmapRange unmaps the pages entirely within the 'n' bytes at offset
+// 'off' and leaves the rest of the mapping intact; this lets memory
+// managers release the middle of a large mapping. Bytes() continues to
+// span the whole mapping; the caller must not touch the unmapped range
+// (doing so faults). Flush, Lock and friends skip the unmapped range
+// and Unmap releases the remainder. It returns ErrUnsupported on
+// Windows.
+func (p *Mapping) UnmapRange(off, n int64) error {
+	if off < 0 || n < 0 || off+n > p.size() {
+		return fmt.Errorf("mmap: unmap %d at %d: out of bounds", n, off)
+	}
+
+	pg := int64(os.Getpagesize())
+	start := (off + pg - 1) &^ (pg - 1)
+	end := off + n
+	if end < p.size() {
+		end &^= pg - 1
+	}
+	if start >= end {
+		return nil
+	}
+	m := p.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return p.unmapRange(start, end-start)
+}
+
+// Unmap unmaps the given mapping
+func (p *Mapping) Unmap() error {
+	m := p.m
+	sz := p.size()
+	t0 := m.start()
+
+	m.mu.Lock()
+	err := p.unmap()
+	if err == nil {
+		delete(m.live, p)
+	}
+	m.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if o := m.obs; o != nil {
+		o.OnUnmap(sz, time.Since(t0))
+	}
+	return nil
+}
+
+// size returns the length of the mapping
+func (p *Mapping) size() int64 {
+	return int64(len(p.bytes()))
+}
+
+// MappedFile represents the entire contents of a file mapped into
+// memory; the contents are available via Bytes() and the other methods
+// of the embedded Mapping.
+type MappedFile struct {
+	*Mapping
+
+	fd *os.File
+}
+
+// Open opens the file 'path' and maps its entire contents with the
+// given protection. The file is opened read-write if 'prot' includes
+// PROT_WRITE. Close() unmaps the contents and closes the file.
+func Open(path string, prot Prot) (*MappedFile, error) {
+	flag := os.O_RDONLY
+	if prot&PROT_WRITE != 0 {
+		flag = os.O_RDWR
+	}
+
+	fd, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, fmt.Errorf("mmap: %w", err)
+	}
+
+	p, err := New(fd).Map(0, 0, prot, 0)
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	f := &MappedFile{
+		Mapping: p,
+		fd:      fd,
+	}
+	return f, nil
+}
+
+// Close unmaps the file contents and closes the file
+func (f *MappedFile) Close() error {
+	return errors.Join(f.Unmap(), f.fd.Close())
+}
+
+// OpenVerified maps the file 'path' read-only and calls verify with
+// the body and the trailing 'trailerLen' bytes of the file (eg a
+// checksum of the body). The mapping is returned only if verify
+// succeeds; otherwise it is unmapped and the error from verify is
+// returned. The file itself is closed before returning.
+func OpenVerified(path string, trailerLen int, verify func(body, trailer []byte) error) (*Mapping, error) {
+	if trailerLen < 0 {
+		return nil, fmt.Errorf("mmap: %s: invalid trailer length %d", path, trailerLen)
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("mmap: %w", err)
+	}
+
+	defer fd.Close()
+
+	p, err := New(fd).Map(0, 0, PROT_READ, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	b := p.bytes()
+	if len(b) < trailerLen {
+		p.Unmap()
+		return nil, fmt.Errorf("mmap: %s: %d bytes is too short for a %d byte trailer", path, len(b), trailerLen)
+	}
+
+	n := len(b) - trailerLen
+	if err = verify(b[:n], b[n:]); err != nil {
+		p.Unmap()
+		return nil, err
+	}
+	return p, nil
+}
+
+// OpenIndex maps the entire contents of the file 'path' read-only and
+// advises the kernel that it will be accessed randomly (MADV_RANDOM);
+// this disables readahead which only hurts random access files such as
+// indexes. The file itself is closed before returning.
+func OpenIndex(path string) (*Mapping, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("mmap: %w", err)
+	}
+
+	defer fd.Close()
+
+	p, err := New(fd).Map(0, 0, PROT_READ, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if err = adviseFn(p, adviseRandom); err != nil {
+		p.Unmap()
+		return nil, fmt.Errorf("mmap: %s: madvise: %w", path, err)
+	}
+	return p, nil
+}
+
+// Head maps the first 'n' bytes of the file as a read-only mapping
+// suitable for quick inspection (eg sniffing file headers). Files
+// smaller than 'n' bytes are mapped in their entirety. The mapping
+// doesn't prefault the file contents and readahead is disabled
+// (MADV_RANDOM) where the platform supports it.
+func Head(fd *os.File, n int64) (*Mapping, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("mmap: %s: head %d: invalid size", fd.Name(), n)
+	}
+
+	st, err := fd.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("mmap: %w", err)
+	}
+
+	sz := min(n, st.Size())
+	p, err := New(fd).Map(sz, 0, PROT_READ, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = p.noReadahead(); err != nil {
+		p.Unmap()
+		return nil, fmt.Errorf("mmap: %s: madvise: %w", fd.Name(), err)
+	}
+	return p, nil
+}
+
+// LoadPrivate returns a private, writable anon mapping holding a copy
+// of the contents of the file. The copy is detached from the file:
+// later changes to the file aren't visible in it and changes to it are
+// never written back. Unmap frees it.
+func LoadPrivate(fd *os.File) (*Mapping, error) {
+	sz, err := fileSize(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	if sz == 0 {
+		return nil, fmt.Errorf("mmap: %s: empty file", fd.Name())
+	}
+
+	p, err := NewAnon().Map(sz, 0, PROT_RW, F_COW)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = fd.ReadAt(p.bytes(), 0); err != nil {
+		p.Unmap()
+		return nil, fmt.Errorf("mmap: %s: %w", fd.Name(), err)
+	}
+	return p, nil
+}
+
+// AlignedBuffer returns a page aligned buffer of 'sz' bytes backed by
+// an anon mapping; it is suitable for O_DIRECT I/O. The returned
+// closure frees the buffer; the buffer must not be used after that.
+func AlignedBuffer(sz int) ([]byte, func(), error) {
+	if sz <= 0 {
+		return nil, nil, fmt.Errorf("mmap: aligned buffer: invalid size %d", sz)
+	}
+
+	p, err := NewAnon().Map(int64(sz), 0, PROT_RW, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	free := func() {
+		if p != nil {
+			p.Unmap()
+			p = nil
+		}
+	}
+	return p.bytes(), free, nil
+}
+
+// AtomicWrite writes 'sz' bytes to 'path' in an all-or-nothing
+// fashion: it maps a temp file ('path' + ".tmp") of 'sz' bytes, calls
+// fn to populate it, flushes it to disk, renames it over 'path' and
+// syncs the parent directory so that the rename is durable. The new
+// file keeps the permissions of the file it replaces (0600 for a new
+// file). If any step fails, the temp file is removed and 'path' is
+// left untouched.
+func AtomicWrite(path string, sz int64, fn func(b []byte) error) error {
+	if sz <= 0 {
+		return fmt.Errorf("mmap: atomic write %s: invalid size %d", path, sz)
+	}
+
+	var mode fs.FileMode = 0600
+	if st, err := os.Stat(path); err == nil {
+		mode = st.Mode().Perm()
+	}
+
+	tmp := path + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return fmt.Errorf("mmap: atomic write: %w", err)
+	}
+
+	// the umask (or a stale temp file) may have left a different mode
+	err = fd.Chmod(mode)
+	if err == nil {
+		err = stage(fd, sz, fn)
+	}
+
+	// windows can't rename open files; so close it first
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("mmap: atomic write %s: %w", path, err)
+	}
+
+	if err = syncDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("mmap: atomic write %s: %w", path, err)
+	}
+	return nil
+}
+
+// stage populates the temp file of AtomicWrite via fn
+func stage(fd *os.File, sz int64, fn func(b []byte) error) error {
+	if err := fd.Truncate(sz); err != nil {
+		return err
+	}
+
+	p, err := New(fd).Map(sz, 0, PROT_RW, 0)
+	if err != nil {
+		return err
+	}
+
+	if err = fn(p.bytes()); err == nil {
+		err = p.Flush()
+	}
+
+	if err2 := p.Unmap(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// CloneFile creates 'dst' as a copy-on-write clone of 'src' on
+// filesystems that support it (eg btrfs and XFS via FICLONE on Linux,
+// APFS via clonefile(2) on Darwin); the clone shares the storage of
+// 'src' until either is modified. 'dst' must not exist. It returns an
+// error wrapping ErrUnsupported if the platform or filesystem can't
+// clone files; callers can fall back to a regular copy.
+func CloneFile(src, dst string) error {
+	if err := cloneFile(src, dst); err != nil {
+		return fmt.Errorf("mmap: clone %s to %s: %w", src, dst, err)
+	}
+	return nil
+}
+
+// NewFaultHandler returns an experimental demand paged anon mapping of
+// 'sz' bytes (rounded up to a multiple of the page size): the first
+// access to each page calls fill with the index of the page and a page
+// sized buffer to populate (eg by decompressing from a backing store).
+// Pages whose fill fails read as zeros. fill runs on a separate
+// goroutine while the faulting goroutine is blocked; it must not touch
+// the mapping itself. Faults are served until the mapping is unmapped.
+// On Linux, this uses userfaultfd(2); elsewhere it returns
+// ErrUnsupported.
+func NewFaultHandler(sz int64, fill func(pageIdx int64, page []byte) error) (*Mapping, error) {
+	if sz <= 0 {
+		return nil, fmt.Errorf("mmap: fault handler: invalid size %d", sz)
+	}
+	return newFaultHandler(pageRound(sz), fill)
+}
+
+// DonateCache copies 'n' bytes at offset 'off' of 'src' to the same
+// offset of 'dst' in the kernel (copy_file_range(2) on Linux); the
+// data never passes through user space and filesystems may share page
+// cache or storage between the files, or copy on the server. This is an
+// alternative to copying large ranges via mappings. It returns an error
+// wrapping ErrUnsupported where the platform or filesystem can't do
+// this; callers can fall back to a regular copy.
+func DonateCache(src, dst *os.File, off, n int64) error {
+	if off < 0 || n < 0 {
+		return fmt.Errorf("mmap: copy %d at %d: invalid range", n, off)
+	}
+
+	if err := copyRange(src, dst, off, n); err != nil {
+		return fmt.Errorf("mmap: copy %s to %s: %d at %d: %w", src.Name(), dst.Name(), n, off, err)
+	}
+	return nil
+}
+
+// ExecMappingAllowed reports whether the system permits anon mappings
+// that are both writable and executable (eg for JIT compilers).
+// Hardened systems (W^X policies, SELinux etc.) may disallow them.
+func ExecMappingAllowed() bool {
+	sz := int64(os.Getpagesize())
+	p, err := NewAnon().map_anon(sz, 0, PROT_READ|PROT_WRITE|PROT_EXEC, 0)
+	if err != nil {
+		return false
+	}
+
+	p.unmap()
+	return true
+}
+
+// Reader mmap's chunks of the file and calls the given closure
+// with successive chunks of the file contents until EOF. If the
+// closure returns non-nil error, it breaks the iteration and the
+// error is propogated back to the caller along with any error from
+// unmapping the chunk. Reader returns the number of bytes of read.
+func Reader(fd *os.File, fp func(buf []byte) error) (int64, error) {
+	return chunks(fd, _MaxMmapSize, fp)
+}
+
+// MapStream drains 'r' into a temporary file and returns a read-only
+// mapping of its contents; this provides random access to data from
+// non-seekable sources such as pipes and sockets. The returned closure
+// unmaps the contents and removes the temporary file.
+func MapStream(r io.Reader) (*Mapping, func() error, error) {
+	fd, err := os.CreateTemp("", "mmap-stream")
+	if err != nil {
+		return nil, nil, fmt.Errorf("mmap: stream: %w", err)
+	}
+
+	cleanup := func() error {
+		return errors.Join(fd.Close(), os.Remove(fd.Name()))
+	}
+
+	if _, err = io.Copy(fd, r); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("mmap: stream: %w", err)
+	}
+
+	p, err := New(fd).Map(0, 0, PROT_READ, 0)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("mmap: stream: %w", err)
+	}
+
+	done := func() error {
+		return errors.Join(p.Unmap(), cleanup())
+	}
+	return p, done, nil
+}
+
+// MapStdin maps the entire contents of stdin read-only when it is
+// redirected from a regular file; it returns an error if stdin is a
+// pipe, terminal etc. (see MapStream for those).
+func MapStdin() (*Mapping, error) {
+	if err := isRegular(os.Stdin); err != nil {
+		return nil, err
+	}
+	return New(os.Stdin).Map(0, 0, PROT_READ, 0)
+}
+
+// MapStdout resizes stdout to 'sz' bytes and maps it read-write when
+// it is redirected to a regular file; it returns an error if stdout is
+// a pipe, terminal etc. Shared writable mappings need the file to be
+// opened read-write (eg via "1<>file" in the shell); a plain ">file"
+// redirect opens it write-only and mapping it fails.
+func MapStdout(sz int64) (*Mapping, error) {
+	if err := isRegular(os.Stdout); err != nil {
+		return nil, err
+	}
+
+	if sz <= 0 {
+		return nil, fmt.Errorf("mmap: %s: map %d: invalid size", os.Stdout.Name(), sz)
+	}
+
+	if err := os.Stdout.Truncate(sz); err != nil {
+		return nil, fmt.Errorf("mmap: %w", err)
+	}
+	return New(os.Stdout).Map(sz, 0, PROT_RW, 0)
+}
+
+// isRegular returns an error unless 'fd' is a regular file
+func isRegular(fd *os.File) error {
+	st, err := fd.Stat()
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+
+	if !st.Mode().IsRegular() {
+		return fmt.Errorf("mmap: %s: not a regular file (%s)", fd.Name(), st.Mode().Type())
+	}
+	return nil
+}
+
+// ErrChecksumMismatch is returned by ReaderVerify when the digest of
+// the file contents doesn't match the expected digest.
+type ErrChecksumMismatch struct {
+	Got  []byte
+	Want []byte
+}
+
+func (e *ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("mmap: checksum mismatch: got %x, want %x", e.Got, e.Want)
+}
+
+// ReaderVerify streams the contents of the file through the hash 'h'
+// (via Reader) and compares the resulting digest with 'expected'. It
+// returns *ErrChecksumMismatch if the digests differ.
+func ReaderVerify(fd *os.File, expected []byte, h hash.Hash) error {
+	h.Reset()
+	_, err := Reader(fd, func(b []byte) error {
+		h.Write(b)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		off += sz
-		z += sz
-		fsz -= sz
+	sum := h.Sum(nil)
+	if !bytes.Equal(sum, expected) {
+		return &ErrChecksumMismatch{Got: sum, Want: expected}
 	}
-	return z, nil
+	return nil
 }
@@ -0,0 +1,1163 @@
+// mmap_linux_test.go - linux specific tests for mmap-go
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+
+package mmap_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/opencoff/go-mmap"
+	"golang.org/x/sys/unix"
+)
+
+func TestNoReserveFallback(t *testing.T) {
+	assert := newAsserter(t)
+
+	mode, err := os.ReadFile("/proc/sys/vm/overcommit_memory")
+	if err != nil || !bytes.Equal(bytes.TrimSpace(mode), []byte("0")) {
+		t.Skip("needs heuristic overcommit (vm.overcommit_memory=0)")
+	}
+
+	var si unix.Sysinfo_t
+	err = unix.Sysinfo(&si)
+	assert(err == nil, "sysinfo: %s", err)
+
+	// the overcommit heuristic refuses any single mapping larger than
+	// RAM + swap; MAP_NORESERVE bypasses that accounting.
+	unit := int64(si.Unit)
+	sz := 2 * (int64(si.Totalram) + int64(si.Totalswap)) * unit
+	if sz > mmap.MaxMappingSize {
+		t.Skipf("system memory too large for this test")
+	}
+
+	m := mmap.NewAnon()
+	_, err = m.Map(sz, 0, mmap.PROT_READ|mmap.PROT_WRITE, 0)
+	assert(errors.Is(err, unix.ENOMEM), "mmap %d: exp ENOMEM, saw %v", sz, err)
+
+	m.SetNoReserveFallback(true)
+	p, err := m.Map(sz, 0, mmap.PROT_READ|mmap.PROT_WRITE, 0)
+	assert(err == nil, "mmap %d with fallback: %s", sz, err)
+	assert(len(p.Bytes()) == int(sz), "mmap: len exp %d, saw %d", sz, len(p.Bytes()))
+
+	err = p.Unmap()
+	assert(err == nil, "unmap: %s", err)
+}
+
+func TestSpill(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+
+	var sz int64 = 4 * _PAGE
+	m, err := mmap.NewSpill(dir, sz)
+	assert(err == nil, "spill %s: %s", dir, err)
+
+	p, err := m.Map(0, 0, mmap.PROT_READ|mmap.PROT_WRITE, 0)
+	assert(err == nil, "spill: mmap: %s", err)
+	assert(len(p.Bytes()) == int(sz), "spill: len exp %d, saw %d", sz, len(p.Bytes()))
+
+	pages := randData(sz)
+	for i := range pages {
+		pg := &pages[i]
+		copy(p.Bytes()[pg.off:], pg.buf)
+	}
+
+	err = p.Flush()
+	assert(err == nil, "spill: flush: %s", err)
+
+	de, err := os.ReadDir(dir)
+	assert(err == nil, "readdir %s: %s", dir, err)
+	assert(len(de) == 0, "spill: %s has %d named files", dir, len(de))
+
+	for i := range pages {
+		pg := &pages[i]
+		assert(bytes.Equal(pg.buf, p.Bytes()[pg.off:pg.off+int64(len(pg.buf))]),
+			"spill at %d: content mismatch", pg.off)
+	}
+
+	assert(p.Unmap() == nil, "spill: unmap failed")
+	assert(m.Close() == nil, "spill: close failed")
+}
+
+func TestPreallocate(t *testing.T) {
+	assert := newAsserter(t)
+
+	fname := tmpName(t)
+	fd, err := os.OpenFile(fname, os.O_CREATE|os.O_RDWR, 0600)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	defer fd.Close()
+
+	var sz int64 = 64 * _PAGE
+	err = fd.Truncate(sz)
+	assert(err == nil, "truncate %s: %s", fname, err)
+
+	var st0 unix.Stat_t
+	err = unix.Fstat(int(fd.Fd()), &st0)
+	assert(err == nil, "stat %s: %s", fname, err)
+
+	m := mmap.New(fd)
+	err = m.Preallocate(0, 2*sz)
+	if errors.Is(err, unix.EOPNOTSUPP) {
+		t.Skipf("fallocate not supported: %s", err)
+	}
+	assert(err == nil, "preallocate %s: %s", fname, err)
+
+	var st1 unix.Stat_t
+	err = unix.Fstat(int(fd.Fd()), &st1)
+	assert(err == nil, "stat %s: %s", fname, err)
+	assert(st1.Blocks > st0.Blocks, "preallocate: blocks %d -> %d", st0.Blocks, st1.Blocks)
+	assert(st1.Size == 2*sz, "preallocate: size exp %d, saw %d", 2*sz, st1.Size)
+}
+
+func TestMaxMmapSize(t *testing.T) {
+	assert := newAsserter(t)
+
+	v := mmap.MaxMmapSize()
+	assert(v > 0, "max mmap size: %d", v)
+	assert(v <= mmap.MaxMappingSize, "max mmap size: %d > %d", v, mmap.MaxMappingSize)
+
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_AS, &lim); err == nil {
+		exp := mmap.MaxMappingSize
+		if cur := uint64(lim.Cur); cur != unix.RLIM_INFINITY && cur < uint64(exp) {
+			exp = int64(cur)
+		}
+		assert(v == exp, "max mmap size: exp %d, saw %d", exp, v)
+	}
+}
+
+func TestWaitFlush(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 16 * _PAGE
+	fname := tmpName(t)
+	err := createFile(fname, randData(sz))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	f, err := mmap.Open(fname, mmap.PROT_RW)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer f.Close()
+
+	pages := randData(sz)
+	for i := range pages {
+		pg := &pages[i]
+		copy(f.Bytes()[pg.off:], pg.buf)
+	}
+
+	err = f.FlushAsync()
+	assert(err == nil, "flush async: %s", err)
+
+	err = f.WaitFlush()
+	assert(err == nil, "wait flush: %s", err)
+
+	b, err := os.ReadFile(fname)
+	assert(err == nil, "read %s: %s", fname, err)
+	assert(bytes.Equal(b, concat(pages)), "wait flush: content mismatch")
+}
+
+func TestFaultInjectNoReserve(t *testing.T) {
+	assert := newAsserter(t)
+
+	// refuse all mappings that don't ask for MAP_NORESERVE
+	var noreserve bool
+	mmap.InjectFault(func(fd int, off int64, sz int, prot, flags int) ([]byte, error) {
+		if flags&unix.MAP_NORESERVE == 0 {
+			return nil, unix.ENOMEM
+		}
+		noreserve = true
+		return unix.Mmap(fd, off, sz, prot, flags)
+	})
+	defer mmap.InjectFault(nil)
+
+	m := mmap.NewAnon()
+	_, err := m.Map(_PAGE, 0, mmap.PROT_RW, 0)
+	assert(errors.Is(err, unix.ENOMEM), "map: exp ENOMEM, saw %v", err)
+	assert(!noreserve, "map: unexpected MAP_NORESERVE")
+
+	m.SetNoReserveFallback(true)
+	p, err := m.Map(_PAGE, 0, mmap.PROT_RW, 0)
+	assert(err == nil, "map with fallback: %s", err)
+	assert(noreserve, "map: fallback didn't use MAP_NORESERVE")
+	assert(p.Unmap() == nil, "unmap failed")
+}
+
+func TestScanner(t *testing.T) {
+	assert := newAsserter(t)
+
+	window := 64 * _PAGE
+
+	fname := tmpName(t)
+	pages := randData(64 * window)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	// start with a cold page cache
+	err = unix.Fadvise(int(fd.Fd()), 0, 0, unix.FADV_DONTNEED)
+	assert(err == nil, "fadvise: %s", err)
+
+	var maxRes int
+	h := sha256.New()
+	s := mmap.NewScanner(fd, window)
+	err = s.Each(func(off int64, b []byte) error {
+		h.Write(b)
+		n, err := s.Resident()
+		if err != nil {
+			return err
+		}
+		maxRes = max(maxRes, n)
+		return nil
+	})
+	assert(err == nil, "scan: %s", err)
+	assert(bytes.Equal(h.Sum(nil), cksum(pages)), "scan: checksum mismatch")
+
+	// the current window, the prefetched next window and some slack
+	// for the kernel's fault-around
+	lim := int(3 * window / _PAGE)
+	if maxRes > lim {
+		t.Fatalf("scan: %d pages resident; exp at most %d", maxRes, lim)
+	}
+	t.Logf("scan: max %d pages resident (window %d pages)", maxRes, window/_PAGE)
+}
+
+func TestGrowsDown(t *testing.T) {
+	assert := newAsserter(t)
+
+	p, err := mmap.NewAnon().Map(4*_PAGE, 0, mmap.PROT_RW, mmap.F_GROWSDOWN)
+	assert(err == nil, "map growsdown: %s", err)
+
+	b := p.Bytes()
+	for i := range b {
+		b[i] = byte(i)
+	}
+	assert(b[len(b)-1] == byte(len(b)-1), "growsdown: write failed")
+	assert(p.Unmap() == nil, "unmap failed")
+
+	fname := tmpName(t)
+	err = createFile(fname, randData(_PAGE))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	_, err = mmap.New(fd).Map(0, 0, mmap.PROT_READ, mmap.F_GROWSDOWN)
+	assert(errors.Is(err, mmap.ErrUnsupported), "file growsdown: exp ErrUnsupported, saw %v", err)
+}
+
+func TestCloneFile(t *testing.T) {
+	assert := newAsserter(t)
+
+	src := tmpName(t)
+	pages := randData(8 * _PAGE)
+	err := createFile(src, pages)
+	assert(err == nil, "create %s: %s", src, err)
+
+	dst := src + ".clone"
+	err = mmap.CloneFile(src, dst)
+	if errors.Is(err, mmap.ErrUnsupported) {
+		t.Skipf("clone: %s", err)
+	}
+	assert(err == nil, "clone: %s", err)
+
+	err = mmap.CloneFile(src, dst)
+	assert(err != nil, "clone: expected error for existing dst")
+
+	f, err := mmap.Open(dst, mmap.PROT_RW)
+	assert(err == nil, "open %s: %s", dst, err)
+	assert(bytes.Equal(f.Bytes(), concat(pages)), "clone: content mismatch")
+
+	// modify the clone; src must be unaffected
+	copy(f.Bytes(), "hello, world")
+	assert(f.Close() == nil, "close %s", dst)
+
+	b, err := os.ReadFile(src)
+	assert(err == nil, "read %s: %s", src, err)
+	assert(bytes.Equal(b, concat(pages)), "clone: src modified")
+}
+
+func TestFlushAndLock(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 8 * _PAGE
+	fname := tmpName(t)
+	err := createFile(fname, randData(sz))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	f, err := mmap.Open(fname, mmap.PROT_RW)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer f.Close()
+
+	before := vmLocked(t)
+
+	msg := []byte("hello, world")
+	copy(f.Bytes()[_PAGE:], msg)
+	err = f.FlushAndLock()
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOMEM) {
+		t.Skipf("mlock: %s", err)
+	}
+	assert(err == nil, "flush and lock: %s", err)
+
+	defer f.Unlock()
+
+	after := vmLocked(t)
+	assert(after-before >= sz, "lock: VmLck grew by %d; exp %d", after-before, sz)
+
+	b, err := os.ReadFile(fname)
+	assert(err == nil, "read %s: %s", fname, err)
+	assert(bytes.Equal(b[_PAGE:_PAGE+int64(len(msg))], msg), "flush: content mismatch")
+}
+
+func TestLockAll(t *testing.T) {
+	assert := newAsserter(t)
+
+	sz := 8 * _PAGE
+	var maps []*mmap.Mapping
+	for i := 0; i < 3; i++ {
+		p, err := mmap.NewAnon().Map(sz, 0, mmap.PROT_RW, 0)
+		assert(err == nil, "map: %s", err)
+		defer p.Unmap()
+		maps = append(maps, p)
+	}
+
+	before := vmLocked(t)
+	err := mmap.LockAll(maps...)
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOMEM) {
+		t.Skipf("mlock: %s", err)
+	}
+	assert(err == nil, "lock all: %s", err)
+
+	after := vmLocked(t)
+	assert(after-before == 3*sz, "lock all: VmLck grew by %d; exp %d", after-before, 3*sz)
+
+	for _, p := range maps {
+		assert(p.Unlock() == nil, "unlock")
+	}
+	assert(vmLocked(t) == before, "unlock: VmLck didn't shrink")
+
+	// the third lock fails; the first two must be rolled back
+	errFail := errors.New("fail")
+	var n int
+	mmap.SetLockHook(func(p *mmap.Mapping) error {
+		if n++; n == 3 {
+			return errFail
+		}
+		return p.Lock()
+	})
+	defer mmap.SetLockHook(nil)
+
+	err = mmap.LockAll(maps...)
+	assert(errors.Is(err, errFail), "lock all: exp fail, saw %v", err)
+	assert(n == 3, "lock all: exp 3 locks, saw %d", n)
+	assert(vmLocked(t) == before, "lock all: VmLck %d after rollback; exp %d", vmLocked(t), before)
+}
+
+// vmLocked returns the locked memory of the process (in bytes)
+func vmLocked(t *testing.T) int64 {
+	b, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Skipf("can't read process status: %s", err)
+	}
+
+	for _, ln := range strings.Split(string(b), "\n") {
+		var kb int64
+		if _, err := fmt.Sscanf(ln, "VmLck: %d kB", &kb); err == nil {
+			return kb * 1024
+		}
+	}
+	t.Skipf("no VmLck in process status")
+	return 0
+}
+
+func TestNetworkFS(t *testing.T) {
+	assert := newAsserter(t)
+
+	tests := []struct {
+		ftype int64
+		exp   bool
+	}{
+		{0x6969, true},      // NFS
+		{0xff534d42, true},  // CIFS
+		{-0x00acb2be, true}, // CIFS as a signed 32-bit f_type
+		{0xfe534d42, true},  // SMB2
+		{0xef53, false},     // ext4
+		{0x58465342, false}, // XFS
+		{0x01021994, false}, // tmpfs
+	}
+
+	for _, x := range tests {
+		ok := mmap.IsNetworkFSType(uint32(x.ftype))
+		assert(ok == x.exp, "f_type %#x: exp %v, saw %v", x.ftype, x.exp, ok)
+	}
+
+	fname := tmpName(t)
+	err := createFile(fname, randData(_PAGE))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	var st unix.Statfs_t
+	err = unix.Fstatfs(int(fd.Fd()), &st)
+	assert(err == nil, "fstatfs: %s", err)
+
+	ok, err := mmap.New(fd).IsNetworkFS()
+	assert(err == nil, "network fs: %s", err)
+	assert(ok == mmap.IsNetworkFSType(uint32(st.Type)), "network fs: mismatch for f_type %#x", st.Type)
+
+	ok, err = mmap.NewAnon().IsNetworkFS()
+	assert(err == nil && !ok, "anon: exp false, saw %v, %v", ok, err)
+}
+
+func TestSetName(t *testing.T) {
+	assert := newAsserter(t)
+
+	p, err := mmap.NewAnon().Map(4*_PAGE, 0, mmap.PROT_RW, mmap.F_COW)
+	assert(err == nil, "map anon: %s", err)
+
+	defer p.Unmap()
+
+	nm := fmt.Sprintf("mmap-test-%x", randU32())
+	err = p.SetName(nm)
+	if errors.Is(err, unix.EINVAL) {
+		t.Skipf("kernel doesn't support anon vma names: %s", err)
+	}
+	assert(err == nil, "set name: %s", err)
+
+	maps, err := os.ReadFile("/proc/self/maps")
+	assert(err == nil, "read maps: %s", err)
+
+	want := fmt.Sprintf("%x-", p.Addr())
+	var found bool
+	for _, ln := range strings.Split(string(maps), "\n") {
+		if strings.HasPrefix(ln, want) {
+			found = strings.HasSuffix(ln, "[anon_shmem:"+nm+"]") || strings.HasSuffix(ln, "[anon:"+nm+"]")
+			assert(found, "maps: name missing: %s", ln)
+		}
+	}
+	assert(found, "maps: no mapping at %#x", p.Addr())
+
+	fname := tmpName(t)
+	err = createFile(fname, randData(_PAGE))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	f, err := mmap.Open(fname, mmap.PROT_READ)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer f.Close()
+
+	err = f.SetName(nm)
+	assert(errors.Is(err, mmap.ErrUnsupported), "file set name: exp ErrUnsupported, saw %v", err)
+}
+
+// kernelAtLeast returns true if the running kernel is at least
+// major.minor
+func kernelAtLeast(major, minor int) bool {
+	var un unix.Utsname
+	if err := unix.Uname(&un); err != nil {
+		return false
+	}
+
+	var kmaj, kmin int
+	rel := unix.ByteSliceToString(un.Release[:])
+	if _, err := fmt.Sscanf(rel, "%d.%d", &kmaj, &kmin); err != nil {
+		return false
+	}
+	return kmaj > major || (kmaj == major && kmin >= minor)
+}
+
+func TestCollapseHuge(t *testing.T) {
+	assert := newAsserter(t)
+
+	if !kernelAtLeast(6, 1) {
+		t.Skip("MADV_COLLAPSE needs linux 6.1+")
+	}
+
+	// large enough to hold at least one aligned 2MB huge page
+	var sz int64 = 4 << 20
+	p, err := mmap.NewAnon().Map(sz, 0, mmap.PROT_RW, mmap.F_COW)
+	assert(err == nil, "map anon: %s", err)
+
+	defer p.Unmap()
+
+	b := p.Bytes()
+	for i := int64(0); i < sz; i += _PAGE {
+		b[i] = byte(i / _PAGE)
+	}
+
+	err = p.CollapseHuge()
+	switch {
+	case errors.Is(err, unix.EAGAIN), errors.Is(err, unix.ENOMEM):
+		t.Skipf("collapse: %s", err)
+	case err != nil:
+		assert(errors.Is(err, mmap.ErrUnsupported), "collapse: %s", err)
+	}
+
+	for i := int64(0); i < sz; i += _PAGE {
+		assert(b[i] == byte(i/_PAGE), "collapse: page %d corrupted", i/_PAGE)
+	}
+}
+
+func TestPopulate(t *testing.T) {
+	assert := newAsserter(t)
+
+	if !kernelAtLeast(5, 14) {
+		t.Skip("MADV_POPULATE_(READ|WRITE) needs linux 5.14+")
+	}
+
+	var sz int64 = 64 * _PAGE
+	populate := map[string]func(p *mmap.Mapping) error{
+		"read":  (*mmap.Mapping).PopulateRead,
+		"write": (*mmap.Mapping).PopulateWrite,
+	}
+
+	for nm, fp := range populate {
+		p, err := mmap.NewAnon().Map(sz, 0, mmap.PROT_RW, mmap.F_COW)
+		assert(err == nil, "map anon: %s", err)
+
+		before, err := p.Resident()
+		assert(err == nil, "resident: %s", err)
+
+		err = fp(p)
+		assert(err == nil, "populate %s: %s", nm, err)
+
+		after, err := p.Resident()
+		assert(err == nil, "resident: %s", err)
+		assert(after > before, "populate %s: resident %d -> %d", nm, before, after)
+		assert(after == int(sz/_PAGE), "populate %s: exp %d resident, saw %d", nm, sz/_PAGE, after)
+		assert(p.Unmap() == nil, "unmap")
+	}
+}
+
+func TestFaultStats(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 256 * _PAGE
+	fname := tmpName(t)
+	err := createFile(fname, randData(sz))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	// evict the file so that touching it likely needs disk I/O; the
+	// kernel may still find some pages cached. So we can't insist on
+	// seeing major faults.
+	err = unix.Fadvise(int(fd.Fd()), 0, 0, unix.FADV_DONTNEED)
+	assert(err == nil, "fadvise: %s", err)
+
+	p, err := mmap.New(fd).Map(0, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map: %s", err)
+
+	defer p.Unmap()
+
+	var sum byte
+	b := p.Bytes()
+	minor, major := mmap.WithFaultStats(func() {
+		for i := int64(0); i < sz; i += _PAGE {
+			sum += b[i]
+		}
+	})
+	t.Logf("%d pages: %d minor, %d major faults", sz/_PAGE, minor, major)
+	assert(minor+major > 0, "fault stats: no faults reported")
+}
+
+func TestUninitialized(t *testing.T) {
+	assert := newAsserter(t)
+
+	// most kernels silently zero the pages; so we can't assert much
+	// beyond the mapping being usable.
+	sz := 8 * _PAGE
+	for _, fl := range []mmap.Flag{mmap.F_UNINITIALIZED, mmap.F_UNINITIALIZED | mmap.F_COW} {
+		p, err := mmap.NewAnon().Map(sz, 0, mmap.PROT_RW, fl)
+		assert(err == nil, "map %s: %s", fl, err)
+
+		b := p.Bytes()
+		assert(int64(len(b)) == sz, "map %s: exp %d bytes, saw %d", fl, sz, len(b))
+		for i := range b {
+			b[i] = byte(i)
+		}
+		assert(b[sz-1] == byte(sz-1), "map %s: write failed", fl)
+		assert(p.Unmap() == nil, "unmap %s", fl)
+	}
+}
+
+func TestCanMap(t *testing.T) {
+	assert := newAsserter(t)
+
+	ok, err := mmap.CanMap(1 << 20)
+	assert(err == nil, "can map 1M: %s", err)
+	assert(ok, "can't map 1M")
+
+	// larger than any machine we'll run on
+	ok, err = mmap.CanMap(1 << 62)
+	assert(err == nil, "can map 4E: %s", err)
+	assert(!ok, "can map 4E")
+
+	_, err = mmap.CanMap(0)
+	assert(err != nil, "can map 0: no error")
+}
+
+func TestReaderPrefetch(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 37*_PAGE + 123
+	fname := tmpName(t)
+	pages := randData(sz)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	var calls int
+	h := sha256.New()
+	n, err := mmap.ReaderPrefetch(fd, 4*_PAGE, func(b []byte) error {
+		calls++
+		h.Write(b)
+		return nil
+	})
+	assert(err == nil, "prefetch: %s", err)
+	assert(n == sz, "prefetch: exp %d bytes, saw %d", sz, n)
+	assert(calls == 10, "prefetch: exp 10 chunks, saw %d", calls)
+	assert(bytes.Equal(h.Sum(nil), cksum(pages)), "prefetch: checksum mismatch")
+
+	errStop := errors.New("stop")
+	calls = 0
+	n, err = mmap.ReaderPrefetch(fd, 4*_PAGE, func(b []byte) error {
+		if calls++; calls == 3 {
+			return errStop
+		}
+		return nil
+	})
+	assert(errors.Is(err, errStop), "prefetch: exp errStop, saw %v", err)
+	assert(n == 8*_PAGE, "prefetch: exp %d bytes, saw %d", 8*_PAGE, n)
+
+	// unmap failures are reported
+	errUnmap := errors.New("unmap")
+	mmap.SetUnmapHook(func(p *mmap.Mapping) error {
+		p.Unmap()
+		return errUnmap
+	})
+	defer mmap.SetUnmapHook(nil)
+
+	_, err = mmap.ReaderPrefetch(fd, 4*_PAGE, func(b []byte) error {
+		return nil
+	})
+	assert(errors.Is(err, errUnmap), "prefetch: exp unmap error, saw %v", err)
+}
+
+func TestOpenIndex(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 7*_PAGE + 3
+	fname := tmpName(t)
+	pages := randData(sz)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	p, err := mmap.OpenIndex(fname)
+	assert(err == nil, "open index: %s", err)
+
+	defer p.Unmap()
+
+	assert(bytes.Equal(p.Bytes(), concat(pages)), "open index: content mismatch")
+
+	// the kernel shows MADV_RANDOM as "rr" in the VmFlags of the mapping
+	fl := vmFlags(t, p.Addr())
+	assert(slices.Contains(fl, "rr"), "open index: no MADV_RANDOM in %v", fl)
+}
+
+// vmFlags returns the VmFlags of the region holding addr from
+// /proc/self/smaps; the kernel may have merged the mapping with its
+// neighbours.
+func vmFlags(t *testing.T, addr uintptr) []string {
+	assert := newAsserter(t)
+
+	b, err := os.ReadFile("/proc/self/smaps")
+	assert(err == nil, "smaps: %s", err)
+
+	var found bool
+	for _, ln := range strings.Split(string(b), "\n") {
+		var lo, hi uintptr
+		if _, err := fmt.Sscanf(ln, "%x-%x ", &lo, &hi); err == nil {
+			found = lo <= addr && addr < hi
+			continue
+		}
+		if found && strings.HasPrefix(ln, "VmFlags:") {
+			return strings.Fields(ln)[1:]
+		}
+	}
+	assert(false, "smaps: no mapping at %#x", addr)
+	return nil
+}
+
+func TestDonateCache(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 16 * _PAGE
+	src := tmpName(t)
+	pages := randData(sz)
+	err := createFile(src, pages)
+	assert(err == nil, "create %s: %s", src, err)
+
+	dst := tmpName(t) + ".dst"
+	err = createFile(dst, randData(sz))
+	assert(err == nil, "create %s: %s", dst, err)
+
+	sfd, err := os.Open(src)
+	assert(err == nil, "open %s: %s", src, err)
+
+	defer sfd.Close()
+
+	dfd, err := os.OpenFile(dst, os.O_RDWR, 0600)
+	assert(err == nil, "open %s: %s", dst, err)
+
+	defer dfd.Close()
+
+	want, err := os.ReadFile(dst)
+	assert(err == nil, "read %s: %s", dst, err)
+
+	off, n := 3*_PAGE+17, 5*_PAGE+100
+	err = mmap.DonateCache(sfd, dfd, off, n)
+	if errors.Is(err, mmap.ErrUnsupported) {
+		t.Skipf("copy_file_range: %s", err)
+	}
+	assert(err == nil, "donate: %s", err)
+
+	copy(want[off:off+n], concat(pages)[off:off+n])
+	got, err := os.ReadFile(dst)
+	assert(err == nil, "read %s: %s", dst, err)
+	assert(bytes.Equal(got, want), "donate: content mismatch")
+
+	// copying past the end of src
+	err = mmap.DonateCache(sfd, dfd, sz-10, 20)
+	assert(errors.Is(err, io.ErrUnexpectedEOF), "donate past EOF: %v", err)
+}
+
+func TestFaultHandler(t *testing.T) {
+	assert := newAsserter(t)
+
+	var mu sync.Mutex
+	var seen []int64
+	fill := func(idx int64, page []byte) error {
+		mu.Lock()
+		seen = append(seen, idx)
+		mu.Unlock()
+
+		for i := range page {
+			page[i] = byte(idx)
+		}
+		return nil
+	}
+
+	p, err := mmap.NewFaultHandler(32*_PAGE, fill)
+	if err != nil && (errors.Is(err, mmap.ErrUnsupported) || errors.Is(err, unix.EPERM)) {
+		t.Skipf("userfaultfd: %s", err)
+	}
+	assert(err == nil, "fault handler: %s", err)
+
+	b := p.Bytes()
+	touch := []int64{3, 17, 0, 31}
+	for _, i := range touch {
+		v := b[i*_PAGE+5]
+		assert(v == byte(i), "page %d: exp %d, saw %d", i, byte(i), v)
+	}
+
+	// already filled pages don't fault again
+	assert(b[17*_PAGE] == 17, "page 17 refilled")
+
+	mu.Lock()
+	got := slices.Clone(seen)
+	mu.Unlock()
+	assert(slices.Equal(got, touch), "fill: exp %v, saw %v", touch, got)
+
+	assert(p.Unmap() == nil, "unmap")
+}
+
+func TestDirectIOCompatible(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 8 * _PAGE
+	fname := tmpName(t)
+	err := createFile(fname, randData(sz))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	// skip filesystems that can't do O_DIRECT at all
+	dfd, err := os.OpenFile(fname, os.O_RDONLY|unix.O_DIRECT, 0)
+	if err != nil {
+		t.Skipf("O_DIRECT: %s", err)
+	}
+	dfd.Close()
+
+	p, err := mmap.New(fd).Map(0, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map: %s", err)
+
+	defer p.Unmap()
+
+	ok, err := p.IsDirectIOCompatible(fd)
+	assert(err == nil, "direct io: %s", err)
+	assert(ok, "direct io: page aligned mapping not compatible")
+
+	// a mapping with an odd length isn't
+	q, err := mmap.New(fd).Map(sz-100, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map: %s", err)
+
+	defer q.Unmap()
+
+	ok, err = q.IsDirectIOCompatible(fd)
+	assert(err == nil, "direct io: %s", err)
+	assert(!ok, "direct io: odd length mapping is compatible")
+}
+
+func TestFilesystemType(t *testing.T) {
+	assert := newAsserter(t)
+
+	fname := tmpName(t)
+	err := createFile(fname, randData(_PAGE))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	fs, err := mmap.New(fd).FilesystemType()
+	assert(err == nil, "fs type: %s", err)
+	t.Logf("%s: %s", fname, fs)
+
+	var st unix.Statfs_t
+	err = unix.Fstatfs(int(fd.Fd()), &st)
+	assert(err == nil, "statfs: %s", err)
+
+	switch st.Type {
+	case unix.TMPFS_MAGIC:
+		assert(fs == "tmpfs", "fs type: exp tmpfs, saw %q", fs)
+	case unix.EXT4_SUPER_MAGIC:
+		assert(fs == "ext4", "fs type: exp ext4, saw %q", fs)
+	default:
+		assert(fs != "", "fs type: empty")
+	}
+
+	_, err = mmap.NewAnon().FilesystemType()
+	assert(err != nil, "fs type of anon: no error")
+}
+
+func TestSmapsStats(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 64 * _PAGE
+	fname := tmpName(t)
+	err := createFile(fname, randData(sz))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	f, err := mmap.Open(fname, mmap.PROT_RW)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer f.Close()
+
+	// no readahead: so only the touched pages are resident
+	err = unix.Madvise(f.Bytes(), unix.MADV_RANDOM)
+	assert(err == nil, "madvise: %s", err)
+
+	// read 16 pages and dirty 8 of them
+	touched := int64(16)
+	b := f.Bytes()
+	var sum byte
+	for i := int64(0); i < touched; i++ {
+		sum += b[i*_PAGE]
+		if i%2 == 0 {
+			b[i*_PAGE+1] = sum
+		}
+	}
+
+	st, err := f.SmapsStats()
+	assert(err == nil, "smaps: %s", err)
+	t.Logf("smaps: %+v", st)
+
+	// fault-around may map in a few more cached pages
+	assert(st.Rss >= touched*_PAGE && st.Rss <= sz, "rss: %d; exp [%d, %d]", st.Rss, touched*_PAGE, sz)
+	assert(st.Pss > 0 && st.Pss <= st.Rss, "pss: %d", st.Pss)
+	assert(st.SharedDirty+st.PrivateDirty >= touched/2*_PAGE, "dirty: %+v", st)
+	assert(st.SharedClean+st.SharedDirty+st.PrivateClean+st.PrivateDirty == st.Rss, "breakdown doesn't add up: %+v", st)
+}
+
+func TestReservation(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 4 * _PAGE
+	fname := tmpName(t)
+	pages := randData(sz)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	r, err := mmap.Reserve(64 << 20)
+	assert(err == nil, "reserve: %s", err)
+	assert(r.Size() == 64<<20, "reserve: exp 64MB, saw %d", r.Size())
+
+	defer r.Release()
+
+	f, err := r.Map(mmap.New(fd), 1<<20, sz, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map file: %s", err)
+	assert(f.Addr() == r.Addr()+1<<20, "file: exp addr %#x, saw %#x", r.Addr()+1<<20, f.Addr())
+	assert(bytes.Equal(f.Bytes(), concat(pages)), "file: content mismatch")
+
+	a, err := r.Map(mmap.NewAnon(), 32<<20, 2*_PAGE, 0, mmap.PROT_RW, mmap.F_COW)
+	assert(err == nil, "map anon: %s", err)
+	assert(a.Addr() == r.Addr()+32<<20, "anon: exp addr %#x, saw %#x", r.Addr()+32<<20, a.Addr())
+	copy(a.Bytes(), "hello")
+
+	// overlapping, unaligned and out of bounds mappings are refused
+	_, err = r.Map(mmap.NewAnon(), 32<<20+_PAGE, _PAGE, 0, mmap.PROT_RW, 0)
+	assert(err != nil, "map overlapping: no error")
+	_, err = r.Map(mmap.NewAnon(), 10, _PAGE, 0, mmap.PROT_RW, 0)
+	assert(err != nil, "map unaligned: no error")
+	_, err = r.Map(mmap.NewAnon(), 64<<20, _PAGE, 0, mmap.PROT_RW, 0)
+	assert(err != nil, "map out of bounds: no error")
+
+	err = r.Release()
+	assert(err != nil, "release with live mappings: no error")
+
+	// the pages of an unmapped mapping go back to the reservation and
+	// can be reused
+	ptr := unsafe.Pointer(&a.Bytes()[0])
+	assert(a.Unmap() == nil, "unmap anon")
+
+	_, err = unix.MmapPtr(-1, 0, ptr, uintptr(_PAGE), unix.PROT_READ, unix.MAP_PRIVATE|unix.MAP_ANON|unix.MAP_FIXED_NOREPLACE)
+	assert(errors.Is(err, unix.EEXIST), "unmapped pages not reserved: %v", err)
+
+	old := a
+	a, err = r.Map(mmap.NewAnon(), 32<<20, _PAGE, 0, mmap.PROT_RW, 0)
+	assert(err == nil, "remap anon: %s", err)
+	assert(a.Bytes()[0] == 0, "remap anon: stale contents")
+
+	// unmapping the old mapping again leaves the new one alone
+	err = old.Unmap()
+	assert(errors.Is(err, os.ErrClosed), "double unmap: exp ErrClosed, saw %v", err)
+	a.Bytes()[0] = 1
+	assert(a.Bytes()[0] == 1, "remap anon: content mismatch")
+
+	assert(a.Unmap() == nil, "unmap anon")
+	assert(f.Unmap() == nil, "unmap file")
+	assert(r.Release() == nil, "release")
+}
+
+func TestFutex(t *testing.T) {
+	assert := newAsserter(t)
+
+	// child: announce readiness at offset 4 and wait for offset 0 to
+	// become non-zero
+	if fname := os.Getenv("MMAP_TEST_FUTEX"); fname != "" {
+		fd, err := os.OpenFile(fname, os.O_RDWR, 0)
+		assert(err == nil, "child: open %s: %s", fname, err)
+
+		defer fd.Close()
+
+		p, err := mmap.New(fd).Map(0, 0, mmap.PROT_RW, 0)
+		assert(err == nil, "child: mmap: %s", err)
+
+		defer p.Unmap()
+
+		b := p.Bytes()
+		atomic.StoreUint32((*uint32)(unsafe.Pointer(&b[4])), 1)
+		for atomic.LoadUint32((*uint32)(unsafe.Pointer(&b[0]))) == 0 {
+			err = p.FutexWait(0, 0)
+			assert(err == nil, "child: futex wait: %s", err)
+		}
+		return
+	}
+
+	fname := tmpName(t)
+	err := createFile(fname, randData(_PAGE))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.OpenFile(fname, os.O_RDWR, 0)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	p, err := mmap.New(fd).Map(0, 0, mmap.PROT_RW, 0)
+	assert(err == nil, "mmap: %s", err)
+
+	defer p.Unmap()
+
+	b := p.Bytes()
+	clear(b)
+
+	val := (*uint32)(unsafe.Pointer(&b[0]))
+	ready := (*uint32)(unsafe.Pointer(&b[4]))
+
+	// a stale expected value doesn't block
+	err = p.FutexWait(0, 1)
+	assert(err == nil, "futex wait: %s", err)
+
+	err = p.FutexWait(2, 0)
+	assert(err != nil, "futex wait misaligned: no error")
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFutex$")
+	cmd.Env = append(os.Environ(), "MMAP_TEST_FUTEX="+fname)
+
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err = cmd.Start()
+	assert(err == nil, "child: %s", err)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	deadline := time.After(10 * time.Second)
+	for atomic.LoadUint32(ready) == 0 {
+		select {
+		case err := <-done:
+			t.Fatalf("futex: child exited before it was ready: %v\n%s", err, out.String())
+		case <-deadline:
+			cmd.Process.Kill()
+			t.Fatalf("futex: child not ready")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	// give the child a chance to block in the kernel
+	time.Sleep(10 * time.Millisecond)
+	atomic.StoreUint32(val, 1)
+
+	var woken int
+	for {
+		n, err := p.FutexWake(0, 1)
+		assert(err == nil, "futex wake: %s", err)
+		woken += n
+
+		select {
+		case err := <-done:
+			assert(err == nil, "child: %s\n%s", err, out.String())
+			t.Logf("futex: woke %d waiters", woken)
+			return
+		case <-deadline:
+			cmd.Process.Kill()
+			t.Fatalf("futex: child not woken")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// TestReaderBlockDev hashes the block device named by $MMAP_TEST_BLKDEV
+// (eg a small loop device set up via losetup(8)).
+func TestReaderBlockDev(t *testing.T) {
+	assert := newAsserter(t)
+
+	dev := os.Getenv("MMAP_TEST_BLKDEV")
+	if len(dev) == 0 {
+		t.Skip("set MMAP_TEST_BLKDEV to a block device to run this test")
+	}
+
+	fd, err := os.Open(dev)
+	if err != nil {
+		t.Skipf("open %s: %s", dev, err)
+	}
+
+	defer fd.Close()
+
+	h := sha256.New()
+	n, err := mmap.Reader(fd, func(b []byte) error {
+		h.Write(b)
+		return nil
+	})
+	assert(err == nil, "reader %s: %s", dev, err)
+	assert(n > 0, "reader %s: zero size", dev)
+
+	// pread based hash of the same device
+	h2 := sha256.New()
+	m, err := io.Copy(h2, io.NewSectionReader(fd, 0, n+1))
+	assert(err == nil, "pread %s: %s", dev, err)
+	assert(m == n, "size mismatch: pread %d, mmap %d", m, n)
+	assert(bytes.Equal(h.Sum(nil), h2.Sum(nil)), "%s: checksum mismatch", dev)
+}
+
+func TestCoreDump(t *testing.T) {
+	assert := newAsserter(t)
+
+	p, err := mmap.NewAnon().Map(4*_PAGE, 0, mmap.PROT_RW, 0)
+	assert(err == nil, "map anon: %s", err)
+
+	defer p.Unmap()
+
+	err = p.ExcludeFromCoreDump()
+	assert(err == nil, "exclude: %s", err)
+
+	err = p.IncludeInCoreDump()
+	assert(err == nil, "include: %s", err)
+}
+
+// TestAnonShared checks that F_COW selects a private anon mapping;
+// the kernel shows shared mappings as "sh" in their VmFlags.
+func TestAnonShared(t *testing.T) {
+	assert := newAsserter(t)
+
+	tests := []struct {
+		flags  mmap.Flag
+		shared bool
+	}{
+		{0, true},
+		{mmap.F_COW, false},
+	}
+
+	for _, tc := range tests {
+		p, err := mmap.NewAnon().Map(_PAGE, 0, mmap.PROT_RW, tc.flags)
+		assert(err == nil, "mmap anon %#x: %s", tc.flags, err)
+
+		fl := vmFlags(t, p.Addr())
+		assert(slices.Contains(fl, "sh") == tc.shared, "anon %#x: exp shared %v, saw %v", tc.flags, tc.shared, fl)
+		p.Unmap()
+	}
+}
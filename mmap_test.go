@@ -14,15 +14,27 @@
 package mmap_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/opencoff/go-mmap"
 )
@@ -150,54 +162,1981 @@ func TestReader(t *testing.T) {
 	fd.Close()
 }
 
+func TestReaderError(t *testing.T) {
+	assert := newAsserter(t)
+
+	fname := tmpName(t)
+
+	var sz int64 = 3*_PAGE + (_PAGE / 3)
+	err := createFile(fname, randData(sz))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open: %s: %s", fname, err)
+
+	defer fd.Close()
+
+	errFp := errors.New("fp failed")
+	errUnmap := errors.New("unmap failed")
+	fail := func(b []byte) error {
+		return errFp
+	}
+
+	n, err := mmap.Reader(fd, fail)
+	assert(errors.Is(err, errFp), "reader: exp fp error, saw %v", err)
+	assert(n == 0, "reader: exp 0 bytes, saw %d", n)
+
+	// the chunk is still unmapped; but the unmap fails
+	mmap.SetUnmapHook(func(p *mmap.Mapping) error {
+		p.Unmap()
+		return errUnmap
+	})
+	defer mmap.SetUnmapHook(nil)
+
+	n, err = mmap.Reader(fd, fail)
+	assert(errors.Is(err, errFp), "reader: exp fp error, saw %v", err)
+	assert(errors.Is(err, errUnmap), "reader: exp unmap error, saw %v", err)
+	assert(n == 0, "reader: exp 0 bytes, saw %d", n)
+
+	n, err = mmap.Reader(fd, func(b []byte) error {
+		return nil
+	})
+	assert(errors.Is(err, errUnmap), "reader: exp unmap error, saw %v", err)
+	assert(!errors.Is(err, errFp), "reader: unexpected fp error: %v", err)
+	assert(n == sz, "reader: exp %d bytes, saw %d", sz, n)
+}
+
+func TestReaderVerify(t *testing.T) {
+	assert := newAsserter(t)
+
+	fname := tmpName(t)
+
+	var sz int64 = 3*_PAGE + (_PAGE / 3)
+
+	orig := randData(sz)
+	osum := cksum(orig)
+
+	err := createFile(fname, orig)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open: %s: %s", fname, err)
+
+	defer fd.Close()
+
+	err = mmap.ReaderVerify(fd, osum, sha256.New())
+	assert(err == nil, "verify: %s: %s", fname, err)
+
+	bad := bytes.Clone(osum)
+	bad[0] ^= 0xff
+
+	var cerr *mmap.ErrChecksumMismatch
+
+	err = mmap.ReaderVerify(fd, bad, sha256.New())
+	assert(errors.As(err, &cerr), "verify: %s: exp checksum mismatch, saw %v", fname, err)
+	assert(bytes.Equal(cerr.Got, osum), "verify: got %x, exp %x", cerr.Got, osum)
+	assert(bytes.Equal(cerr.Want, bad), "verify: want %x, exp %x", cerr.Want, bad)
+}
+
 func TestCOW(t *testing.T) {
 	assert := newAsserter(t)
 
 	fname := tmpName(t)
 
-	var sz int64 = 3*_PAGE + (_PAGE / 3)
+	var sz int64 = 3*_PAGE + (_PAGE / 3)
+
+	orig := randData(sz)
+
+	err := createFile(fname, orig)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.OpenFile(fname, os.O_RDWR, 0600)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	m := mmap.New(fd)
+
+	p, err := m.Map(sz, 0, mmap.PROT_READ|mmap.PROT_WRITE, mmap.F_COW)
+	assert(err == nil, "mmap: %s: %s", fname, err)
+	assert(p != nil, "mmap: %s: nil ptr", fname)
+
+	mapped := p.Bytes()
+	assert(len(mapped) == int(sz), "mmap: len exp %d, saw %d", sz, len(mapped))
+
+	// mutate the contents
+	pages := randData(sz)
+	out := mapped[:]
+	for i := range pages {
+		pg := &pages[i]
+		n := copy(out, pg.buf)
+		out = out[n:]
+	}
+	p.Unmap()
+	fd.Close()
+
+	// now read the file back and see if the contents are same as orig
+	fd, err = os.Open(fname)
+	m = mmap.New(fd)
+	assert(err == nil, "mmap: open %s: %s", fname, err)
+	for i := range orig {
+		pg := &orig[i]
+		p, err := m.Map(int64(len(pg.buf)), pg.off, mmap.PROT_READ, 0)
+		assert(err == nil, "mmap %d at %d: %s", len(pg.buf), pg.off, err)
+		assert(p != nil, "mmap: %s: nil ptr", fname)
+		assert(bytes.Equal(p.Bytes(), pg.buf), "mmap: %d at %d content mismatch", len(pg.buf), pg.off)
+		p.Unmap()
+	}
+	fd.Close()
+}
+
+func TestFlushN(t *testing.T) {
+	assert := newAsserter(t)
+
+	fname := tmpName(t)
+
+	var sz int64 = 2*_PAGE + (_PAGE / 3)
+
+	err := createFile(fname, randData(sz))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.OpenFile(fname, os.O_RDWR, 0600)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	m := mmap.New(fd)
+	p, err := m.Map(sz, 0, mmap.PROT_READ|mmap.PROT_WRITE, 0)
+	assert(err == nil, "mmap: %s: %s", fname, err)
+
+	copy(p.Bytes(), []byte("hello"))
+
+	n, err := p.FlushN()
+	assert(err == nil, "flush: %s: %s", fname, err)
+	assert(n == sz, "flush: exp %d, saw %d", sz, n)
+
+	// ranged flushes report the page aligned window
+	ranges := []struct {
+		off, n, exp int64
+	}{
+		{10, 5, _PAGE},
+		{_PAGE - 1, 2, 2 * _PAGE},
+		{2 * _PAGE, 10, sz - 2*_PAGE},
+		{0, sz, sz},
+	}
+	for _, r := range ranges {
+		n, err = p.FlushRangeN(r.off, r.n)
+		assert(err == nil, "flush %d at %d: %s", r.n, r.off, err)
+		assert(n == r.exp, "flush %d at %d: exp %d, saw %d", r.n, r.off, r.exp, n)
+	}
+
+	p.Unmap()
+}
+
+func TestMapStream(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 3*_PAGE + (_PAGE / 3)
+	pages := randData(sz)
+
+	rd, wr := io.Pipe()
+	go func() {
+		for i := range pages {
+			wr.Write(pages[i].buf)
+		}
+		wr.Close()
+	}()
+
+	p, done, err := mmap.MapStream(rd)
+	assert(err == nil, "mapstream: %s", err)
+
+	mapped := p.Bytes()
+	assert(len(mapped) == int(sz), "mapstream: len exp %d, saw %d", sz, len(mapped))
+	for i := range pages {
+		pg := &pages[i]
+		n := len(pg.buf)
+		mm := mapped[pg.off:]
+
+		assert(bytes.Equal(pg.buf, mm[:n]), "mapstream at %d: content mismatch", pg.off)
+	}
+
+	err = done()
+	assert(err == nil, "mapstream: cleanup: %s", err)
+}
+
+type testObserver struct {
+	maps, unmaps, flushes, locks []int64
+}
+
+func (o *testObserver) OnMap(sz int64, _ time.Duration)   { o.maps = append(o.maps, sz) }
+func (o *testObserver) OnUnmap(sz int64, _ time.Duration) { o.unmaps = append(o.unmaps, sz) }
+func (o *testObserver) OnFlush(sz int64, _ time.Duration) { o.flushes = append(o.flushes, sz) }
+func (o *testObserver) OnLock(sz int64, _ time.Duration)  { o.locks = append(o.locks, sz) }
+
+func TestObserver(t *testing.T) {
+	assert := newAsserter(t)
+
+	fname := tmpName(t)
+
+	var sz int64 = 2*_PAGE + (_PAGE / 3)
+
+	err := createFile(fname, randData(sz))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.OpenFile(fname, os.O_RDWR, 0600)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	var o testObserver
+
+	m := mmap.New(fd)
+	m.SetObserver(&o)
+
+	p, err := m.Map(0, 0, mmap.PROT_READ|mmap.PROT_WRITE, 0)
+	assert(err == nil, "mmap: %s: %s", fname, err)
+
+	err = p.Flush()
+	assert(err == nil, "flush: %s: %s", fname, err)
+
+	// mlock may be disallowed by resource limits; only the successful
+	// ones are observed.
+	var locks []int64
+	if err = p.Lock(); err == nil {
+		locks = append(locks, sz)
+		p.Unlock()
+	}
+
+	err = p.Unmap()
+	assert(err == nil, "unmap: %s: %s", fname, err)
+
+	// failed operations must not be reported
+	_, err = m.Map(2*sz, 0, mmap.PROT_READ, 0)
+	assert(err != nil, "mmap: %s: out of bounds map succeeded", fname)
+
+	exp := []int64{sz}
+	assert(slices.Equal(o.maps, exp), "observer: map: exp %v, saw %v", exp, o.maps)
+	assert(slices.Equal(o.flushes, exp), "observer: flush: exp %v, saw %v", exp, o.flushes)
+	assert(slices.Equal(o.unmaps, exp), "observer: unmap: exp %v, saw %v", exp, o.unmaps)
+	assert(slices.Equal(o.locks, locks), "observer: lock: exp %v, saw %v", locks, o.locks)
+}
+
+func TestCopyInto(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 2*_PAGE + (_PAGE / 3)
+	pages := randData(sz)
+	fname := tmpName(t)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	m := mmap.New(fd)
+	p, err := m.Map(sz, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "mmap: %s: %s", fname, err)
+
+	defer p.Unmap()
+
+	// exact size
+	pg := &pages[1]
+	buf := make([]byte, len(pg.buf))
+	n, err := p.CopyInto(buf, pg.off)
+	assert(err == nil, "copy at %d: %s", pg.off, err)
+	assert(n == len(pg.buf), "copy at %d: exp %d, saw %d", pg.off, len(pg.buf), n)
+	assert(bytes.Equal(buf, pg.buf), "copy at %d: content mismatch", pg.off)
+
+	// too small a buffer
+	buf = make([]byte, 100)
+	n, err = p.CopyInto(buf, pg.off)
+	assert(err == nil, "copy at %d: %s", pg.off, err)
+	assert(n == len(buf), "copy at %d: exp %d, saw %d", pg.off, len(buf), n)
+	assert(bytes.Equal(buf, pg.buf[:n]), "copy at %d: content mismatch", pg.off)
+
+	// short copy at the end of the mapping
+	pg = &pages[len(pages)-1]
+	buf = make([]byte, _PAGE)
+	n, err = p.CopyInto(buf, pg.off)
+	assert(err == nil, "copy at %d: %s", pg.off, err)
+	assert(n == len(pg.buf), "copy at %d: exp %d, saw %d", pg.off, len(pg.buf), n)
+	assert(bytes.Equal(buf[:n], pg.buf), "copy at %d: content mismatch", pg.off)
+
+	_, err = p.CopyInto(buf, sz+1)
+	assert(err != nil, "copy at %d: out of bounds copy succeeded", sz+1)
+}
+
+func TestHead(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 8*_PAGE + (_PAGE / 3)
+	pages := randData(sz)
+	fname := tmpName(t)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	var n int64 = 100
+	p, err := mmap.Head(fd, n)
+	assert(err == nil, "head %s: %s", fname, err)
+	assert(len(p.Bytes()) == int(n), "head: len exp %d, saw %d", n, len(p.Bytes()))
+	assert(bytes.Equal(p.Bytes(), pages[0].buf[:n]), "head: content mismatch")
+	p.Unmap()
+
+	// small file must be mapped in its entirety
+	n = 2 * sz
+	p, err = mmap.Head(fd, n)
+	assert(err == nil, "head %s: %s", fname, err)
+	assert(len(p.Bytes()) == int(sz), "head: len exp %d, saw %d", sz, len(p.Bytes()))
+	assert(bytes.Equal(p.Bytes(), concat(pages)), "head: content mismatch")
+	p.Unmap()
+
+	for _, n := range []int64{0, -1} {
+		_, err = mmap.Head(fd, n)
+		assert(err != nil, "head %d: no error", n)
+	}
+}
+
+func TestConcurrentMap(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 32 * _PAGE
+	pages := randData(sz)
+	fname := tmpName(t)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	m := mmap.New(fd)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(pages))
+	for i := range pages {
+		wg.Add(1)
+		go func(pg *data) {
+			defer wg.Done()
+			for j := 0; j < 16; j++ {
+				p, err := m.Map(int64(len(pg.buf)), pg.off, mmap.PROT_READ, 0)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(p.Bytes(), pg.buf) {
+					errs <- fmt.Errorf("mmap at %d: content mismatch", pg.off)
+				}
+				if err = p.Unmap(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(&pages[i])
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert(err == nil, "concurrent map: %s", err)
+	}
+}
+
+func TestProtRW(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 2*_PAGE + (_PAGE / 3)
+	pages := randData(sz)
+	fname := tmpName(t)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.OpenFile(fname, os.O_RDWR, 0600)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	m := mmap.New(fd)
+	p, err := m.Map(sz, 0, mmap.PROT_RW, 0)
+	assert(err == nil, "mmap: %s: %s", fname, err)
+
+	b := p.Bytes()
+	assert(bytes.Equal(b[:len(pages[0].buf)], pages[0].buf), "mmap: content mismatch")
+
+	msg := []byte("hello world")
+	copy(b, msg)
+	p.Unmap()
+
+	buf := make([]byte, len(msg))
+	_, err = fd.ReadAt(buf, 0)
+	assert(err == nil, "read %s: %s", fname, err)
+	assert(bytes.Equal(buf, msg), "mmap: write mismatch: exp %q, saw %q", msg, buf)
+}
+
+func TestExecMappingAllowed(t *testing.T) {
+	// the result depends on the environment
+	ok := mmap.ExecMappingAllowed()
+	t.Logf("exec mappings allowed: %v", ok)
+}
+
+func TestOpen(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 3*_PAGE + (_PAGE / 3)
+	pages := randData(sz)
+	fname := tmpName(t)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	f, err := mmap.Open(fname, mmap.PROT_READ)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer f.Close()
+
+	assert(bytes.Equal(f.Bytes(), concat(pages)), "open %s: content mismatch", fname)
+}
+
+func TestDecode(t *testing.T) {
+	assert := newAsserter(t)
+
+	type rec struct {
+		Id    uint32
+		Flags uint16
+		Kind  uint8
+		Pad   uint8
+		Off   int64
+	}
+
+	var buf bytes.Buffer
+	recs := make([]rec, 500)
+	for i := range recs {
+		r := &recs[i]
+		r.Id = randU32()
+		r.Flags = uint16(i)
+		r.Kind = uint8(i % 7)
+		r.Off = -int64(i) * 4096
+		binary.Write(&buf, binary.BigEndian, r)
+	}
+
+	fname := tmpName(t)
+	err := os.WriteFile(fname, buf.Bytes(), 0600)
+	assert(err == nil, "write %s: %s", fname, err)
+
+	f, err := mmap.Open(fname, mmap.PROT_READ)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer f.Close()
+
+	var off int64
+	for i := range recs {
+		var r rec
+
+		next, err := f.Decode(off, binary.BigEndian, &r)
+		assert(err == nil, "decode %d at %d: %s", i, off, err)
+		assert(next == off+int64(binary.Size(r)), "decode %d: bad next offset %d", i, next)
+		assert(r == recs[i], "decode %d: exp %+v, saw %+v", i, recs[i], r)
+		off = next
+	}
+
+	var r rec
+	_, err = f.Decode(off, binary.BigEndian, &r)
+	assert(err != nil, "decode at %d: out of bounds decode succeeded", off)
+}
+
+func TestMapTruncateRace(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 4 * _PAGE
+	fname := tmpName(t)
+	err := createFile(fname, randData(sz))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.OpenFile(fname, os.O_RDWR, 0600)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			fd.Truncate(_PAGE)
+			fd.Truncate(sz)
+		}
+	}()
+
+	// we never touch the mapped memory: it may be truncated after Map
+	// returns. All we care about is that Map fails cleanly.
+	var races int
+	m := mmap.New(fd)
+	for i := 0; i < 2000; i++ {
+		p, err := m.Map(sz, 0, mmap.PROT_READ, 0)
+		switch {
+		case err == nil:
+			p.Unmap()
+		case errors.Is(err, mmap.ErrRaceTruncated):
+			races++
+		default:
+			assert(strings.Contains(err.Error(), "out of bounds"), "mmap: %s", err)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+	t.Logf("truncate races detected: %d", races)
+}
+
+func TestEnforceWX(t *testing.T) {
+	assert := newAsserter(t)
+
+	if !mmap.ExecMappingAllowed() {
+		t.Skip("writable+executable mappings disallowed by the system")
+	}
+
+	const rwx = mmap.PROT_READ | mmap.PROT_WRITE | mmap.PROT_EXEC
+
+	m := mmap.NewAnon()
+
+	mmap.EnforceWXProtection(true)
+	defer mmap.EnforceWXProtection(false)
+
+	_, err := m.Map(_PAGE, 0, rwx, 0)
+	assert(errors.Is(err, mmap.ErrWXViolation), "mmap rwx: exp W^X violation, saw %v", err)
+
+	p, err := m.Map(_PAGE, 0, mmap.PROT_RX, 0)
+	assert(err == nil, "mmap rx: %s", err)
+	p.Unmap()
+
+	mmap.EnforceWXProtection(false)
+	p, err = m.Map(_PAGE, 0, rwx, 0)
+	assert(err == nil, "mmap rwx: %s", err)
+	p.Unmap()
+}
+
+func TestChunkedReader(t *testing.T) {
+	assert := newAsserter(t)
+
+	lines := randLines(2000)
+	fname := tmpName(t)
+	err := os.WriteFile(fname, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	assert(err == nil, "write %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	// one page windows guarantee lines straddling windows
+	rd := mmap.NewChunkedReader(fd, _PAGE)
+	defer rd.Close()
+
+	var i int
+	sc := bufio.NewScanner(rd)
+	for sc.Scan() {
+		assert(i < len(lines), "scan: too many lines")
+		assert(sc.Text() == lines[i], "line %d: exp %q, saw %q", i, lines[i], sc.Text())
+		i++
+	}
+	assert(sc.Err() == nil, "scan: %s", sc.Err())
+	assert(i == len(lines), "scan: exp %d lines, saw %d", len(lines), i)
+}
+
+func TestForEachLine(t *testing.T) {
+	assert := newAsserter(t)
+
+	lines := randLines(2000)
+
+	// the last line has no trailing newline; an empty last line would
+	// look like one that does.
+	lines[len(lines)-1] += "x"
+	fname := tmpName(t)
+	err := os.WriteFile(fname, []byte(strings.Join(lines, "\n")), 0600)
+	assert(err == nil, "write %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	for _, chunk := range []int64{_PAGE, 2 * _PAGE, mmap.MaxMappingSize} {
+		var i int
+		err = mmap.ForEachLineChunk(fd, chunk, func(b []byte) error {
+			assert(i < len(lines), "chunk %d: too many lines", chunk)
+			assert(string(b) == lines[i], "chunk %d: line %d: exp %q, saw %q", chunk, i, lines[i], b)
+			i++
+			return nil
+		})
+		assert(err == nil, "chunk %d: %s", chunk, err)
+		assert(i == len(lines), "chunk %d: exp %d lines, saw %d", chunk, len(lines), i)
+	}
+
+	var n int
+	err = mmap.ForEachLine(fd, func(b []byte) error {
+		n++
+		return nil
+	})
+	assert(err == nil, "foreach: %s", err)
+	assert(n == len(lines), "foreach: exp %d lines, saw %d", len(lines), n)
+}
+
+func TestForEachVarintRecord(t *testing.T) {
+	assert := newAsserter(t)
+
+	// records of assorted sizes - including ones larger than a page
+	// and an empty one
+	var recs [][]byte
+	var buf []byte
+	for _, n := range []int64{10, 0, 200, _PAGE + 33, 1, 3 * _PAGE, 127, 128, 5000, 17} {
+		r := concat(randData(n))
+		recs = append(recs, r)
+		buf = binary.AppendUvarint(buf, uint64(len(r)))
+		buf = append(buf, r...)
+	}
+
+	fname := tmpName(t)
+	err := os.WriteFile(fname, buf, 0600)
+	assert(err == nil, "write %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	for _, chunk := range []int64{_PAGE, 2 * _PAGE, mmap.MaxMappingSize} {
+		var i int
+		err = mmap.ForEachVarintRecordChunk(fd, chunk, func(b []byte) error {
+			assert(i < len(recs), "chunk %d: too many records", chunk)
+			assert(bytes.Equal(b, recs[i]), "chunk %d: record %d: exp %d bytes, saw %d", chunk, i, len(recs[i]), len(b))
+			i++
+			return nil
+		})
+		assert(err == nil, "chunk %d: %s", chunk, err)
+		assert(i == len(recs), "chunk %d: exp %d records, saw %d", chunk, len(recs), i)
+	}
+
+	// a truncated last record
+	err = os.WriteFile(fname, buf[:len(buf)-3], 0600)
+	assert(err == nil, "write %s: %s", fname, err)
+
+	err = mmap.ForEachVarintRecordChunk(fd, _PAGE, func(b []byte) error { return nil })
+	assert(errors.Is(err, io.ErrUnexpectedEOF), "truncated: exp io.ErrUnexpectedEOF, saw %v", err)
+
+	// a length that can't be right
+	bad := binary.AppendUvarint(nil, 1<<40)
+	err = os.WriteFile(fname, append(bad, buf...), 0600)
+	assert(err == nil, "write %s: %s", fname, err)
+
+	err = mmap.ForEachVarintRecord(fd, func(b []byte) error { return nil })
+	assert(err != nil && strings.Contains(err.Error(), "exceeds"), "corrupt: saw %v", err)
+}
+
+func TestSnapshot(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 5*_PAGE + (_PAGE / 3)
+	pages := randData(sz)
+	fname := tmpName(t)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	f, err := mmap.Open(fname, mmap.PROT_RW)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer f.Close()
+
+	// mutate the source via its mapping
+	copy(f.Bytes()[_PAGE:], []byte("mutated"))
+	want := sha256.Sum256(f.Bytes())
+
+	snap := fname + ".snap"
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	err = mmap.New(fd).SnapshotTo(snap)
+	assert(err == nil, "snapshot %s: %s", snap, err)
+
+	b, err := os.ReadFile(snap)
+	assert(err == nil, "read %s: %s", snap, err)
+
+	got := sha256.Sum256(b)
+	assert(got == want, "snapshot: digest mismatch: exp %x, saw %x", want, got)
+}
+
+func TestFlushRange(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 8 * _PAGE
+	fname := tmpName(t)
+	err := createFile(fname, randData(sz))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.OpenFile(fname, os.O_RDWR, 0600)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	var o testObserver
+
+	m := mmap.New(fd)
+	m.SetObserver(&o)
+
+	p, err := m.Map(0, 0, mmap.PROT_RW, 0)
+	assert(err == nil, "mmap: %s: %s", fname, err)
+
+	defer p.Unmap()
+
+	// write a record that straddles pages 2 and 3
+	msg := []byte("a record straddling a page boundary")
+	off := 3*_PAGE - 10
+	copy(p.Bytes()[off:], msg)
+
+	err = p.FlushRange(off, int64(len(msg)))
+	assert(err == nil, "flush %d at %d: %s", len(msg), off, err)
+
+	// only the affected pages must be flushed
+	exp := []int64{2 * _PAGE}
+	assert(slices.Equal(o.flushes, exp), "flush: exp %v, saw %v", exp, o.flushes)
+
+	buf := make([]byte, len(msg))
+	_, err = fd.ReadAt(buf, off)
+	assert(err == nil, "read %s: %s", fname, err)
+	assert(bytes.Equal(buf, msg), "flush: exp %q, saw %q", msg, buf)
+
+	err = p.FlushRange(sz-10, 11)
+	assert(err != nil, "flush: out of bounds flush succeeded")
+}
+
+func TestDupFd(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 4 * _PAGE
+	fname := tmpName(t)
+	err := createFile(fname, randData(sz))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.OpenFile(fname, os.O_RDWR, 0600)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	m := mmap.New(fd)
+	p, err := m.Map(0, 0, mmap.PROT_RW, 0)
+	assert(err == nil, "map: %s", err)
+
+	err = m.DupFd()
+	assert(err == nil, "dup: %s", err)
+
+	// the mapping must outlive the caller's fd; on Windows, Unmap
+	// flushes via the (duplicated) file handle
+	assert(fd.Close() == nil, "close %s", fname)
+
+	msg := []byte("hello, world")
+	copy(p.Bytes()[_PAGE:], msg)
+
+	err = p.Flush()
+	assert(err == nil, "flush: %s", err)
+
+	err = p.Unmap()
+	assert(err == nil, "unmap: %s", err)
+
+	err = m.Close()
+	assert(err == nil, "close: %s", err)
+
+	b, err := os.ReadFile(fname)
+	assert(err == nil, "read %s: %s", fname, err)
+	assert(bytes.Equal(b[_PAGE:_PAGE+int64(len(msg))], msg), "dup: content mismatch")
+}
+
+func TestPointerAt(t *testing.T) {
+	assert := newAsserter(t)
+
+	sz := 2*_PAGE + 17
+	p, err := mmap.NewAnon().Map(sz, 0, mmap.PROT_RW, 0)
+	assert(err == nil, "map anon: %s", err)
+
+	defer p.Unmap()
+
+	for _, off := range []int64{0, 1, _PAGE, sz - 1} {
+		ptr, err := p.PointerAt(off)
+		assert(err == nil, "pointer at %d: %s", off, err)
+		assert(uintptr(ptr) == p.Addr()+uintptr(off), "pointer at %d: exp %#x, saw %p",
+			off, p.Addr()+uintptr(off), ptr)
+
+		*(*byte)(ptr) = 0xa5
+		assert(p.Bytes()[off] == 0xa5, "pointer at %d: write not visible", off)
+	}
+
+	for _, off := range []int64{-1, sz} {
+		_, err := p.PointerAt(off)
+		assert(err != nil, "pointer at %d: expected error", off)
+	}
+}
+
+func TestFileSize(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 2*_PAGE + 100
+	fname := tmpName(t)
+	err := createFile(fname, randData(sz))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.OpenFile(fname, os.O_RDWR|os.O_APPEND, 0600)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	m := mmap.New(fd)
+	p, err := m.Map(0, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map: %s", err)
+
+	defer p.Unmap()
+
+	fsz, err := m.FileSize()
+	assert(err == nil, "file size: %s", err)
+	assert(fsz == sz, "file size: exp %d, saw %d", sz, fsz)
+
+	_, err = fd.Write(make([]byte, 3*_PAGE))
+	assert(err == nil, "append: %s", err)
+
+	fsz, err = m.FileSize()
+	assert(err == nil, "file size: %s", err)
+	assert(fsz == sz+3*_PAGE, "file size: exp %d, saw %d", sz+3*_PAGE, fsz)
+	assert(p.MappedSize() == sz, "mapped size: exp %d, saw %d", sz, p.MappedSize())
+
+	_, err = mmap.NewAnon().FileSize()
+	assert(err != nil, "anon file size: expected error")
+}
+
+func TestMapHint(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 4 * _PAGE
+	fname := tmpName(t)
+	pages := randData(sz)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	// use a free address range as the hint
+	a, err := mmap.NewAnon().Map(sz, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map anon: %s", err)
+
+	hint := unsafe.Pointer(&a.Bytes()[0])
+	assert(a.Unmap() == nil, "unmap failed")
+
+	p, err := mmap.New(fd).MapHint(hint, sz, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map hint: %s", err)
+	assert(bytes.Equal(p.Bytes(), concat(pages)), "map hint: content mismatch")
+	t.Logf("hint %p, mapped at %#x", hint, p.Addr())
+
+	err = p.Unmap()
+	assert(err == nil, "unmap: %s", err)
+
+	p, err = mmap.NewAnon().MapHint(hint, sz, 0, mmap.PROT_RW, 0)
+	assert(err == nil, "map anon hint: %s", err)
+
+	p.Bytes()[sz-1] = 0x5a
+	err = p.Unmap()
+	assert(err == nil, "unmap: %s", err)
+}
+
+func TestSlowFlush(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 8 * _PAGE
+	fname := tmpName(t)
+	err := createFile(fname, randData(sz))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.OpenFile(fname, os.O_RDWR, 0600)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	var calls int
+	var dur time.Duration
+	var fsz int64
+
+	m := mmap.New(fd)
+	m.SetSlowFlushThreshold(time.Nanosecond, func(d time.Duration, sz int64) {
+		calls++
+		dur, fsz = d, sz
+	})
+
+	p, err := m.Map(0, 0, mmap.PROT_RW, 0)
+	assert(err == nil, "map: %s", err)
+
+	defer p.Unmap()
+
+	copy(p.Bytes(), "hello, world")
+	err = p.Flush()
+	assert(err == nil, "flush: %s", err)
+	assert(calls == 1, "slow flush: exp 1 call, saw %d", calls)
+	assert(dur > 0, "slow flush: zero duration")
+	assert(fsz == sz, "slow flush: exp size %d, saw %d", sz, fsz)
+
+	// a large threshold must not trigger the callback
+	m.SetSlowFlushThreshold(time.Hour, func(d time.Duration, sz int64) {
+		calls++
+	})
+	err = p.Flush()
+	assert(err == nil, "flush: %s", err)
+	assert(calls == 1, "slow flush: exp 1 call, saw %d", calls)
+}
+
+func TestStatCache(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 32 * _PAGE
+	fname := tmpName(t)
+	pages := randData(sz)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.OpenFile(fname, os.O_RDWR|os.O_APPEND, 0600)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	// map every page individually
+	m := mmap.New(fd)
+	m.SetStatCache(true)
+	for i := range pages {
+		pg := &pages[i]
+		p, err := m.Map(_PAGE, pg.off, mmap.PROT_READ, 0)
+		assert(err == nil, "map page %d: %s", i, err)
+		assert(bytes.Equal(p.Bytes(), pg.buf), "page %d: content mismatch", i)
+		assert(p.Unmap() == nil, "unmap page %d", i)
+	}
+
+	// grow the file; the cached size hides the new page until refreshed
+	more := randData(_PAGE)
+	_, err = fd.Write(more[0].buf)
+	assert(err == nil, "append: %s", err)
+
+	_, err = m.Map(_PAGE, sz, mmap.PROT_READ, 0)
+	assert(err != nil, "map past cached size: expected error")
+
+	err = m.RefreshStat()
+	assert(err == nil, "refresh: %s", err)
+
+	p, err := m.Map(_PAGE, sz, mmap.PROT_READ, 0)
+	assert(err == nil, "map new page: %s", err)
+	assert(bytes.Equal(p.Bytes(), more[0].buf), "new page: content mismatch")
+	assert(p.Unmap() == nil, "unmap new page")
+
+	// without the cache, Map always sees the current size
+	_, err = fd.Write(more[0].buf)
+	assert(err == nil, "append: %s", err)
+
+	m = mmap.New(fd)
+	p, err = m.Map(_PAGE, sz, mmap.PROT_READ, 0)
+	assert(err == nil, "map: %s", err)
+	assert(p.Unmap() == nil, "unmap")
+
+	_, err = fd.Write(more[0].buf)
+	assert(err == nil, "append: %s", err)
+
+	p, err = m.Map(_PAGE, sz+2*_PAGE, mmap.PROT_READ, 0)
+	assert(err == nil, "map uncached: %s", err)
+	assert(bytes.Equal(p.Bytes(), more[0].buf), "uncached: content mismatch")
+	assert(p.Unmap() == nil, "unmap")
+}
+
+func TestAdaptiveAdvice(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 32 * _PAGE
+	fname := tmpName(t)
+	err := createFile(fname, randData(sz))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	var advs []mmap.Advice
+	mmap.SetAdviseHook(func(p *mmap.Mapping, a mmap.Advice) error {
+		advs = append(advs, a)
+		return nil
+	})
+	defer mmap.SetAdviseHook(nil)
+
+	m := mmap.New(fd)
+	m.SetAdaptiveAdvice(true)
+
+	mapAt := func(off int64) {
+		p, err := m.Map(_PAGE, off, mmap.PROT_READ, 0)
+		assert(err == nil, "map at %d: %s", off, err)
+		assert(p.Unmap() == nil, "unmap at %d", off)
+	}
+
+	// the first few sequential mappings don't have enough history
+	for i := int64(0); i < 8; i++ {
+		mapAt(i * _PAGE)
+	}
+	assert(len(advs) == 5, "sequential: exp 5 advice, saw %d", len(advs))
+	for i, a := range advs {
+		assert(a == mmap.AdviseSequential, "sequential: advice %d is %d", i, a)
+	}
+
+	// scattered mappings switch the advice after a run
+	advs = advs[:0]
+	for _, pg := range []int64{20, 3, 27, 11, 30, 1} {
+		mapAt(pg * _PAGE)
+	}
+	assert(len(advs) == 6, "random: exp 6 advice, saw %d", len(advs))
+	for i, a := range advs[:3] {
+		assert(a == mmap.AdviseSequential, "random: advice %d is %d", i, a)
+	}
+	for i, a := range advs[3:] {
+		assert(a == mmap.AdviseRandom, "random: advice %d is %d", i+3, a)
+	}
+}
+
+func TestErrUnsupported(t *testing.T) {
+	assert := newAsserter(t)
+
+	fname := tmpName(t)
+	err := createFile(fname, randData(_PAGE))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	// growable file mappings aren't supported anywhere
+	_, err = mmap.New(fd).Map(0, 0, mmap.PROT_READ, mmap.F_GROWSDOWN)
+	assert(errors.Is(err, mmap.ErrUnsupported), "growsdown: exp ErrUnsupported, saw %v", err)
+
+	p, err := mmap.New(fd).Map(0, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map: %s", err)
+
+	defer p.Unmap()
+
+	switch runtime.GOOS {
+	case "windows":
+		_, err = p.Resident()
+		assert(errors.Is(err, mmap.ErrUnsupported), "resident: exp ErrUnsupported, saw %v", err)
+
+		_, err = mmap.New(fd).Map(0, 0, mmap.PROT_READ, mmap.F_HUGETLB)
+		assert(errors.Is(err, mmap.ErrUnsupported), "hugetlb: exp ErrUnsupported, saw %v", err)
+
+	case "linux":
+		_, err = p.Resident()
+		assert(err == nil, "resident: %s", err)
+
+	default:
+		err = p.ExcludeFromCoreDump()
+		assert(errors.Is(err, mmap.ErrUnsupported), "core dump: exp ErrUnsupported, saw %v", err)
+	}
+}
+
+func TestLoadPrivate(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 5*_PAGE + 11
+	fname := tmpName(t)
+	pages := randData(sz)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.OpenFile(fname, os.O_RDWR, 0600)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	p, err := mmap.LoadPrivate(fd)
+	assert(err == nil, "load: %s", err)
+	assert(bytes.Equal(p.Bytes(), concat(pages)), "load: content mismatch")
+
+	// neither side sees the other's changes
+	b := p.Bytes()
+	for i := range b {
+		b[i] ^= 0xff
+	}
+	_, err = fd.WriteAt([]byte("hello, world"), 0)
+	assert(err == nil, "write: %s", err)
+	assert(b[0] == pages[0].buf[0]^0xff, "load: file change visible in copy")
+
+	err = p.Unmap()
+	assert(err == nil, "unmap: %s", err)
+
+	want := concat(pages)
+	copy(want, "hello, world")
+	got, err := os.ReadFile(fname)
+	assert(err == nil, "read %s: %s", fname, err)
+	assert(bytes.Equal(got, want), "load: private changes written back")
+}
+
+func TestReaderPipelined(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 37*_PAGE + 123
+	fname := tmpName(t)
+	pages := randData(sz)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	h := sha256.New()
+	n, err := mmap.Reader(fd, func(b []byte) error {
+		h.Write(b)
+		return nil
+	})
+	assert(err == nil, "reader: %s", err)
+	want := h.Sum(nil)
+
+	var calls int
+	h.Reset()
+	n2, err := mmap.ReaderPipelined(fd, 4*_PAGE, func(b []byte) error {
+		calls++
+		h.Write(b)
+		return nil
+	})
+	assert(err == nil, "pipelined: %s", err)
+	assert(n2 == n, "pipelined: exp %d bytes, saw %d", n, n2)
+	assert(calls == 10, "pipelined: exp 10 chunks, saw %d", calls)
+	assert(bytes.Equal(h.Sum(nil), want), "pipelined: checksum mismatch")
+
+	errStop := errors.New("stop")
+	calls = 0
+	n2, err = mmap.ReaderPipelined(fd, 4*_PAGE, func(b []byte) error {
+		if calls++; calls == 3 {
+			return errStop
+		}
+		return nil
+	})
+	assert(errors.Is(err, errStop), "pipelined: exp errStop, saw %v", err)
+	assert(n2 == 8*_PAGE, "pipelined: exp %d bytes, saw %d", 8*_PAGE, n2)
+
+	// unmap failures are reported
+	errUnmap := errors.New("unmap")
+	mmap.SetUnmapHook(func(p *mmap.Mapping) error {
+		p.Unmap()
+		return errUnmap
+	})
+	defer mmap.SetUnmapHook(nil)
+
+	_, err = mmap.ReaderPipelined(fd, 4*_PAGE, func(b []byte) error {
+		return nil
+	})
+	assert(errors.Is(err, errUnmap), "pipelined: exp unmap error, saw %v", err)
+}
+
+func TestReadFrom(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 4 * _PAGE
+	fname := tmpName(t)
+	err := createFile(fname, randData(sz))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	f, err := mmap.Open(fname, mmap.PROT_RW)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer f.Close()
+
+	// short source: fills a prefix of the mapping
+	src := randData(2*_PAGE + 99)
+	n, err := f.ReadFrom(bytes.NewReader(concat(src)))
+	assert(err == nil, "read from: %s", err)
+	assert(n == 2*_PAGE+99, "read from: exp %d bytes, saw %d", 2*_PAGE+99, n)
+	assert(bytes.Equal(f.Bytes()[:n], concat(src)), "read from: content mismatch")
+
+	// long source: stops when the mapping is full
+	_, err = f.Seek(0, io.SeekStart)
+	assert(err == nil, "seek: %s", err)
+
+	src = randData(sz + _PAGE)
+	r := bytes.NewReader(concat(src))
+	n, err = f.ReadFrom(r)
+	assert(err == nil, "read from: %s", err)
+	assert(n == sz, "read from: exp %d bytes, saw %d", sz, n)
+	assert(r.Len() == int(_PAGE), "read from: exp %d unread bytes, saw %d", _PAGE, r.Len())
+	assert(bytes.Equal(f.Bytes(), concat(src)[:sz]), "read from: content mismatch")
+
+	// io.Copy via a writer: the cursor carries across calls
+	_, err = f.Seek(0, io.SeekStart)
+	assert(err == nil, "seek: %s", err)
+
+	src = randData(sz)
+	n, err = io.Copy(f, io.MultiReader(bytes.NewReader(concat(src)[:_PAGE]), bytes.NewReader(concat(src)[_PAGE:])))
+	assert(err == nil, "copy: %s", err)
+	assert(n == sz, "copy: exp %d bytes, saw %d", sz, n)
+	assert(bytes.Equal(f.Bytes(), concat(src)), "copy: content mismatch")
+
+	// a full mapping takes no more
+	_, err = f.Write([]byte("x"))
+	assert(errors.Is(err, io.ErrShortWrite), "write when full: exp ErrShortWrite, saw %v", err)
+
+	_, err = f.Seek(1, io.SeekEnd)
+	assert(err != nil, "seek past end: no error")
+
+	ro, err := mmap.Open(fname, mmap.PROT_READ)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer ro.Close()
+
+	_, err = ro.ReadFrom(bytes.NewReader(concat(src)))
+	assert(errors.Is(err, mmap.ErrReadOnly), "read-only: exp ErrReadOnly, saw %v", err)
+	_, err = ro.Write([]byte("x"))
+	assert(errors.Is(err, mmap.ErrReadOnly), "read-only write: exp ErrReadOnly, saw %v", err)
+}
+
+func TestAsFile(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 3*_PAGE + 17
+	fname := tmpName(t)
+	pages := randData(sz)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	p, err := mmap.New(fd).Map(sz, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map: %s", err)
+
+	defer p.Unmap()
+
+	mod := time.Now()
+	f := p.AsFile(fname, mod)
+
+	fi, err := f.Stat()
+	assert(err == nil, "stat: %s", err)
+	assert(fi.Size() == sz, "stat: exp size %d, saw %d", sz, fi.Size())
+	assert(fi.Name() == filepath.Base(fname), "stat: name %q", fi.Name())
+	assert(fi.ModTime().Equal(mod), "stat: modtime %s", fi.ModTime())
+	assert(fi.Mode().IsRegular(), "stat: mode %s", fi.Mode())
+
+	got, err := io.ReadAll(f)
+	assert(err == nil, "read: %s", err)
+	assert(bytes.Equal(got, concat(pages)), "read: content mismatch")
+
+	// and the seekable bits
+	rs, ok := f.(io.ReadSeeker)
+	assert(ok, "not a seeker")
+	_, err = rs.Seek(_PAGE, io.SeekStart)
+	assert(err == nil, "seek: %s", err)
+	got, err = io.ReadAll(rs)
+	assert(err == nil, "read after seek: %s", err)
+	assert(bytes.Equal(got, concat(pages)[_PAGE:]), "read after seek: content mismatch")
+
+	assert(f.Close() == nil, "close")
+	_, err = f.Read(got)
+	assert(errors.Is(err, fs.ErrClosed), "read after close: %v", err)
+}
+
+func TestAlignedBuffer(t *testing.T) {
+	assert := newAsserter(t)
+
+	for _, sz := range []int{1, 4095, 3*int(_PAGE) + 5, 1 << 20} {
+		b, free, err := mmap.AlignedBuffer(sz)
+		assert(err == nil, "aligned %d: %s", sz, err)
+		assert(len(b) == sz, "aligned %d: saw %d bytes", sz, len(b))
+
+		addr := uintptr(unsafe.Pointer(&b[0]))
+		assert(addr%uintptr(_PAGE) == 0, "aligned %d: addr %#x not page aligned", sz, addr)
+
+		b[0], b[sz-1] = 1, 2
+		free()
+		free()
+	}
+
+	_, _, err := mmap.AlignedBuffer(0)
+	assert(err != nil, "aligned 0: no error")
+}
+
+func TestAtomicWrite(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 2*_PAGE + 100
+	fname := tmpName(t)
+	err := os.WriteFile(fname, []byte("old contents"), 0640)
+	assert(err == nil, "write %s: %s", fname, err)
+
+	st, err := os.Stat(fname)
+	assert(err == nil, "stat %s: %s", fname, err)
+
+	want := concat(randData(sz))
+	err = mmap.AtomicWrite(fname, sz, func(b []byte) error {
+		copy(b, want)
+		return nil
+	})
+	assert(err == nil, "atomic write: %s", err)
+
+	got, err := os.ReadFile(fname)
+	assert(err == nil, "read %s: %s", fname, err)
+	assert(bytes.Equal(got, want), "atomic write: content mismatch")
+
+	nst, err := os.Stat(fname)
+	assert(err == nil, "stat %s: %s", fname, err)
+	assert(nst.Mode() == st.Mode(), "atomic write: exp mode %s, saw %s", st.Mode(), nst.Mode())
+
+	_, err = os.Stat(fname + ".tmp")
+	assert(os.IsNotExist(err), "atomic write: temp file left behind")
+
+	// a failing fn leaves the file untouched
+	errFail := errors.New("fail")
+	err = mmap.AtomicWrite(fname, sz, func(b []byte) error {
+		copy(b, "garbage")
+		return errFail
+	})
+	assert(errors.Is(err, errFail), "atomic write: exp fail, saw %v", err)
+
+	got, err = os.ReadFile(fname)
+	assert(err == nil, "read %s: %s", fname, err)
+	assert(bytes.Equal(got, want), "atomic write: failure modified file")
+
+	_, err = os.Stat(fname + ".tmp")
+	assert(os.IsNotExist(err), "atomic write: temp file not removed on failure")
+}
+
+func TestZeroRuns(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 8 * _PAGE
+	fname := tmpName(t)
+	fd, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	defer fd.Close()
+
+	// a sparse file with data in a few places
+	err = fd.Truncate(sz)
+	assert(err == nil, "truncate: %s", err)
+
+	fill := func(off, n int64) {
+		_, err := fd.WriteAt(bytes.Repeat([]byte{0xa5}, int(n)), off)
+		assert(err == nil, "write %d at %d: %s", n, off, err)
+	}
+	fill(0, 3)
+	fill(_PAGE+5, 1)
+	fill(4*_PAGE, _PAGE)
+	fill(sz-1, 1)
+
+	p, err := mmap.New(fd).Map(sz, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map: %s", err)
+
+	defer p.Unmap()
+
+	want := []mmap.Range{
+		{3, _PAGE + 2},
+		{_PAGE + 6, 3*_PAGE - 6},
+		{5 * _PAGE, 3*_PAGE - 1},
+	}
+	r, err := p.ZeroRuns(1)
+	assert(err == nil, "zero runs: %s", err)
+	assert(slices.Equal(r, want), "zero runs: exp %v, saw %v", want, r)
+
+	// short runs are ignored
+	r, err = p.ZeroRuns(2 * _PAGE)
+	assert(err == nil, "zero runs: %s", err)
+	assert(slices.Equal(r, want[1:]), "zero runs: exp %v, saw %v", want[1:], r)
+
+	_, err = p.ZeroRuns(0)
+	assert(err != nil, "zero runs 0: no error")
+}
+
+func TestWindow(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 300*_PAGE + 77
+	fname := tmpName(t)
+	pages := randData(sz)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	want := concat(pages)
+	win := 16 * _PAGE
+	w := mmap.NewWindow(fd, win)
+
+	defer w.Close()
+
+	// slide forward in odd steps, then jump around
+	var offs []int64
+	for off := int64(0); off < sz; off += 5*_PAGE + 13 {
+		offs = append(offs, off)
+	}
+	offs = append(offs, sz-1, 0, 100*_PAGE+1, 3, sz-win, sz-win-1)
+
+	for _, off := range offs {
+		b, err := w.At(off)
+		assert(err == nil, "at %d: %s", off, err)
+
+		exp := want[off:min(off+win, sz)]
+		assert(bytes.Equal(b, exp), "at %d: exp %d bytes, saw %d (or content mismatch)", off, len(exp), len(b))
+	}
+
+	_, err = w.At(sz)
+	assert(err == io.EOF, "at EOF: exp io.EOF, saw %v", err)
+	assert(w.Close() == nil, "close")
+}
+
+func TestBuffers(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 9*_PAGE + 321
+	fname := tmpName(t)
+	pages := randData(sz)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
 
-	orig := randData(sz)
+	defer fd.Close()
 
-	err := createFile(fname, orig)
+	p, err := mmap.New(fd).Map(0, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map: %s", err)
+
+	defer p.Unmap()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert(err == nil, "listen: %s", err)
+
+	defer ln.Close()
+
+	type result struct {
+		b   []byte
+		err error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			ch <- result{nil, err}
+			return
+		}
+		b, err := io.ReadAll(c)
+		c.Close()
+		ch <- result{b, err}
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	assert(err == nil, "dial: %s", err)
+
+	bufs := p.Buffers()
+	n, err := bufs.WriteTo(c)
+	assert(err == nil, "write: %s", err)
+	assert(n == sz, "write: exp %d bytes, saw %d", sz, n)
+	c.Close()
+
+	r := <-ch
+	assert(r.err == nil, "read: %s", r.err)
+	assert(bytes.Equal(r.b, concat(pages)), "buffers: content mismatch")
+}
+
+func TestOpenVerified(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 4*_PAGE + 9
+	body := concat(randData(sz))
+	sum := sha256.Sum256(body)
+
+	fname := tmpName(t)
+	err := os.WriteFile(fname, append(body, sum[:]...), 0600)
+	assert(err == nil, "write %s: %s", fname, err)
+
+	errBad := errors.New("bad checksum")
+	verify := func(body, trailer []byte) error {
+		h := sha256.Sum256(body)
+		if !bytes.Equal(h[:], trailer) {
+			return errBad
+		}
+		return nil
+	}
+
+	p, err := mmap.OpenVerified(fname, sha256.Size, verify)
+	assert(err == nil, "verify: %s", err)
+	assert(bytes.Equal(p.Bytes()[:sz], body), "verify: content mismatch")
+	assert(p.Unmap() == nil, "unmap")
+
+	// flip a bit in the body
+	body[sz/2] ^= 1
+	err = os.WriteFile(fname, append(body, sum[:]...), 0600)
+	assert(err == nil, "write %s: %s", fname, err)
+
+	p, err = mmap.OpenVerified(fname, sha256.Size, verify)
+	assert(errors.Is(err, errBad), "tampered: exp errBad, saw %v", err)
+	assert(p == nil, "tampered: returned a mapping")
+
+	_, err = mmap.OpenVerified(fname, int(sz)+100, verify)
+	assert(err != nil, "short file: no error")
+}
+
+func TestCapabilities(t *testing.T) {
+	assert := newAsserter(t)
+
+	c := mmap.Capabilities()
+	t.Logf("caps: %+v", c)
+	assert(c == mmap.Capabilities(), "caps: not stable")
+
+	switch runtime.GOOS {
+	case "linux":
+		assert(c.Mincore && c.Mremap, "linux: exp mincore and mremap")
+	case "windows":
+		assert(c == mmap.Caps{}, "windows: exp no caps")
+	default:
+		assert(c.Mincore, "%s: exp mincore", runtime.GOOS)
+	}
+}
+
+func TestHexDump(t *testing.T) {
+	assert := newAsserter(t)
+
+	p, err := mmap.NewAnon().Map(_PAGE, 0, mmap.PROT_RW, 0)
+	assert(err == nil, "map: %s", err)
+
+	defer p.Unmap()
+
+	copy(p.Bytes()[0x10:], "Hello, world\n\x00\x01\x02\x7fabcdefghijklmnop")
+
+	var buf bytes.Buffer
+	err = p.HexDump(0x10, 33, &buf)
+	assert(err == nil, "hexdump: %s", err)
+
+	want := `00000010: 4865 6c6c 6f2c 2077 6f72 6c64 0a00 0102  Hello, world....
+00000020: 7f61 6263 6465 6667 6869 6a6b 6c6d 6e6f  .abcdefghijklmno
+00000030: 70                                       p
+`
+	assert(buf.String() == want, "hexdump:\nexp:\n%s\nsaw:\n%s", want, buf.String())
+
+	err = p.HexDump(_PAGE-8, 16, &buf)
+	assert(err != nil, "hexdump out of bounds: no error")
+}
+
+func TestMapContext(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 64*_PAGE + 1
+	fname := tmpName(t)
+	pages := randData(sz)
+	err := createFile(fname, pages)
 	assert(err == nil, "create %s: %s", fname, err)
 
-	fd, err := os.OpenFile(fname, os.O_RDWR, 0600)
+	fd, err := os.Open(fname)
 	assert(err == nil, "open %s: %s", fname, err)
 
-	m := mmap.New(fd)
+	defer fd.Close()
 
-	p, err := m.Map(sz, 0, mmap.PROT_READ|mmap.PROT_WRITE, mmap.F_COW)
-	assert(err == nil, "mmap: %s: %s", fname, err)
-	assert(p != nil, "mmap: %s: nil ptr", fname)
+	p, err := mmap.New(fd).MapContext(context.Background(), 0, 0, mmap.PROT_READ, mmap.F_READAHEAD)
+	assert(err == nil, "map: %s", err)
+	assert(bytes.Equal(p.Bytes(), concat(pages)), "map: content mismatch")
+	assert(p.Unmap() == nil, "unmap")
 
-	mapped := p.Bytes()
-	assert(len(mapped) == int(sz), "mmap: len exp %d, saw %d", sz, len(mapped))
+	// a large anon mapping takes a while to prefault; read faults
+	// only map the zero page - so it costs no memory.
+	big := int64(1) << 32
+	if runtime.GOARCH == "386" || runtime.GOARCH == "arm" {
+		big = 1 << 29
+	}
 
-	// mutate the contents
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	t0 := time.Now()
+	p, err = mmap.NewAnon().MapContext(ctx, big, 0, mmap.PROT_READ, mmap.F_READAHEAD|mmap.F_COW)
+	d := time.Since(t0)
+	if err == nil {
+		p.Unmap()
+		t.Skipf("prefault of %d bytes finished in %s", big, d)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) && d < time.Millisecond {
+		t.Skipf("can't map %d bytes: %s", big, err)
+	}
+	assert(errors.Is(err, context.DeadlineExceeded), "map: exp deadline exceeded, saw %v", err)
+	assert(p == nil, "map: returned a mapping")
+
+	// already cancelled
+	_, err = mmap.NewAnon().MapContext(ctx, _PAGE, 0, mmap.PROT_READ, 0)
+	assert(errors.Is(err, context.DeadlineExceeded), "map: exp deadline exceeded, saw %v", err)
+}
+
+func TestReaderThrottled(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 20*_PAGE + 7
+	fname := tmpName(t)
 	pages := randData(sz)
-	out := mapped[:]
-	for i := range pages {
-		pg := &pages[i]
-		n := copy(out, pg.buf)
-		out = out[n:]
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	// the scan should take at least 200ms
+	rate := sz * 5
+	h := sha256.New()
+	t0 := time.Now()
+	n, err := mmap.ReaderThrottled(fd, rate, func(b []byte) error {
+		h.Write(b)
+		return nil
+	})
+	d := time.Since(t0)
+	assert(err == nil, "throttled: %s", err)
+	assert(n == sz, "throttled: exp %d bytes, saw %d", sz, n)
+	assert(bytes.Equal(h.Sum(nil), cksum(pages)), "throttled: checksum mismatch")
+
+	want := time.Duration(sz) * time.Second / time.Duration(rate)
+	assert(d >= want-10*time.Millisecond, "throttled: took %s; exp at least %s", d, want)
+
+	_, err = mmap.ReaderThrottled(fd, 0, nil)
+	assert(err != nil, "throttled: zero rate: no error")
+}
+
+func TestGrowingMapping(t *testing.T) {
+	assert := newAsserter(t)
+
+	fname := tmpName(t)
+	fd, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	defer fd.Close()
+
+	g, err := mmap.NewGrowingMapping(fd)
+	assert(err == nil, "growing: %s", err)
+
+	// increasing offsets - the last one leaves a large hole
+	gap := int64(256 << 20)
+	offs := []int64{0, 100, _PAGE - 3, 3 * _PAGE, 3*_PAGE + 17, gap}
+	writes := make(map[int64][]byte)
+	for _, off := range offs {
+		b := concat(randData(_PAGE/2 + 5))
+		n, err := g.WriteAt(b, off)
+		assert(err == nil, "write at %d: %s", off, err)
+		assert(n == len(b), "write at %d: exp %d bytes, saw %d", off, len(b), n)
+		writes[off] = b
 	}
-	p.Unmap()
-	fd.Close()
 
-	// now read the file back and see if the contents are same as orig
-	fd, err = os.Open(fname)
-	m = mmap.New(fd)
-	assert(err == nil, "mmap: open %s: %s", fname, err)
-	for i := range orig {
-		pg := &orig[i]
-		p, err := m.Map(int64(len(pg.buf)), pg.off, mmap.PROT_READ, 0)
-		assert(err == nil, "mmap %d at %d: %s", len(pg.buf), pg.off, err)
-		assert(p != nil, "mmap: %s: nil ptr", fname)
-		assert(bytes.Equal(p.Bytes(), pg.buf), "mmap: %d at %d content mismatch", len(pg.buf), pg.off)
+	end := gap + _PAGE/2 + 5
+	assert(g.Size() == end, "size: exp %d, saw %d", end, g.Size())
+
+	got := make([]byte, _PAGE/2+5)
+	_, err = g.ReadAt(got, 0)
+	assert(err == nil, "read: %s", err)
+	assert(bytes.Equal(got[:100], writes[0][:100]), "read: content mismatch")
+
+	_, err = g.ReadAt(got, 3*_PAGE+17)
+	assert(err == nil, "read: %s", err)
+	assert(bytes.Equal(got, writes[3*_PAGE+17]), "read: content mismatch")
+
+	_, err = g.ReadAt(got, end-1)
+	assert(err == io.EOF, "read past end: exp io.EOF, saw %v", err)
+
+	assert(g.Close() == nil, "close")
+
+	st, err := fd.Stat()
+	assert(err == nil, "stat: %s", err)
+	assert(st.Size() == end, "file size: exp %d, saw %d", end, st.Size())
+
+	// read back from the file
+	for _, off := range []int64{3*_PAGE + 17, gap} {
+		_, err = fd.ReadAt(got, off)
+		assert(err == nil, "file read at %d: %s", off, err)
+		assert(bytes.Equal(got, writes[off]), "file read at %d: content mismatch", off)
+	}
+
+	_, err = fd.ReadAt(got, gap/2)
+	assert(err == nil, "file read hole: %s", err)
+	assert(bytes.Equal(got, make([]byte, len(got))), "hole isn't zero")
+
+	// use after close
+	_, err = g.ReadAt(got, 0)
+	assert(errors.Is(err, os.ErrClosed), "read after close: exp ErrClosed, saw %v", err)
+	_, err = g.WriteAt(got, 0)
+	assert(errors.Is(err, os.ErrClosed), "write after close: exp ErrClosed, saw %v", err)
+	err = g.Flush()
+	assert(errors.Is(err, os.ErrClosed), "flush after close: exp ErrClosed, saw %v", err)
+	assert(g.Close() == nil, "second close")
+
+	st, err = fd.Stat()
+	assert(err == nil, "stat: %s", err)
+	assert(st.Size() == end, "file size after close: exp %d, saw %d", end, st.Size())
+}
+
+func TestGrowingMappingFlush(t *testing.T) {
+	assert := newAsserter(t)
+
+	fname := tmpName(t)
+	fd, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	defer fd.Close()
+
+	g, err := mmap.NewGrowingMapping(fd)
+	assert(err == nil, "growing: %s", err)
+
+	defer g.Close()
+
+	o := &testObserver{}
+	g.SetObserver(o)
+
+	// append records and flush every few; each flush must only cover
+	// the pages written since the previous one.
+	rec := concat(randData(_PAGE))
+	var off int64
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 3; j++ {
+			_, err = g.WriteAt(rec, off)
+			assert(err == nil, "write at %d: %s", off, err)
+			off += int64(len(rec))
+		}
+
+		err = g.Flush()
+		assert(err == nil, "flush: %s", err)
+		assert(len(o.flushes) == i+1, "flush %d: exp %d flushes, saw %d", i, i+1, len(o.flushes))
+		assert(o.flushes[i] == 3*_PAGE, "flush %d: exp %d bytes, saw %d", i, 3*_PAGE, o.flushes[i])
+	}
+
+	// nothing written; nothing flushed
+	err = g.Flush()
+	assert(err == nil, "flush: %s", err)
+	assert(len(o.flushes) == 4, "idle flush: exp 4 flushes, saw %d", len(o.flushes))
+}
+
+func TestFilesEqual(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 9*_PAGE + 5
+	pages := randData(sz)
+
+	a := tmpName(t)
+	err := createFile(a, pages)
+	assert(err == nil, "create %s: %s", a, err)
+
+	b := a + ".b"
+	err = createFile(b, pages)
+	assert(err == nil, "create %s: %s", b, err)
+
+	eq, err := mmap.FilesEqual(a, b)
+	assert(err == nil, "equal: %s", err)
+	assert(eq, "equal: identical files differ")
+
+	// same size, one byte different
+	buf := concat(pages)
+	buf[sz-2] ^= 1
+	err = os.WriteFile(b, buf, 0600)
+	assert(err == nil, "write %s: %s", b, err)
+
+	eq, err = mmap.FilesEqual(a, b)
+	assert(err == nil, "equal: %s", err)
+	assert(!eq, "equal: different files are equal")
+
+	// different sizes
+	err = os.WriteFile(b, concat(pages)[:sz-1], 0600)
+	assert(err == nil, "write %s: %s", b, err)
+
+	eq, err = mmap.FilesEqual(a, b)
+	assert(err == nil, "equal: %s", err)
+	assert(!eq, "equal: files of different sizes are equal")
+
+	// empty files
+	err = os.WriteFile(a, nil, 0600)
+	assert(err == nil, "write %s: %s", a, err)
+	err = os.WriteFile(b, nil, 0600)
+	assert(err == nil, "write %s: %s", b, err)
+
+	eq, err = mmap.FilesEqual(a, b)
+	assert(err == nil, "equal: %s", err)
+	assert(eq, "equal: empty files differ")
+
+	_, err = mmap.FilesEqual(a, a+".missing")
+	assert(err != nil, "equal: missing file: no error")
+}
+
+func TestDetach(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 4*_PAGE + 10
+	fname := tmpName(t)
+	pages := randData(sz)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	p, err := mmap.New(fd).Map(0, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map: %s", err)
+
+	b := p.Detach(_PAGE-5, 2*_PAGE)
+	tail := p.Detach(sz-4, 100)
+	assert(p.Detach(sz+1, 1) == nil, "detach out of bounds: not nil")
+	assert(p.Unmap() == nil, "unmap")
+
+	// the copies outlive the mapping
+	want := concat(pages)
+	assert(bytes.Equal(b, want[_PAGE-5:3*_PAGE-5]), "detach: content mismatch")
+	assert(bytes.Equal(tail, want[sz-4:]), "detach tail: exp 4 bytes, saw %d", len(tail))
+}
+
+func TestRingLog(t *testing.T) {
+	assert := newAsserter(t)
+
+	fname := tmpName(t)
+	fd, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	defer fd.Close()
+
+	err = fd.Truncate(32 + 256)
+	assert(err == nil, "truncate: %s", err)
+
+	r, err := mmap.NewRingLog(fd)
+	assert(err == nil, "ring log: %s", err)
+	assert(r.Cap() == 256, "cap: exp 256, saw %d", r.Cap())
+
+	// each record takes 14 bytes; so many times the capacity
+	const n = 100
+	for i := 0; i < n; i++ {
+		err = r.Append([]byte(fmt.Sprintf("record-%03d", i)))
+		assert(err == nil, "append %d: %s", i, err)
+	}
+
+	err = r.Append(make([]byte, 253))
+	assert(err != nil, "append too large: no error")
+
+	check := func(r *mmap.RingLog) {
+		recs, err := r.Records()
+		assert(err == nil, "records: %s", err)
+		assert(len(recs) == 256/14, "records: exp %d, saw %d", 256/14, len(recs))
+
+		// the most recent records, in order
+		first := n - len(recs)
+		for i, rec := range recs {
+			exp := fmt.Sprintf("record-%03d", first+i)
+			assert(string(rec) == exp, "record %d: exp %q, saw %q", i, exp, rec)
+		}
+	}
+
+	check(r)
+	assert(r.Close() == nil, "close")
+
+	// the log survives reopening
+	r, err = mmap.NewRingLog(fd)
+	assert(err == nil, "reopen ring log: %s", err)
+
+	defer r.Close()
+	check(r)
+}
+
+func TestMapStdin(t *testing.T) {
+	assert := newAsserter(t)
+
+	// child: map stdin and verify its contents
+	if exp := os.Getenv("MMAP_TEST_STDIN_SUM"); exp != "" {
+		p, err := mmap.MapStdin()
+		if exp == "pipe" {
+			assert(err != nil, "child: map stdin pipe: no error")
+			return
+		}
+		assert(err == nil, "child: map stdin: %s", err)
+
+		sum := sha256.Sum256(p.Bytes())
+		assert(fmt.Sprintf("%x", sum[:]) == exp, "child: content mismatch")
 		p.Unmap()
+		return
 	}
-	fd.Close()
+
+	var sz int64 = 3*_PAGE + (_PAGE / 3)
+	pages := randData(sz)
+	fname := tmpName(t)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMapStdin$")
+	cmd.Env = append(os.Environ(), fmt.Sprintf("MMAP_TEST_STDIN_SUM=%x", cksum(pages)))
+	cmd.Stdin = fd
+	out, err := cmd.CombinedOutput()
+	assert(err == nil, "child: %s\n%s", err, out)
+
+	cmd = exec.Command(os.Args[0], "-test.run=^TestMapStdin$")
+	cmd.Env = append(os.Environ(), "MMAP_TEST_STDIN_SUM=pipe")
+	cmd.Stdin = strings.NewReader("not a file")
+	out, err = cmd.CombinedOutput()
+	assert(err == nil, "child: %s\n%s", err, out)
+}
+
+func TestString(t *testing.T) {
+	assert := newAsserter(t)
+
+	prots := []struct {
+		p   mmap.Prot
+		exp string
+	}{
+		{0, "NONE"},
+		{mmap.PROT_READ, "READ"},
+		{mmap.PROT_RW, "READ|WRITE"},
+		{mmap.PROT_RX, "READ|EXEC"},
+		{mmap.PROT_RW | mmap.PROT_EXEC, "READ|WRITE|EXEC"},
+		{mmap.PROT_WRITE | 0x10, "WRITE|0x10"},
+	}
+
+	for _, x := range prots {
+		s := x.p.String()
+		assert(s == x.exp, "prot %d: exp %q, saw %q", uint(x.p), x.exp, s)
+	}
+
+	flags := []struct {
+		f   mmap.Flag
+		exp string
+	}{
+		{0, "NONE"},
+		{mmap.F_COW, "COW"},
+		{mmap.F_COW | mmap.F_HUGETLB | mmap.F_READAHEAD, "COW|HUGETLB|READAHEAD"},
+		{mmap.F_READAHEAD | mmap.F_INHERIT, "READAHEAD|INHERIT"},
+		{0x300, "0x300"},
+	}
+
+	for _, x := range flags {
+		s := x.f.String()
+		assert(s == x.exp, "flag %d: exp %q, saw %q", uint(x.f), x.exp, s)
+	}
+
+	s := fmt.Sprintf("%v", mmap.PROT_RW)
+	assert(s == "READ|WRITE", "fmt: saw %q", s)
 }
 
 // Create a file that is sz bytes big
@@ -255,6 +2194,30 @@ func randData(sz int64) []data {
 	return pages
 }
 
+// concat returns the data pages as one contiguous buffer
+func concat(d []data) []byte {
+	var b []byte
+	for i := range d {
+		b = append(b, d[i].buf...)
+	}
+	return b
+}
+
+// randLines returns n lines of random printable text of random lengths
+func randLines(n int) []string {
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789 "
+
+	lines := make([]string, n)
+	for i := range lines {
+		b := make([]byte, randU32()%200)
+		for j := range b {
+			b[j] = chars[randU32()%uint32(len(chars))]
+		}
+		lines[i] = string(b)
+	}
+	return lines
+}
+
 // sha256 of the data pages
 func cksum(d []data) []byte {
 	h := sha256.New()
@@ -16,17 +16,35 @@
 package mmap
 
 import (
+	"cmp"
 	"fmt"
 	"golang.org/x/sys/unix"
+	"os"
 	"reflect"
+	"runtime"
+	"slices"
 	"unsafe"
 )
 
 func (m *Mmap) mmap(sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+	return m.mmap_hint(nil, sz, off, prot, flags)
+}
+
+func (m *Mmap) map_anon(sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+	return m.map_anon_hint(nil, sz, off, prot, flags)
+}
+
+// mmap_hint maps the file at the address 'hint' if possible; a nil
+// hint lets the kernel choose the address.
+func (m *Mmap) mmap_hint(hint unsafe.Pointer, sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+	if flags&F_GROWSDOWN != 0 {
+		return nil, fmt.Errorf("%s: mmap %d at %d: F_GROWSDOWN: %w", m.fd.Name(), sz, off, ErrUnsupported)
+	}
+
 	mprot, mflag := convert(prot, flags)
 
 	fd := m.fd.Fd()
-	b, err := unix.Mmap(int(fd), off, int(sz), mprot, mflag)
+	b, err := m.do_mmap(hint, int(fd), sz, off, mprot, mflag)
 	if err != nil {
 		return nil, fmt.Errorf("%s: mmap %d at %d: %w", m.fd.Name(), sz, off, err)
 	}
@@ -34,15 +52,51 @@ func (m *Mmap) mmap(sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
 	p := &Mapping{
 		buf: b,
 		m:   m,
+		wr:  prot&PROT_WRITE != 0,
+		raw: hint != nil,
+		cow: flags&F_COW != 0,
+	}
+
+	if flags&F_INHERIT != 0 {
+		if p.ifd, err = inherit(m.fd); err != nil {
+			p.unmap()
+			return nil, fmt.Errorf("%s: mmap %d at %d: %w", m.fd.Name(), sz, off, err)
+		}
 	}
 	return p, nil
 }
 
-func (m *Mmap) map_anon(sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+func (m *Mmap) map_anon_hint(hint unsafe.Pointer, sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+	if flags&F_INHERIT != 0 {
+		return nil, fmt.Errorf("<anon>: mmap %d at %d: F_INHERIT: %w", sz, off, ErrUnsupported)
+	}
+
 	mprot, mflag := convert(prot, flags)
+
+	// F_COW always selects a private anon mapping - even for read-only
+	// mappings.
+	if flags&F_COW != 0 {
+		mflag &^= unix.MAP_SHARED
+		mflag |= unix.MAP_PRIVATE
+	}
 	mflag |= unix.MAP_ANON
 
-	b, err := unix.Mmap(-1, off, int(sz), mprot, mflag)
+	// the kernel ignores this unless it allows uninitialized anon pages
+	if flags&F_UNINITIALIZED != 0 {
+		mflag |= _MAP_UNINITIALIZED
+	}
+
+	if flags&F_GROWSDOWN != 0 {
+		if _MAP_GROWSDOWN == 0 {
+			return nil, fmt.Errorf("<anon>: mmap %d at %d: F_GROWSDOWN: %w", sz, off, ErrUnsupported)
+		}
+
+		// the kernel only grows private mappings
+		mflag &^= unix.MAP_SHARED
+		mflag |= unix.MAP_PRIVATE | _MAP_GROWSDOWN
+	}
+
+	b, err := m.do_mmap(hint, -1, sz, off, mprot, mflag)
 	if err != nil {
 		return nil, fmt.Errorf("<anon>: mmap %d at %d: %w", sz, off, err)
 	}
@@ -50,10 +104,174 @@ func (m *Mmap) map_anon(sz, off int64, prot Prot, flags Flag) (*Mapping, error)
 	p := &Mapping{
 		buf: b,
 		m:   m,
+		wr:  prot&PROT_WRITE != 0,
+		raw: hint != nil,
 	}
 	return p, nil
 }
 
+// inherit returns a duplicate of fd that is inherited across exec; the
+// caller's fd is left alone.
+func inherit(fd *os.File) (*os.File, error) {
+	nfd, err := unix.Dup(int(fd.Fd()))
+	if err != nil {
+		return nil, os.NewSyscallError("dup", err)
+	}
+	return os.NewFile(uintptr(nfd), fd.Name()), nil
+}
+
+// dupFile duplicates fd; the duplicate is close-on-exec
+func dupFile(fd *os.File) (*os.File, error) {
+	nfd, err := unix.FcntlInt(fd.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("fcntl", err)
+	}
+	return os.NewFile(uintptr(nfd), fd.Name()), nil
+}
+
+// mmapSyscall is the mmap(2) used by do_mmap; tests replace it to
+// simulate failures.
+var mmapSyscall = unix.Mmap
+
+// setFaultInjector replaces the mmap(2) syscall with fn; a nil fn
+// restores the real syscall.
+func setFaultInjector(fn func(fd int, off int64, sz int, prot, flags int) ([]byte, error)) {
+	if fn == nil {
+		fn = unix.Mmap
+	}
+	mmapSyscall = fn
+}
+
+// do_mmap calls mmap(2) and optionally retries with MAP_NORESERVE if
+// the kernel refused the mapping due to overcommit limits. A non-nil
+// hint is passed to the kernel as the preferred address.
+func (m *Mmap) do_mmap(hint unsafe.Pointer, fd int, sz, off int64, mprot, mflag int) ([]byte, error) {
+	mm := mmapSyscall
+	if hint != nil {
+		mm = func(fd int, off int64, sz int, prot, flags int) ([]byte, error) {
+			return mmapHint(hint, fd, off, sz, prot, flags)
+		}
+	}
+
+	b, err := mm(fd, off, int(sz), mprot, mflag)
+	if err == unix.ENOMEM && m.noreserve && _MAP_NORESERVE != 0 {
+		b, err = mm(fd, off, int(sz), mprot, mflag|_MAP_NORESERVE)
+	}
+	return b, err
+}
+
+// mmapHint calls mmap(2) with an address hint. Such mappings are not
+// known to unix.Munmap; they must be unmapped via unix.MunmapPtr.
+func mmapHint(hint unsafe.Pointer, fd int, off int64, sz int, prot, flags int) ([]byte, error) {
+	ptr, err := unix.MmapPtr(fd, off, hint, uintptr(sz), prot, flags)
+	if err != nil {
+		return nil, err
+	}
+	return unsafe.Slice((*byte)(ptr), sz), nil
+}
+
+// reserve maps 'sz' bytes of inaccessible address space
+func reserve(sz int64) ([]byte, error) {
+	return unix.Mmap(-1, 0, int(sz), unix.PROT_NONE, unix.MAP_PRIVATE|unix.MAP_ANON|_MAP_NORESERVE)
+}
+
+func unreserve(b []byte) error {
+	return unix.Munmap(b)
+}
+
+// rereserve replaces the 'sz' bytes at 'addr' with inaccessible
+// address space
+func rereserve(addr unsafe.Pointer, sz int64) error {
+	_, err := mmapHint(addr, -1, 0, int(sz), unix.PROT_NONE, unix.MAP_PRIVATE|unix.MAP_ANON|unix.MAP_FIXED|_MAP_NORESERVE)
+	return err
+}
+
+// mapFixed maps at exactly 'addr' within the reservation 'r'
+func (m *Mmap) mapFixed(r *Reservation, addr unsafe.Pointer, sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+	var p *Mapping
+	var err error
+
+	if m.fd == nil {
+		p, err = m.map_anon_hint(addr, sz, off, prot, flags|f_fixed)
+	} else {
+		p, err = m.mmap_hint(addr, sz, off, prot, flags|f_fixed)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.resv = r
+	return p, nil
+}
+
+func maxMmapSize() int64 {
+	var lim unix.Rlimit
+
+	if _RLIMIT_AS < 0 || unix.Getrlimit(_RLIMIT_AS, &lim) != nil {
+		return _MaxMmapSize
+	}
+
+	cur := uint64(lim.Cur)
+	if cur == unix.RLIM_INFINITY || cur >= uint64(_MaxMmapSize) {
+		return _MaxMmapSize
+	}
+	return int64(cur)
+}
+
+// EnableLargePages acquires the privileges needed for large page
+// mappings. Unix needs no special privileges for huge pages; they must
+// however be provisioned by the administrator.
+func EnableLargePages() error {
+	return nil
+}
+
+// WithFaultStats calls fn and returns the number of minor and major
+// page faults incurred while it ran; this helps quantify the cost of
+// touching mapped memory. On Linux, fn runs locked to the current OS
+// thread and only its faults are counted; elsewhere the counts are
+// process wide and include the faults of other goroutines.
+func WithFaultStats(fn func()) (minor, major int64) {
+	var r0, r1 unix.Rusage
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	unix.Getrusage(_RUSAGE_WHO, &r0)
+	fn()
+	unix.Getrusage(_RUSAGE_WHO, &r1)
+
+	return int64(r1.Minflt - r0.Minflt), int64(r1.Majflt - r0.Majflt)
+}
+
+// syncDir makes the changes to the entries of dir (eg a rename) durable
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = fd.Sync()
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// unlinkedTempFile creates a temporary file in dir and removes its name
+func unlinkedTempFile(dir string) (*os.File, error) {
+	fd, err := os.CreateTemp(dir, "mmap-spill")
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Remove(fd.Name()); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return fd, nil
+}
+
 // convert canonical prot/flags to Unix specific ones
 func convert(prot Prot, flags Flag) (mprot, mflag int) {
 	mprot = unix.PROT_READ
@@ -77,12 +295,58 @@ func convert(prot Prot, flags Flag) (mprot, mflag int) {
 	if flags&F_READAHEAD != 0 {
 		mflag |= _MAP_POPULATE
 	}
+	if flags&f_fixed != 0 {
+		mflag |= unix.MAP_FIXED
+	}
 	return
 }
 
 type Mapping struct {
 	buf []byte
 	m   *Mmap
+	wr  bool
+
+	// set if mapped via unix.MmapPtr
+	raw bool
+
+	// set for private (copy-on-write) file mappings
+	cow bool
+
+	// sorted, disjoint [start, end) ranges unmapped via UnmapRange
+	holes [][2]int64
+
+	// set if placed in a Reservation; unmap returns the pages to it
+	resv *Reservation
+
+	// write cursor of Write, ReadFrom and Seek
+	woff int64
+
+	// inheritable duplicate of the file for F_INHERIT
+	ifd *os.File
+}
+
+// InheritedFd returns the descriptor that child processes inherit
+// across exec for mappings created with F_INHERIT; it is a duplicate of
+// the mapped file that is closed when the mapping is unmapped. It
+// returns -1 for other mappings.
+func (p *Mapping) InheritedFd() int {
+	if p.ifd == nil {
+		return -1
+	}
+	return int(p.ifd.Fd())
+}
+
+// Iovec returns an iovec describing the mapping; it can be passed to
+// vectored syscalls such as readv(2) and pwritev(2). The mapping must
+// outlive the use of the iovec.
+func (p *Mapping) Iovec() unix.Iovec {
+	var iov unix.Iovec
+
+	if len(p.buf) > 0 {
+		iov.Base = &p.buf[0]
+		iov.SetLen(len(p.buf))
+	}
+	return iov
 }
 
 func (p *Mapping) addr() uintptr {
@@ -95,21 +359,268 @@ func (p *Mapping) bytes() []byte {
 }
 
 func (p *Mapping) lock() error {
-	return unix.Mlock(p.buf)
+	return p.each(0, int64(len(p.buf)), unix.Mlock)
 }
 
 func (p *Mapping) unlock() error {
-	return unix.Munlock(p.buf)
+	return p.each(0, int64(len(p.buf)), unix.Munlock)
 }
 
 func (p *Mapping) flush() error {
-	var fd int = -1
-	if p.m.fd != nil {
-		fd = int(p.m.fd.Fd())
+	// anon memory has nothing to sync to; and some kernels return
+	// EINVAL for msync(2) of anon mappings.
+	if p.m.fd == nil {
+		return nil
+	}
+	return p.msync(0, int64(len(p.buf)))
+}
+
+func (p *Mapping) flushRange(off, n int64) error {
+	if p.m.fd == nil {
+		return nil
+	}
+	return p.msync(off, n)
+}
+
+// msync syncs the given range; on network filesystems, msync(2) only
+// writes the pages to the client's cache. So we fsync to push them to
+// the server.
+func (p *Mapping) msync(off, n int64) error {
+	err := p.each(off, n, func(b []byte) error {
+		return unix.Msync(b, unix.MS_SYNC)
+	})
+	if err != nil {
+		return err
+	}
+
+	if p.wr && p.m.onNetworkFS() {
+		return p.m.fd.Sync()
+	}
+	return nil
+}
+
+func (p *Mapping) flushData() error {
+	if p.m.fd == nil {
+		return nil
+	}
+
+	err := p.each(0, int64(len(p.buf)), func(b []byte) error {
+		return unix.Msync(b, unix.MS_SYNC)
+	})
+	if err != nil {
+		return err
+	}
+	return fdatasync(p.m.fd)
+}
+
+func (p *Mapping) flushAsync() error {
+	if p.m.fd == nil {
+		return nil
+	}
+	return p.each(0, int64(len(p.buf)), func(b []byte) error {
+		return unix.Msync(b, unix.MS_ASYNC)
+	})
+}
+
+// MS_SYNC blocks until all dirty pages - including those already under
+// writeback due to an earlier MS_ASYNC - are on disk.
+func (p *Mapping) waitFlush() error {
+	return p.flush()
+}
+
+func (p *Mapping) resident() (int, error) {
+	var n int
+
+	pg := os.Getpagesize()
+	err := p.each(0, int64(len(p.buf)), func(b []byte) error {
+		vec := make([]byte, (len(b)+pg-1)/pg)
+		if err := mincore(b, vec); err != nil {
+			return fmt.Errorf("mmap: mincore %d bytes: %w", len(b), err)
+		}
+
+		for _, v := range vec {
+			n += int(v & 1)
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (p *Mapping) discard(off, n int64) error {
+	if err := p.checkHoles("discard", off, n); err != nil {
+		return err
+	}
+	if err := unix.Madvise(p.buf[off:off+n], unix.MADV_DONTNEED); err != nil {
+		return fmt.Errorf("mmap: discard %d at %d: %w", n, off, err)
+	}
+	return nil
+}
+
+func (p *Mapping) advise(a advice) error {
+	adv := unix.MADV_NORMAL
+	switch a {
+	case adviseSequential:
+		adv = unix.MADV_SEQUENTIAL
+	case adviseRandom:
+		adv = unix.MADV_RANDOM
+	}
+
+	if err := p.checkHoles("advise", 0, int64(len(p.buf))); err != nil {
+		return err
+	}
+	return unix.Madvise(p.buf, adv)
+}
+
+// noReadahead disables kernel readahead for the mapping
+func (p *Mapping) noReadahead() error {
+	if err := p.checkHoles("advise", 0, int64(len(p.buf))); err != nil {
+		return err
+	}
+	return unix.Madvise(p.buf, unix.MADV_RANDOM)
+}
+
+// prefetch starts reading the given range in the background
+func (p *Mapping) prefetch(off, n int64) error {
+	if err := p.checkHoles("prefetch", off, n); err != nil {
+		return err
+	}
+	return unix.Madvise(p.buf[off:off+n], unix.MADV_WILLNEED)
+}
+
+func (p *Mapping) protect(prot Prot) error {
+	// mprotect(2) fails with a cryptic EACCES when a shared mapping of
+	// a read-only file is made writable; so we look first.
+	if fd := p.m.fd; fd != nil && prot&PROT_WRITE != 0 && !p.cow {
+		fl, err := unix.FcntlInt(fd.Fd(), unix.F_GETFL, 0)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fd.Name(), os.NewSyscallError("fcntl", err))
+		}
+		if fl&unix.O_ACCMODE == unix.O_RDONLY {
+			return fmt.Errorf("%s: file opened read-only (O_RDONLY); can't make shared mapping writable", fd.Name())
+		}
 	}
-	return unix.Msync(p.buf, fd)
+
+	mprot, _ := convert(prot, 0)
+	return p.each(0, int64(len(p.buf)), func(b []byte) error {
+		return unix.Mprotect(b, mprot)
+	})
 }
 
+// unmapRange unmaps the page aligned range and records the hole
+func (p *Mapping) unmapRange(off, n int64) error {
+	var err error
+
+	// holes in a Reservation stay reserved
+	if p.resv != nil {
+		err = rereserve(unsafe.Pointer(&p.buf[off]), n)
+	} else {
+		err = unix.MunmapPtr(unsafe.Pointer(&p.buf[off]), uintptr(n))
+	}
+
+	if err != nil {
+		return fmt.Errorf("mmap: unmap %d at %d: %w", n, off, err)
+	}
+
+	// merge the new hole with the ones it overlaps or abuts
+	start, end := off, off+n
+	holes := p.holes[:0:0]
+	for _, h := range p.holes {
+		if h[1] < start || h[0] > end {
+			holes = append(holes, h)
+			continue
+		}
+		start, end = min(start, h[0]), max(end, h[1])
+	}
+
+	holes = append(holes, [2]int64{start, end})
+	slices.SortFunc(holes, func(a, b [2]int64) int {
+		return cmp.Compare(a[0], b[0])
+	})
+	p.holes = holes
+	return nil
+}
+
+// each calls fn with the mapped parts of the range [off, off+n) - ie
+// skipping the holes created by UnmapRange
+func (p *Mapping) each(off, n int64, fn func(b []byte) error) error {
+	end := off + n
+	for _, h := range p.holes {
+		if h[1] <= off || h[0] >= end {
+			continue
+		}
+
+		if h[0] > off {
+			if err := fn(p.buf[off:h[0]]); err != nil {
+				return err
+			}
+		}
+		off = h[1]
+	}
+
+	if off < end {
+		return fn(p.buf[off:end])
+	}
+	return nil
+}
+
+// mappedLen returns the number of bytes of [off, off+n) that are
+// mapped - ie not in a hole created by UnmapRange
+func (p *Mapping) mappedLen(off, n int64) int64 {
+	var z int64
+	p.each(off, n, func(b []byte) error {
+		z += int64(len(b))
+		return nil
+	})
+	return z
+}
+
+// checkHoles returns an error if the 'n' bytes at offset 'off' overlap
+// a hole created by UnmapRange; the kernel may have reused the hole
+// for some other mapping.
+func (p *Mapping) checkHoles(op string, off, n int64) error {
+	for _, h := range p.holes {
+		if h[0] < off+n && off < h[1] {
+			return fmt.Errorf("mmap: %s %d at %d: overlaps unmapped range %d-%d", op, n, off, h[0], h[1])
+		}
+	}
+	return nil
+}
+
+// unmap tears down the mapping; a mapping can only be unmapped once:
+// by then its address range may belong to someone else.
 func (p *Mapping) unmap() error {
-	return unix.Munmap(p.buf)
+	if p.buf == nil {
+		return fmt.Errorf("mmap: unmap: %w", os.ErrClosed)
+	}
+
+	var err error
+	switch {
+	case p.resv != nil:
+		if err = p.resv.restore(p); err == nil {
+			p.resv = nil
+		}
+
+	case len(p.holes) > 0:
+		// only unmap what's left; the holes may belong to others by now
+		err = p.each(0, int64(len(p.buf)), func(b []byte) error {
+			return unix.MunmapPtr(unsafe.Pointer(&b[0]), uintptr(len(b)))
+		})
+
+	case p.raw:
+		err = unix.MunmapPtr(unsafe.Pointer(&p.buf[0]), uintptr(len(p.buf)))
+
+	default:
+		err = unix.Munmap(p.buf)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	p.buf, p.holes = nil, nil
+	if p.ifd != nil {
+		err = p.ifd.Close()
+		p.ifd = nil
+	}
+	return err
 }
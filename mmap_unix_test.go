@@ -0,0 +1,491 @@
+// mmap_unix_test.go - unix specific tests for mmap-go
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build darwin || linux || freebsd || openbsd || solaris || netbsd || dragonfly
+
+package mmap_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/opencoff/go-mmap"
+	"golang.org/x/sys/unix"
+)
+
+func TestMapExplicit(t *testing.T) {
+	assert := newAsserter(t)
+
+	fd, err := os.Open("/dev/zero")
+	assert(err == nil, "open /dev/zero: %s", err)
+
+	defer fd.Close()
+
+	m := mmap.New(fd)
+	p, err := m.MapExplicit(_PAGE, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "mmap /dev/zero: %s", err)
+
+	b := p.Bytes()
+	assert(len(b) == int(_PAGE), "mmap: len exp %d, saw %d", _PAGE, len(b))
+	for i := range b {
+		assert(b[i] == 0, "mmap: non-zero byte %#x at %d", b[i], i)
+	}
+
+	_, err = m.MapExplicit(0, 0, mmap.PROT_READ, 0)
+	assert(err != nil, "mmap: zero size map succeeded")
+
+	p.Unmap()
+}
+
+func TestProtRX(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 2 * _PAGE
+	pages := randData(sz)
+	fname := tmpName(t)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	m := mmap.New(fd)
+	p, err := m.Map(sz, 0, mmap.PROT_RX, 0)
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+		t.Skipf("exec mappings disallowed: %s", err)
+	}
+	assert(err == nil, "mmap: %s: %s", fname, err)
+
+	b := p.Bytes()
+	assert(bytes.Equal(b[:len(pages[0].buf)], pages[0].buf), "mmap: content mismatch")
+	p.Unmap()
+}
+
+func TestAnonFlush(t *testing.T) {
+	assert := newAsserter(t)
+
+	for _, fl := range []mmap.Flag{0, mmap.F_COW} {
+		m := mmap.NewAnon()
+		p, err := m.Map(2*_PAGE, 0, mmap.PROT_RW, fl)
+		assert(err == nil, "mmap anon %#x: %s", fl, err)
+
+		copy(p.Bytes(), []byte("hello"))
+		err = p.Flush()
+		assert(err == nil, "flush anon %#x: %s", fl, err)
+		p.Unmap()
+	}
+}
+
+func TestInherit(t *testing.T) {
+	assert := newAsserter(t)
+
+	// child: map the inherited fd and verify its contents
+	if v := os.Getenv("MMAP_TEST_INHERIT_FD"); v != "" {
+		n, err := strconv.Atoi(v)
+		assert(err == nil, "child: bad fd %q", v)
+
+		fd := os.NewFile(uintptr(n), "inherited")
+		p, err := mmap.New(fd).Map(0, 0, mmap.PROT_READ, 0)
+		assert(err == nil, "child: mmap fd %d: %s", n, err)
+
+		sum := sha256.Sum256(p.Bytes())
+		exp := os.Getenv("MMAP_TEST_INHERIT_SUM")
+		assert(hex.EncodeToString(sum[:]) == exp, "child: content mismatch")
+		p.Unmap()
+		return
+	}
+
+	var sz int64 = 3*_PAGE + (_PAGE / 3)
+	pages := randData(sz)
+	fname := tmpName(t)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	p, err := mmap.New(fd).Map(0, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "mmap %s: %s", fname, err)
+	assert(p.InheritedFd() == -1, "mmap: inherited fd %d without F_INHERIT", p.InheritedFd())
+	assert(p.Unmap() == nil, "unmap")
+
+	p, err = mmap.New(fd).Map(0, 0, mmap.PROT_READ, mmap.F_INHERIT)
+	assert(err == nil, "mmap %s: %s", fname, err)
+
+	// the caller's fd is left alone; the child gets a duplicate
+	fl, err := unix.FcntlInt(fd.Fd(), unix.F_GETFD, 0)
+	assert(err == nil, "fcntl: %s", err)
+	assert(fl&unix.FD_CLOEXEC != 0, "mmap: FD_CLOEXEC cleared on the caller's fd")
+
+	ifd := p.InheritedFd()
+	assert(ifd >= 0 && ifd != int(fd.Fd()), "mmap: bad inherited fd %d", ifd)
+
+	fl, err = unix.FcntlInt(uintptr(ifd), unix.F_GETFD, 0)
+	assert(err == nil, "fcntl: %s", err)
+	assert(fl&unix.FD_CLOEXEC == 0, "mmap: FD_CLOEXEC set on the inherited fd")
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInherit$")
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("MMAP_TEST_INHERIT_FD=%d", ifd),
+		fmt.Sprintf("MMAP_TEST_INHERIT_SUM=%x", cksum(pages)))
+	out, err := cmd.CombinedOutput()
+	assert(err == nil, "child: %s\n%s", err, out)
+
+	// the duplicate goes away with the mapping
+	assert(p.Unmap() == nil, "unmap")
+	assert(p.InheritedFd() == -1, "unmap: inherited fd still open")
+	_, err = unix.FcntlInt(uintptr(ifd), unix.F_GETFD, 0)
+	assert(errors.Is(err, unix.EBADF), "unmap: inherited fd %d still open: %v", ifd, err)
+
+	_, err = mmap.NewAnon().Map(_PAGE, 0, mmap.PROT_RW, mmap.F_INHERIT)
+	assert(errors.Is(err, mmap.ErrUnsupported), "anon inherit: exp ErrUnsupported, saw %v", err)
+}
+
+// TestExecShared checks that a child process sees (and changes) the
+// pages of a shared mapping but not those of a private (F_COW) one;
+// the child is the re-exec'd test binary and maps the same file via an
+// inherited fd.
+func TestExecShared(t *testing.T) {
+	assert := newAsserter(t)
+
+	// child: write to the start of the inherited file via a shared mapping
+	if v := os.Getenv("MMAP_TEST_SHARED_FD"); v != "" {
+		n, err := strconv.Atoi(v)
+		assert(err == nil, "child: bad fd %q", v)
+
+		fd := os.NewFile(uintptr(n), "inherited")
+		p, err := mmap.New(fd).Map(0, 0, mmap.PROT_RW, 0)
+		assert(err == nil, "child: mmap fd %d: %s", n, err)
+
+		p.Bytes()[0] = 0xaa
+		p.Unmap()
+		return
+	}
+
+	fname := tmpName(t)
+	err := createFile(fname, randData(_PAGE))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.OpenFile(fname, os.O_RDWR, 0600)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	tests := []struct {
+		flags mmap.Flag
+		exp   byte
+	}{
+		{0, 0xaa},
+		{mmap.F_COW, 0x55},
+	}
+
+	for _, tc := range tests {
+		p, err := mmap.New(fd).Map(0, 0, mmap.PROT_RW, tc.flags|mmap.F_INHERIT)
+		assert(err == nil, "mmap %#x: %s", tc.flags, err)
+
+		// a private mapping gets its own copy of the page here
+		p.Bytes()[0] = 0x55
+
+		cmd := exec.Command(os.Args[0], "-test.run=^TestExecShared$")
+		cmd.Env = append(os.Environ(), fmt.Sprintf("MMAP_TEST_SHARED_FD=%d", p.InheritedFd()))
+		out, err := cmd.CombinedOutput()
+		assert(err == nil, "child: %s\n%s", err, out)
+
+		b := p.Bytes()[0]
+		assert(b == tc.exp, "mmap %#x: exp %#x, saw %#x", tc.flags, tc.exp, b)
+		p.Unmap()
+	}
+}
+
+func TestFaultInject(t *testing.T) {
+	assert := newAsserter(t)
+
+	fname := tmpName(t)
+	err := createFile(fname, randData(4*_PAGE))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	var calls int
+	mmap.InjectFault(func(fd int, off int64, sz int, prot, flags int) ([]byte, error) {
+		calls++
+		return nil, unix.EINVAL
+	})
+	defer mmap.InjectFault(nil)
+
+	_, err = mmap.New(fd).Map(0, 0, mmap.PROT_READ, 0)
+	assert(errors.Is(err, unix.EINVAL), "map: exp EINVAL, saw %v", err)
+	assert(strings.HasPrefix(err.Error(), fname+": mmap"), "map: bad error %q", err)
+
+	_, err = mmap.NewAnon().Map(_PAGE, 0, mmap.PROT_RW, 0)
+	assert(errors.Is(err, unix.EINVAL), "map anon: exp EINVAL, saw %v", err)
+	assert(strings.HasPrefix(err.Error(), "<anon>: mmap"), "map anon: bad error %q", err)
+	assert(calls == 2, "injector: exp 2 calls, saw %d", calls)
+
+	mmap.InjectFault(nil)
+	p, err := mmap.New(fd).Map(0, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map after restore: %s", err)
+	assert(p.Unmap() == nil, "unmap failed")
+}
+
+func TestUnmapRange(t *testing.T) {
+	assert := newAsserter(t)
+
+	fname := tmpName(t)
+	pages := randData(3 * _PAGE)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	f, err := mmap.Open(fname, mmap.PROT_RW)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer f.Close()
+
+	err = f.UnmapRange(_PAGE, _PAGE)
+	assert(err == nil, "unmap range: %s", err)
+
+	// the surrounding pages are intact and usable
+	b := f.Bytes()
+	assert(bytes.Equal(b[:_PAGE], pages[0].buf), "page 0: content mismatch")
+	assert(bytes.Equal(b[2*_PAGE:], pages[2].buf), "page 2: content mismatch")
+
+	copy(b, "hello")
+	copy(b[2*_PAGE:], "world")
+
+	z, err := f.FlushN()
+	assert(err == nil, "flush with hole: %s", err)
+	assert(z == 2*_PAGE, "flush with hole: exp %d bytes, saw %d", 2*_PAGE, z)
+
+	z, err = f.FlushRangeN(_PAGE-1, 2)
+	assert(err == nil, "flush range with hole: %s", err)
+	assert(z == _PAGE, "flush range with hole: exp %d bytes, saw %d", _PAGE, z)
+
+	n, err := f.Resident()
+	assert(err == nil, "resident with hole: %s", err)
+	assert(n <= 2, "resident with hole: exp at most 2 pages, saw %d", n)
+
+	// a partial page is not unmapped
+	err = f.UnmapRange(10, _PAGE)
+	assert(err == nil, "unmap partial: %s", err)
+	assert(b[_PAGE-1] == pages[0].buf[_PAGE-1], "page 0: partial unmap")
+
+	got, err := os.ReadFile(fname)
+	assert(err == nil, "read %s: %s", fname, err)
+	assert(bytes.Equal(got[:5], []byte("hello")), "page 0: write lost")
+	assert(bytes.Equal(got[2*_PAGE:2*_PAGE+5], []byte("world")), "page 2: write lost")
+}
+
+func TestProtect(t *testing.T) {
+	assert := newAsserter(t)
+
+	fname := tmpName(t)
+	err := createFile(fname, randData(2*_PAGE))
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.OpenFile(fname, os.O_RDWR, 0600)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	p, err := mmap.New(fd).Map(0, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map: %s", err)
+
+	defer p.Unmap()
+
+	err = p.PutUint8At(0, 1)
+	assert(errors.Is(err, mmap.ErrReadOnly), "read-only put: exp ErrReadOnly, saw %v", err)
+
+	err = p.Protect(mmap.PROT_RW)
+	assert(err == nil, "protect: %s", err)
+
+	copy(p.Bytes()[_PAGE:], "hello, world")
+	err = p.PutUint8At(0, 0xa5)
+	assert(err == nil, "put after protect: %s", err)
+	assert(p.Flush() == nil, "flush failed")
+
+	b, err := os.ReadFile(fname)
+	assert(err == nil, "read %s: %s", fname, err)
+	assert(b[0] == 0xa5 && bytes.Equal(b[_PAGE:_PAGE+12], []byte("hello, world")), "protect: write lost")
+
+	// a read-only file can't back a writable shared mapping
+	ro, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer ro.Close()
+
+	q, err := mmap.New(ro).Map(0, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map: %s", err)
+
+	defer q.Unmap()
+
+	err = q.Protect(mmap.PROT_RW)
+	assert(err != nil && strings.Contains(err.Error(), "O_RDONLY"), "protect read-only file: saw %v", err)
+
+	mmap.EnforceWXProtection(true)
+	defer mmap.EnforceWXProtection(false)
+
+	err = p.Protect(mmap.PROT_RW | mmap.PROT_EXEC)
+	assert(errors.Is(err, mmap.ErrWXViolation), "protect wx: exp ErrWXViolation, saw %v", err)
+}
+
+func TestFlushData(t *testing.T) {
+	assert := newAsserter(t)
+
+	fname := tmpName(t)
+	pages := randData(4 * _PAGE)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	f, err := mmap.Open(fname, mmap.PROT_RW)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer f.Close()
+
+	more := randData(4 * _PAGE)
+	copy(f.Bytes(), concat(more))
+
+	err = f.FlushData()
+	assert(err == nil, "flush data: %s", err)
+
+	b, err := os.ReadFile(fname)
+	assert(err == nil, "read %s: %s", fname, err)
+	assert(bytes.Equal(b, concat(more)), "flush data: content mismatch")
+}
+
+func TestIovec(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sz int64 = 3*_PAGE + 99
+	fname := tmpName(t)
+	pages := randData(sz)
+	err := createFile(fname, pages)
+	assert(err == nil, "create %s: %s", fname, err)
+
+	fd, err := os.Open(fname)
+	assert(err == nil, "open %s: %s", fname, err)
+
+	defer fd.Close()
+
+	p, err := mmap.New(fd).Map(0, 0, mmap.PROT_READ, 0)
+	assert(err == nil, "map: %s", err)
+
+	defer p.Unmap()
+
+	iov := p.Iovec()
+	assert(iov.Base == &p.Bytes()[0], "iovec: wrong base")
+
+	out := fname + ".out"
+	wfd, err := os.Create(out)
+	assert(err == nil, "create %s: %s", out, err)
+
+	defer wfd.Close()
+
+	n, _, errno := unix.Syscall(unix.SYS_WRITEV, wfd.Fd(), uintptr(unsafe.Pointer(&iov)), 1)
+	assert(errno == 0, "writev: %s", errno)
+	assert(int64(n) == sz, "writev: exp %d bytes, saw %d", sz, n)
+
+	b, err := os.ReadFile(out)
+	assert(err == nil, "read %s: %s", out, err)
+	assert(bytes.Equal(b, concat(pages)), "iovec: content mismatch")
+}
+
+func TestTotalStats(t *testing.T) {
+	assert := newAsserter(t)
+
+	m := mmap.NewAnon()
+	sizes := []int64{4 * _PAGE, 8*_PAGE + 10, 16 * _PAGE}
+	touch := []int64{1, 3, 16}
+
+	var length int64
+	var pages, resident int
+	for i, sz := range sizes {
+		p, err := m.Map(sz, 0, mmap.PROT_RW, mmap.F_COW)
+		assert(err == nil, "map anon %d: %s", sz, err)
+
+		defer p.Unmap()
+
+		b := p.Bytes()
+		for j := int64(0); j < touch[i]; j++ {
+			b[j*_PAGE] = 1
+		}
+
+		length += sz
+		pages += int((sz + _PAGE - 1) / _PAGE)
+		resident += int(touch[i])
+	}
+
+	st, err := m.TotalStats()
+	assert(err == nil, "total stats: %s", err)
+	assert(st.Length == length, "length: exp %d, saw %d", length, st.Length)
+	assert(st.PageCount == pages, "pages: exp %d, saw %d", pages, st.PageCount)
+	assert(st.ResidentPages == resident, "resident: exp %d, saw %d", resident, st.ResidentPages)
+
+	// unmapped mappings no longer count
+	p, err := m.Map(_PAGE, 0, mmap.PROT_RW, mmap.F_COW)
+	assert(err == nil, "map anon: %s", err)
+	assert(p.Unmap() == nil, "unmap")
+
+	st, err = m.TotalStats()
+	assert(err == nil, "total stats: %s", err)
+	assert(st.Length == length, "length after unmap: exp %d, saw %d", length, st.Length)
+}
+
+func TestUnmapRangeReuse(t *testing.T) {
+	assert := newAsserter(t)
+
+	p, err := mmap.NewAnon().Map(3*_PAGE, 0, mmap.PROT_RW, mmap.F_COW)
+	assert(err == nil, "map anon: %s", err)
+
+	hole := unsafe.Pointer(&p.Bytes()[_PAGE])
+	err = p.UnmapRange(_PAGE, _PAGE)
+	assert(err == nil, "unmap range: %s", err)
+
+	// operations on the hole are refused
+	err = p.Discard(0, 3*_PAGE)
+	assert(err != nil, "discard over hole: no error")
+	err = p.ExcludeFromCoreDump()
+	assert(err != nil, "madvise over hole: no error")
+
+	// someone else gets the hole
+	q, err := mmap.NewAnon().MapHint(hole, _PAGE, 0, mmap.PROT_RW, mmap.F_COW)
+	assert(err == nil, "map hint: %s", err)
+
+	defer q.Unmap()
+
+	if q.Addr() != uintptr(hole) {
+		t.Skipf("kernel ignored the hint %p", hole)
+	}
+
+	// and tearing down the original leaves it alone - even twice
+	assert(p.Unmap() == nil, "unmap")
+	err = p.Unmap()
+	assert(errors.Is(err, os.ErrClosed), "double unmap: exp ErrClosed, saw %v", err)
+	q.Bytes()[0] = 1
+	assert(q.Bytes()[0] == 1, "mapping in hole: content mismatch")
+}
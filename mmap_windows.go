@@ -16,10 +16,13 @@
 package mmap
 
 import (
+	"errors"
 	"fmt"
 	"golang.org/x/sys/windows"
 	"os"
+	"path/filepath"
 	"reflect"
+	"time"
 	"unsafe"
 )
 
@@ -29,20 +32,46 @@ type Mapping struct {
 	mapping windows.Handle
 	wr      bool
 	m       *Mmap
+
+	// write cursor of Write, ReadFrom and Seek
+	woff int64
 }
 
 func (m *Mmap) mmap(sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+	return m.mmap_hint(nil, sz, off, prot, flags)
+}
+
+func (m *Mmap) map_anon(sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+	return m.map_anon_hint(nil, sz, off, prot, flags)
+}
+
+// mmap_hint maps the file at the address 'hint' if possible; a nil
+// hint lets the system choose the address.
+func (m *Mmap) mmap_hint(hint unsafe.Pointer, sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+	if flags&F_GROWSDOWN != 0 {
+		return nil, fmt.Errorf("%s: mmap %d at %d: F_GROWSDOWN: %w", m.name(), sz, off, ErrUnsupported)
+	}
+
+	// Windows only supports large pages for anon mappings
+	if flags&F_HUGETLB != 0 {
+		return nil, fmt.Errorf("%s: mmap %d at %d: F_HUGETLB: %w", m.name(), sz, off, ErrUnsupported)
+	}
+
 	mflag, macc := convert(prot, flags)
 
 	fd := windows.Handle(m.fd.Fd())
-	p, err := m.do_mmap(fd, sz, off, mflag, macc)
+	p, err := m.do_mmap(hint, fd, sz, off, mflag, macc, flags)
 	if err == nil {
 		p.wr = prot&PROT_WRITE != 0
 	}
 	return p, err
 }
 
-func (m *Mmap) map_anon(sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+func (m *Mmap) map_anon_hint(hint unsafe.Pointer, sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+	if flags&F_GROWSDOWN != 0 {
+		return nil, fmt.Errorf("%s: mmap %d at %d: F_GROWSDOWN: %w", m.name(), sz, off, ErrUnsupported)
+	}
+
 	mflag, macc := convert(prot, flags)
 
 	// These two flags are ONLY available for anon mappings.
@@ -52,31 +81,152 @@ func (m *Mmap) map_anon(sz, off int64, prot Prot, flags Flag) (*Mapping, error)
 	}
 
 	fd := windows.Handle(^uintptr(0))
-	p, err := m.do_mmap(fd, sz, off, mflag, macc)
-	if err == nil {
-		p.wr = prot&PROT_WRITE != 0
+	p, err := m.do_mmap(hint, fd, sz, off, mflag, macc, flags)
+	if err != nil {
+		if flags&F_HUGETLB != 0 && errors.Is(err, windows.ERROR_PRIVILEGE_NOT_HELD) {
+			err = fmt.Errorf("%w: %w", ErrPrivilegeNotHeld, err)
+		}
+		return nil, err
 	}
-	return p, err
+
+	p.wr = prot&PROT_WRITE != 0
+	return p, nil
+}
+
+func maxMmapSize() int64 {
+	return _MaxMmapSize
+}
+
+// EnableLargePages acquires the SeLockMemoryPrivilege needed for large
+// page (F_HUGETLB) anon mappings. It returns ErrPrivilegeNotHeld if
+// the user hasn't been granted the "Lock pages in memory" right.
+func EnableLargePages() error {
+	var tok windows.Token
+
+	acc := uint32(windows.TOKEN_ADJUST_PRIVILEGES | windows.TOKEN_QUERY)
+	err := windows.OpenProcessToken(windows.CurrentProcess(), acc, &tok)
+	if err != nil {
+		return fmt.Errorf("mmap: large pages: %w", os.NewSyscallError("OpenProcessToken", err))
+	}
+
+	defer tok.Close()
+
+	var tp windows.Tokenprivileges
+
+	nm, _ := windows.UTF16PtrFromString("SeLockMemoryPrivilege")
+	err = windows.LookupPrivilegeValue(nil, nm, &tp.Privileges[0].Luid)
+	if err != nil {
+		return fmt.Errorf("mmap: large pages: %w", os.NewSyscallError("LookupPrivilegeValue", err))
+	}
+
+	tp.PrivilegeCount = 1
+	tp.Privileges[0].Attributes = windows.SE_PRIVILEGE_ENABLED
+
+	// AdjustTokenPrivileges() succeeds even if the privilege isn't held;
+	// the only indication is the last error. So we call it directly.
+	r, _, err := procAdjustTokenPrivileges.Call(uintptr(tok), 0, uintptr(unsafe.Pointer(&tp)), 0, 0, 0)
+	if r == 0 {
+		return fmt.Errorf("mmap: large pages: %w", os.NewSyscallError("AdjustTokenPrivileges", err))
+	}
+	if err == windows.ERROR_NOT_ALL_ASSIGNED {
+		return ErrPrivilegeNotHeld
+	}
+	return nil
+}
+
+// WithFaultStats calls fn and returns the number of page faults of the
+// process incurred while it ran. Windows doesn't distinguish minor and
+// major faults; all faults are reported as minor.
+func WithFaultStats(fn func()) (minor, major int64) {
+	f0 := pageFaults()
+	fn()
+	return int64(pageFaults() - f0), 0
+}
+
+// pageFaults returns the page fault count of the process
+func pageFaults() uint32 {
+	// PROCESS_MEMORY_COUNTERS
+	var pmc struct {
+		Cb                         uint32
+		PageFaultCount             uint32
+		PeakWorkingSetSize         uintptr
+		WorkingSetSize             uintptr
+		QuotaPeakPagedPoolUsage    uintptr
+		QuotaPagedPoolUsage        uintptr
+		QuotaPeakNonPagedPoolUsage uintptr
+		QuotaNonPagedPoolUsage     uintptr
+		PagefileUsage              uintptr
+		PeakPagefileUsage          uintptr
+	}
+
+	pmc.Cb = uint32(unsafe.Sizeof(pmc))
+	procGetProcessMemoryInfo.Call(uintptr(windows.CurrentProcess()), uintptr(unsafe.Pointer(&pmc)), uintptr(pmc.Cb))
+	return pmc.PageFaultCount
+}
+
+// probeCaps returns the (lack of) features on windows
+func probeCaps() Caps {
+	return Caps{}
 }
 
-func (m *Mmap) do_mmap(fd windows.Handle, sz, off int64, mflag, macc uint32) (*Mapping, error) {
+// canMap checks that the mapping fits in the remaining commit charge
+// (physical memory and page file) and the free address space.
+func canMap(sz int64) (bool, error) {
+	// MEMORYSTATUSEX
+	var ms struct {
+		Length               uint32
+		MemoryLoad           uint32
+		TotalPhys            uint64
+		AvailPhys            uint64
+		TotalPageFile        uint64
+		AvailPageFile        uint64
+		TotalVirtual         uint64
+		AvailVirtual         uint64
+		AvailExtendedVirtual uint64
+	}
+
+	ms.Length = uint32(unsafe.Sizeof(ms))
+	if r, _, err := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&ms))); r == 0 {
+		return false, fmt.Errorf("mmap: can map: GlobalMemoryStatusEx: %w", err)
+	}
+
+	n := uint64(sz)
+	return n <= ms.AvailPageFile && n <= ms.AvailVirtual, nil
+}
+
+var procGlobalMemoryStatusEx = windows.NewLazySystemDLL("kernel32.dll").NewProc("GlobalMemoryStatusEx")
+
+var procGetProcessMemoryInfo = windows.NewLazySystemDLL("kernel32.dll").NewProc("K32GetProcessMemoryInfo")
+
+var procFlushInstructionCache = windows.NewLazySystemDLL("kernel32.dll").NewProc("FlushInstructionCache")
+
+var procAdjustTokenPrivileges = windows.NewLazySystemDLL("advapi32.dll").NewProc("AdjustTokenPrivileges")
+
+func (m *Mmap) do_mmap(hint unsafe.Pointer, fd windows.Handle, sz, off int64, mflag, macc uint32, flags Flag) (*Mapping, error) {
 	maxSz := uint64(sz) + uint64(off)
 	maxH := uint32(maxSz >> 32)
 	maxL := uint32(maxSz & 0xffffffff)
 
-	h, err := windows.CreateFileMapping(fd, nil, mflag, maxH, maxL, nil)
+	var sa *windows.SecurityAttributes
+	if flags&F_INHERIT != 0 {
+		sa = &windows.SecurityAttributes{InheritHandle: 1}
+		sa.Length = uint32(unsafe.Sizeof(*sa))
+	}
+
+	h, err := windows.CreateFileMapping(fd, sa, mflag, maxH, maxL, nil)
 	if h == 0 {
 		return nil, fmt.Errorf("%s: mmap %d at %d: %w",
-			m.fd.Name(), sz, off, os.NewSyscallError("CreateFileMapping", err))
+			m.name(), sz, off, os.NewSyscallError("CreateFileMapping", err))
 	}
 
 	// now map into memory
 	offH := uint32(uint64(off) >> 32)
 	offL := uint32(uint64(off) & 0xffffffff)
-	addr, err := windows.MapViewOfFile(h, macc, offH, offL, uintptr(sz))
+	addr, err := mapView(hint, h, macc, offH, offL, uintptr(sz))
 	if addr == 0 {
+		windows.CloseHandle(h)
 		return nil, fmt.Errorf("%s: mmap %d at %d: %w",
-			m.fd.Name(), sz, off, os.NewSyscallError("MapViewOfFile", err))
+			m.name(), sz, off, os.NewSyscallError("MapViewOfFile", err))
 	}
 
 	p := &Mapping{
@@ -88,6 +238,47 @@ func (m *Mmap) do_mmap(fd windows.Handle, sz, off int64, mflag, macc uint32) (*M
 	return p, nil
 }
 
+// dupFile duplicates the handle of fd
+func dupFile(fd *os.File) (*os.File, error) {
+	var h windows.Handle
+
+	me := windows.CurrentProcess()
+	err := windows.DuplicateHandle(me, windows.Handle(fd.Fd()), me, &h, 0, false, windows.DUPLICATE_SAME_ACCESS)
+	if err != nil {
+		return nil, os.NewSyscallError("DuplicateHandle", err)
+	}
+	return os.NewFile(uintptr(h), fd.Name()), nil
+}
+
+// mapView maps a view of the section at 'hint' if possible; the hint
+// is advisory and we fall back to a system chosen address.
+func mapView(hint unsafe.Pointer, h windows.Handle, macc, offH, offL uint32, sz uintptr) (uintptr, error) {
+	if hint != nil {
+		addr, _, _ := procMapViewOfFileEx.Call(uintptr(h), uintptr(macc), uintptr(offH), uintptr(offL), sz, uintptr(hint))
+		if addr != 0 {
+			return addr, nil
+		}
+	}
+	return windows.MapViewOfFile(h, macc, offH, offL, sz)
+}
+
+var procMapViewOfFileEx = windows.NewLazySystemDLL("kernel32.dll").NewProc("MapViewOfFileEx")
+
+// name returns a printable name of the mapped object
+func (m *Mmap) name() string {
+	if m.fd == nil {
+		return "<anon>"
+	}
+	return m.fd.Name()
+}
+
+// Handle returns the section (file mapping) handle of the mapping; it
+// is closed when the mapping is unmapped. With F_INHERIT the handle is
+// inheritable: a child process can map its value with MapViewOfFile.
+func (p *Mapping) Handle() windows.Handle {
+	return p.mapping
+}
+
 func (p *Mapping) addr() uintptr {
 	return p.ptr
 }
@@ -120,24 +311,125 @@ func (p *Mapping) unlock() error {
 }
 
 func (p *Mapping) flush() error {
+	return p.flushRange(0, int64(p.sz))
+}
+
+func (p *Mapping) mappedLen(off, n int64) int64 {
+	return n
+}
+
+func (p *Mapping) flushRange(off, n int64) error {
 	// This is a complex dance on Windows :(
-	err := windows.FlushViewOfFile(p.ptr, uintptr(p.sz))
+	err := windows.FlushViewOfFile(p.ptr+uintptr(off), uintptr(n))
 	if err != nil {
-		return fmt.Errorf("VirtualUnlock %x: (%d bytes): %w",
-			p.ptr, p.sz, os.NewSyscallError("VirtualUnlock", err))
+		return fmt.Errorf("flush %x: (%d bytes): %w",
+			p.ptr+uintptr(off), n, os.NewSyscallError("FlushViewOfFile", err))
 	}
 
 	h := windows.Handle(p.m.fd.Fd())
 	if p.wr && h != windows.Handle(^uintptr(0)) {
 		if err = windows.FlushFileBuffers(h); err != nil {
 			return fmt.Errorf("flush %x: (%d bytes): %w",
-				p.ptr, p.sz, os.NewSyscallError("VirtualUnlock", err))
+				p.ptr+uintptr(off), n, os.NewSyscallError("FlushFileBuffers", err))
 		}
 	}
 	return nil
 }
 
+// FlushFileBuffers has no data-only variant
+func (p *Mapping) flushData() error {
+	return p.flush()
+}
+
+func (p *Mapping) flushAsync() error {
+	err := windows.FlushViewOfFile(p.ptr, uintptr(p.sz))
+	if err != nil {
+		return fmt.Errorf("flush %x: (%d bytes): %w",
+			p.ptr, p.sz, os.NewSyscallError("FlushViewOfFile", err))
+	}
+	return nil
+}
+
+func (p *Mapping) waitFlush() error {
+	h := windows.Handle(p.m.fd.Fd())
+	if p.wr && h != windows.Handle(^uintptr(0)) {
+		if err := windows.FlushFileBuffers(h); err != nil {
+			return fmt.Errorf("flush %x: (%d bytes): %w",
+				p.ptr, p.sz, os.NewSyscallError("FlushFileBuffers", err))
+		}
+	}
+	return nil
+}
+
+func (p *Mapping) resident() (int, error) {
+	return 0, unsupported("resident")
+}
+
+func (p *Mapping) discard(off, n int64) error {
+	return unsupported("discard")
+}
+
+// XXX Windows has no equivalent of madvise(2)
+func (p *Mapping) advise(a advice) error {
+	return nil
+}
+
+func (p *Mapping) noReadahead() error {
+	return nil
+}
+
+func (p *Mapping) prefetch(off, n int64) error {
+	return nil
+}
+
+// NB: a view can't be made more permissive than the access it was
+// mapped with; ie a read-only view can't be made writable.
+func (p *Mapping) protect(prot Prot) error {
+	var old uint32
+
+	mflag, _ := convert(prot, 0)
+	if err := windows.VirtualProtect(p.ptr, p.sz, mflag, &old); err != nil {
+		return fmt.Errorf("%s: %w", p.m.name(), os.NewSyscallError("VirtualProtect", err))
+	}
+	return nil
+}
+
+// XXX placeholders (VirtualAlloc2 and MapViewOfFile3) are needed to
+// map within reserved address space; we don't support them (yet)
+func reserve(sz int64) ([]byte, error) {
+	return nil, unsupported("reserve")
+}
+
+func unreserve(b []byte) error {
+	return unsupported("reserve")
+}
+
+func rereserve(addr unsafe.Pointer, sz int64) error {
+	return unsupported("reserve")
+}
+
+func (m *Mmap) mapFixed(r *Reservation, addr unsafe.Pointer, sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+	return nil, unsupported("reserve")
+}
+
+func (p *Mapping) syncICache(off, n int64) error {
+	r, _, err := procFlushInstructionCache.Call(uintptr(windows.CurrentProcess()), p.addr()+uintptr(off), uintptr(n))
+	if r == 0 {
+		return fmt.Errorf("mmap: FlushInstructionCache: %w", err)
+	}
+	return nil
+}
+
+// Windows can't unmap part of a view
+func (p *Mapping) unmapRange(off, n int64) error {
+	return unsupported("unmap range")
+}
+
 func (p *Mapping) unmap() error {
+	if p.ptr == 0 {
+		return fmt.Errorf("mmap: unmap: %w", os.ErrClosed)
+	}
+
 	err := p.flush()
 	if err != nil {
 		return err
@@ -149,14 +441,71 @@ func (p *Mapping) unmap() error {
 			p.ptr, p.sz, os.NewSyscallError("UnmapViewOfFile", err))
 	}
 
+	ptr := p.ptr
+	p.ptr, p.sz = 0, 0
+
 	err = windows.CloseHandle(p.mapping)
 	if err != nil {
-		return fmt.Errorf("unmap %x: (%d bytes): %w",
-			p.ptr, p.sz, os.NewSyscallError("CloseHandle", err))
+		return fmt.Errorf("unmap %x: %w", ptr, os.NewSyscallError("CloseHandle", err))
 	}
 	return nil
 }
 
+// XXX directories can't be opened for FlushFileBuffers without backup
+// semantics; NTFS journals the rename and we rely on that.
+func syncDir(dir string) error {
+	return nil
+}
+
+// spillFile creates a temp file in dir that is deleted when closed
+func spillFile(dir string) (*os.File, error) {
+	nm := filepath.Join(dir, fmt.Sprintf("mmap-spill-%d-%d", os.Getpid(), time.Now().UnixNano()))
+	p, err := windows.UTF16PtrFromString(nm)
+	if err != nil {
+		return nil, err
+	}
+
+	const share = windows.FILE_SHARE_READ | windows.FILE_SHARE_WRITE | windows.FILE_SHARE_DELETE
+	const attr = windows.FILE_ATTRIBUTE_TEMPORARY | windows.FILE_FLAG_DELETE_ON_CLOSE
+
+	h, err := windows.CreateFile(p, windows.GENERIC_READ|windows.GENERIC_WRITE, share, nil, windows.CREATE_NEW, attr, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("CreateFile", err)
+	}
+	return os.NewFile(uintptr(h), nm), nil
+}
+
+// Block devices aren't exposed via os.File's mode bits on windows;
+// we never get here.
+func getBlockDevSize(fd *os.File) (int64, error) {
+	return 0, fmt.Errorf("block device size: %w", ErrUnsupported)
+}
+
+func preallocate(fd *os.File, off, n int64) error {
+	st, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	// a smaller allocation size truncates the file; so only grow it
+	if off+n <= st.Size() {
+		return nil
+	}
+
+	// FILE_ALLOCATION_INFO
+	info := struct {
+		AllocationSize int64
+	}{off + n}
+
+	h := windows.Handle(fd.Fd())
+	err = windows.SetFileInformationByHandle(h, windows.FileAllocationInfo,
+		(*byte)(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)))
+	if err != nil {
+		return os.NewSyscallError("SetFileInformationByHandle", err)
+	}
+	return extend(fd, off+n)
+}
+
 // Missing constants in sys/windows
 const (
 	_SEC_LARGE_PAGES uint32 = 0x80000000
@@ -199,3 +548,65 @@ func convert(prot Prot, flags Flag) (mflag, macc uint32) {
 	// NB: Windows doesn't support LARGE_PAGES for non-anon mappings!
 	return
 }
+
+func (p *Mapping) coreDump(on bool) error {
+	return unsupported("core dump")
+}
+
+func dropCache(fd *os.File, off, n int64) error {
+	return nil
+}
+
+func readAhead(fd *os.File, off, n int64) error {
+	return nil
+}
+
+func smapsStats(start, end uintptr) (SmapStats, error) {
+	return SmapStats{}, unsupported("smaps")
+}
+
+func fsType(fd *os.File) (string, error) {
+	var nm [windows.MAX_PATH + 1]uint16
+
+	err := windows.GetVolumeInformationByHandle(windows.Handle(fd.Fd()), nil, 0, nil, nil, nil, &nm[0], uint32(len(nm)))
+	if err != nil {
+		return "", os.NewSyscallError("GetVolumeInformationByHandle", err)
+	}
+	return windows.UTF16ToString(nm[:]), nil
+}
+
+func dioAlign(fd *os.File) (mem, off int64, err error) {
+	return 0, 0, unsupported("direct io align")
+}
+
+func copyRange(src, dst *os.File, off, n int64) error {
+	return unsupported("copy range")
+}
+
+func cloneFile(src, dst string) error {
+	return ErrUnsupported
+}
+
+func networkFS(fd *os.File) (bool, error) {
+	return false, ErrUnsupported
+}
+
+func (p *Mapping) setName(nm string) error {
+	return unsupported("set name")
+}
+
+func (p *Mapping) collapseHuge() error {
+	return unsupported("collapse huge")
+}
+
+func (p *Mapping) populate(write bool) error {
+	return unsupported("populate")
+}
+
+func futexWait(v *uint32, expect uint32) error {
+	return unsupported("futex")
+}
+
+func futexWake(v *uint32, n int) (int, error) {
+	return 0, unsupported("futex")
+}
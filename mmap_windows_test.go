@@ -0,0 +1,54 @@
+// mmap_windows_test.go - windows specific tests for mmap-go
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build windows
+
+package mmap_test
+
+import (
+	"errors"
+	"testing"
+	"unsafe"
+
+	"github.com/opencoff/go-mmap"
+	"golang.org/x/sys/windows"
+)
+
+func TestEnableLargePages(t *testing.T) {
+	assert := newAsserter(t)
+
+	err := mmap.EnableLargePages()
+	if errors.Is(err, mmap.ErrPrivilegeNotHeld) {
+		t.Skipf("large pages: %s", err)
+	}
+	assert(err == nil, "large pages: %s", err)
+}
+
+func TestInheritHandle(t *testing.T) {
+	assert := newAsserter(t)
+
+	for _, fl := range []mmap.Flag{0, mmap.F_INHERIT} {
+		p, err := mmap.NewAnon().Map(_PAGE, 0, mmap.PROT_RW, fl)
+		assert(err == nil, "map anon %s: %s", fl, err)
+
+		var hf uint32
+		r, _, err := procGetHandleInformation.Call(uintptr(p.Handle()), uintptr(unsafe.Pointer(&hf)))
+		assert(r != 0, "handle info %s: %s", fl, err)
+
+		inherit := hf&windows.HANDLE_FLAG_INHERIT != 0
+		assert(inherit == (fl == mmap.F_INHERIT), "%s: handle inheritable %v", fl, inherit)
+		assert(p.Unmap() == nil, "unmap")
+	}
+}
+
+var procGetHandleInformation = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetHandleInformation")
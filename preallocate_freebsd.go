@@ -0,0 +1,34 @@
+// preallocate_freebsd.go - posix_fallocate(2) on 64-bit FreeBSD
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build freebsd && (amd64 || arm64 || riscv64)
+
+package mmap
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// XXX x/sys/unix has no wrapper for posix_fallocate(2); the syscall
+// returns the error number rather than setting errno.
+func preallocate(fd *os.File, off, n int64) error {
+	r, _, errno := unix.Syscall(unix.SYS_POSIX_FALLOCATE, fd.Fd(), uintptr(off), uintptr(n))
+	switch {
+	case errno != 0:
+		return os.NewSyscallError("posix_fallocate", errno)
+	case r != 0:
+		return os.NewSyscallError("posix_fallocate", unix.Errno(r))
+	}
+	return nil
+}
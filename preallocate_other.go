@@ -0,0 +1,26 @@
+// preallocate_other.go - BSDs without a usable posix_fallocate(2)
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build openbsd || netbsd || dragonflybsd || (freebsd && !(amd64 || arm64 || riscv64))
+
+package mmap
+
+import (
+	"os"
+)
+
+// XXX the other BSDs have no posix_fallocate(2); on 32-bit FreeBSD its
+// 64-bit arguments need splitting which we don't bother with.
+func preallocate(fd *os.File, off, n int64) error {
+	return unsupported("preallocate")
+}
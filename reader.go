@@ -0,0 +1,524 @@
+// reader.go - streaming readers over mapped files
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ChunkedReader is an io.Reader over a file that maps successive
+// windows ("chunks") of the file; each window is unmapped as soon as it
+// is fully consumed. Unlike Reader(), it is pull based and composes
+// with the io ecosystem (eg bufio.Scanner).
+type ChunkedReader struct {
+	m     *Mmap
+	chunk int64
+	fsz   int64
+
+	// file offset of the next window
+	off int64
+
+	// current window and its unread portion
+	p   *Mapping
+	buf []byte
+
+	err error
+}
+
+var _ io.ReadCloser = &ChunkedReader{}
+
+// NewChunkedReader returns a reader for the contents of 'fd' that maps
+// at most 'chunk' bytes at a time. The chunk size is rounded up to a
+// multiple of the page size.
+func NewChunkedReader(fd *os.File, chunk int64) *ChunkedReader {
+	r := &ChunkedReader{
+		m:     New(fd),
+		chunk: pageRound(chunk),
+	}
+
+	fsz, err := fileSize(fd)
+	if err != nil {
+		r.err = err
+		return r
+	}
+
+	r.fsz = fsz
+	return r
+}
+
+// Read reads up to len(b) bytes from the current window, mapping the
+// next window as needed.
+func (r *ChunkedReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Close unmaps the current window; subsequent reads return io.EOF.
+func (r *ChunkedReader) Close() error {
+	var err error
+	if r.p != nil {
+		err = r.p.unmap()
+		r.p = nil
+	}
+
+	r.buf = nil
+	r.err = io.EOF
+	return err
+}
+
+// next unmaps the current window and maps the next one
+func (r *ChunkedReader) next() error {
+	if r.p != nil {
+		r.p.unmap()
+		r.p = nil
+	}
+
+	if r.off >= r.fsz {
+		return io.EOF
+	}
+
+	sz := min(r.chunk, r.fsz-r.off)
+	p, err := r.m.mmap(sz, r.off, PROT_READ, F_READAHEAD)
+	if err != nil {
+		return err
+	}
+
+	r.p = p
+	r.buf = p.bytes()
+	r.off += sz
+	return nil
+}
+
+// ForEachLine maps the file in chunks and calls fn with each newline
+// delimited line (without the trailing newline). Lines are handed to
+// fn directly from the mapped memory - except for lines that straddle
+// two chunks; such lines are reassembled in a separate buffer. The
+// line is only valid for the duration of the call to fn. If fn returns
+// a non-nil error, the iteration stops and the error is returned.
+func ForEachLine(fd *os.File, fn func(line []byte) error) error {
+	return forEachLine(fd, _MaxMmapSize, fn)
+}
+
+func forEachLine(fd *os.File, chunk int64, fn func(line []byte) error) error {
+	// the partial line at the end of the previous chunk
+	var carry []byte
+
+	_, err := chunks(fd, chunk, func(b []byte) error {
+		if len(carry) > 0 {
+			i := bytes.IndexByte(b, '\n')
+			if i < 0 {
+				carry = append(carry, b...)
+				return nil
+			}
+
+			carry = append(carry, b[:i]...)
+			if err := fn(carry); err != nil {
+				return err
+			}
+			carry = carry[:0]
+			b = b[i+1:]
+		}
+
+		for {
+			i := bytes.IndexByte(b, '\n')
+			if i < 0 {
+				break
+			}
+
+			if err := fn(b[:i]); err != nil {
+				return err
+			}
+			b = b[i+1:]
+		}
+
+		carry = append(carry, b...)
+		return nil
+	})
+
+	if err == nil && len(carry) > 0 {
+		err = fn(carry)
+	}
+	return err
+}
+
+// ForEachVarintRecord maps the file in chunks and calls fn with each
+// record of a stream of records that are prefixed by their length as
+// an unsigned varint (eg delimited protobufs). Like ForEachLine,
+// records are handed to fn directly from the mapped memory except for
+// those that straddle two chunks. A corrupt length or a truncated
+// final record is an error.
+func ForEachVarintRecord(fd *os.File, fn func(rec []byte) error) error {
+	return forEachVarintRecord(fd, _MaxMmapSize, fn)
+}
+
+func forEachVarintRecord(fd *os.File, chunk int64, fn func(rec []byte) error) error {
+	fsz, err := fileSize(fd)
+	if err != nil {
+		return err
+	}
+
+	// the partial record at the end of the previous chunk and the file
+	// offset of the current record
+	var carry []byte
+	var off int64
+
+	corrupt := func(err error) error {
+		return fmt.Errorf("mmap: %s: record at %d: %w", fd.Name(), off, err)
+	}
+
+	_, err = chunks(fd, chunk, func(b []byte) error {
+		if len(carry) > 0 {
+			// complete the length - a byte at a time
+			n, k, err := uvarint(carry, fsz)
+			for ; k == 0 && err == nil && len(b) > 0; n, k, err = uvarint(carry, fsz) {
+				carry = append(carry, b[0])
+				b = b[1:]
+			}
+			if err != nil {
+				return corrupt(err)
+			}
+			if k == 0 {
+				return nil
+			}
+
+			end := k + int(n)
+			need := min(end-len(carry), len(b))
+			carry = append(carry, b[:need]...)
+			b = b[need:]
+			if len(carry) < end {
+				return nil
+			}
+
+			if err := fn(carry[k:]); err != nil {
+				return err
+			}
+			off += int64(end)
+			carry = carry[:0]
+		}
+
+		for len(b) > 0 {
+			n, k, err := uvarint(b, fsz)
+			if err != nil {
+				return corrupt(err)
+			}
+
+			end := k + int(n)
+			if k == 0 || end > len(b) {
+				carry = append(carry, b...)
+				break
+			}
+
+			if err := fn(b[k:end]); err != nil {
+				return err
+			}
+			off += int64(end)
+			b = b[end:]
+		}
+		return nil
+	})
+
+	if err == nil && len(carry) > 0 {
+		err = corrupt(io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+// uvarint decodes the varint record length at the start of b; it
+// returns k == 0 if b doesn't hold the entire varint.
+func uvarint(b []byte, max int64) (uint64, int, error) {
+	n, k := binary.Uvarint(b)
+	switch {
+	case k < 0:
+		return 0, 0, fmt.Errorf("varint overflow")
+	case k > 0 && n > uint64(max):
+		return 0, 0, fmt.Errorf("length %d exceeds file size", n)
+	}
+	return n, k, nil
+}
+
+// unmapFn unmaps the windows of chunks; tests replace it to inject
+// failures
+var unmapFn = (*Mapping).unmap
+
+// chunks maps successive windows of at most 'chunk' bytes of the file
+// and calls fp with each window; it's the engine behind Reader and
+// friends. 'chunk' must be a multiple of the page size. Each window is
+// unmapped before the next one is mapped or chunks returns; a failure
+// to unmap is joined with the error from fp. The returned byte count
+// covers the windows that fp processed without error.
+func chunks(fd *os.File, chunk int64, fp func(buf []byte) error) (int64, error) {
+	fsz, err := fileSize(fd)
+	if err != nil {
+		return 0, err
+	}
+
+	var off, z int64
+
+	m := New(fd)
+	for fsz > 0 {
+		sz := min(fsz, chunk)
+		p, err := m.mmap(sz, off, PROT_READ, F_READAHEAD)
+		if err != nil {
+			return z, err
+		}
+
+		err = fp(p.bytes())
+		if err == nil {
+			z += sz
+		}
+
+		if uerr := unmapFn(p); uerr != nil {
+			err = errors.Join(err, fmt.Errorf("mmap: unmap %d at %d: %w", sz, off, uerr))
+		}
+
+		if err != nil {
+			return z, err
+		}
+
+		off += sz
+		fsz -= sz
+	}
+	return z, nil
+}
+
+// ReaderPipelined is like Reader but maps the file 'chunk' bytes at a
+// time and overlaps the mapping (and prefaulting) of the next chunk
+// with the processing of the current one by fp. The chunk size is
+// rounded up to a multiple of the page size. If fp returns an error,
+// the pending chunk is discarded and the error is returned; failures
+// to unmap are joined with it.
+func ReaderPipelined(fd *os.File, chunk int64, fp func(buf []byte) error) (int64, error) {
+	fsz, err := fileSize(fd)
+	if err != nil {
+		return 0, err
+	}
+
+	type window struct {
+		p   *Mapping
+		err error
+	}
+
+	m := New(fd)
+	chunk = pageRound(chunk)
+	next := func(off int64) chan window {
+		ch := make(chan window, 1)
+		go func() {
+			p, err := m.mmap(min(chunk, fsz-off), off, PROT_READ, F_READAHEAD)
+			ch <- window{p, err}
+		}()
+		return ch
+	}
+
+	unmap := func(p *Mapping, off int64) error {
+		if err := unmapFn(p); err != nil {
+			return fmt.Errorf("mmap: unmap %d at %d: %w", p.size(), off, err)
+		}
+		return nil
+	}
+
+	var off, z int64
+	var pend chan window
+	if fsz > 0 {
+		pend = next(0)
+	}
+
+	for pend != nil {
+		w := <-pend
+		if w.err != nil {
+			return z, w.err
+		}
+
+		sz := w.p.size()
+		pend = nil
+		if off+sz < fsz {
+			pend = next(off + sz)
+		}
+
+		err := fp(w.p.bytes())
+		if err == nil {
+			z += sz
+		}
+
+		err = errors.Join(err, unmap(w.p, off))
+		if err != nil {
+			if pend != nil {
+				if w := <-pend; w.err == nil {
+					err = errors.Join(err, unmap(w.p, off+sz))
+				}
+			}
+			return z, err
+		}
+		off += sz
+	}
+	return z, nil
+}
+
+// ReaderPrefetch is like Reader but maps the file 'chunk' bytes at a
+// time and asks the kernel to read ahead the next chunk before handing
+// the current one to fp. It is a lighter-weight alternative to
+// ReaderPipelined. The chunk size is rounded up to a multiple of the
+// page size.
+func ReaderPrefetch(fd *os.File, chunk int64, fp func(buf []byte) error) (int64, error) {
+	var off int64
+
+	chunk = pageRound(chunk)
+	return chunks(fd, chunk, func(b []byte) error {
+		// advisory; a failure only costs us the readahead
+		off += int64(len(b))
+		readAhead(fd, off, chunk)
+		return fp(b)
+	})
+}
+
+// ReaderThrottled is like Reader but paces the scan to at most
+// 'bytesPerSec' bytes per second; this keeps background scans from
+// saturating the I/O of foreground work. The file is mapped in chunks
+// of about a tenth of a second's worth of data; after each chunk is
+// processed by fp, the scan sleeps until it is back under the rate.
+func ReaderThrottled(fd *os.File, bytesPerSec int64, fp func(buf []byte) error) (int64, error) {
+	if bytesPerSec <= 0 {
+		return 0, fmt.Errorf("mmap: throttled reader: invalid rate %d", bytesPerSec)
+	}
+
+	var z int64
+
+	t0 := time.Now()
+	chunk := pageRound(bytesPerSec / 10)
+	return chunks(fd, chunk, func(b []byte) error {
+		if err := fp(b); err != nil {
+			return err
+		}
+
+		// the time by which we'd have read z bytes at the given rate
+		z += int64(len(b))
+		due := time.Duration(float64(z) / float64(bytesPerSec) * float64(time.Second))
+		if d := due - time.Since(t0); d > 0 {
+			time.Sleep(d)
+		}
+		return nil
+	})
+}
+
+// FilesEqual returns true if the files 'a' and 'b' have the same
+// contents. Files of different sizes are never equal; otherwise the
+// files are mapped and compared a window at a time - stopping at the
+// first difference.
+func FilesEqual(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, fmt.Errorf("mmap: %w", err)
+	}
+
+	defer fa.Close()
+
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, fmt.Errorf("mmap: %w", err)
+	}
+
+	defer fb.Close()
+
+	sa, err := fileSize(fa)
+	if err != nil {
+		return false, err
+	}
+
+	sb, err := fileSize(fb)
+	if err != nil {
+		return false, err
+	}
+
+	if sa != sb {
+		return false, nil
+	}
+
+	ma, mb := New(fa), New(fb)
+	for off := int64(0); off < sa; {
+		sz := min(sa-off, _CompareWindow)
+		eq, err := equalAt(ma, mb, sz, off)
+		if err != nil || !eq {
+			return false, err
+		}
+		off += sz
+	}
+	return true, nil
+}
+
+// files are compared in windows of this size
+const _CompareWindow = 64 * 1024 * 1024
+
+// equalAt compares 'sz' bytes at 'off' of the two files
+func equalAt(ma, mb *Mmap, sz, off int64) (bool, error) {
+	pa, err := ma.mmap(sz, off, PROT_READ, 0)
+	if err != nil {
+		return false, err
+	}
+
+	defer pa.unmap()
+
+	pb, err := mb.mmap(sz, off, PROT_READ, 0)
+	if err != nil {
+		return false, err
+	}
+
+	defer pb.unmap()
+
+	pa.advise(adviseSequential)
+	pb.advise(adviseSequential)
+	return bytes.Equal(pa.bytes(), pb.bytes()), nil
+}
+
+// fileSize returns the size of the file or block device backing fd
+func fileSize(fd *os.File) (int64, error) {
+	st, err := fd.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("mmap: %w", err)
+	}
+
+	mode := st.Mode()
+	if mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0 {
+		sz, err := getBlockDevSize(fd)
+		if err != nil {
+			return 0, fmt.Errorf("mmap: %s: %w", fd.Name(), err)
+		}
+		return sz, nil
+	}
+	return st.Size(), nil
+}
+
+// pageRound rounds n up to a multiple of the page size, within the
+// bounds of a single mapping.
+func pageRound(n int64) int64 {
+	pg := int64(os.Getpagesize())
+	n = (n + pg - 1) &^ (pg - 1)
+	return min(max(n, pg), _MaxMmapSize)
+}
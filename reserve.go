@@ -0,0 +1,154 @@
+// reserve.go - address space reservations
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mmap
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// f_fixed places a mapping at exactly the hinted address (MAP_FIXED);
+// it's only ever used within a Reservation.
+const f_fixed Flag = 1 << 31
+
+// Reservation is a contiguous region of address space that is reserved
+// (mapped PROT_NONE) so that file and anon mappings can be placed at
+// chosen offsets within it without colliding with other mappings of
+// the process. Unmapping a mapping placed in the reservation returns
+// its pages to the reservation. All methods are safe for concurrent use.
+type Reservation struct {
+	mu sync.Mutex
+
+	buf []byte
+
+	// live mappings placed in the reservation
+	live map[*Mapping]struct{}
+}
+
+// Reserve reserves 'sz' bytes (rounded up to a page) of address space.
+// It returns ErrUnsupported on Windows.
+func Reserve(sz int64) (*Reservation, error) {
+	if sz <= 0 || sz > _MaxMmapSize {
+		return nil, fmt.Errorf("mmap: reserve %d: invalid size", sz)
+	}
+
+	b, err := reserve(pageRound(sz))
+	if err != nil {
+		return nil, fmt.Errorf("mmap: reserve %d: %w", sz, err)
+	}
+
+	r := &Reservation{
+		buf:  b,
+		live: make(map[*Mapping]struct{}),
+	}
+	return r, nil
+}
+
+// Addr returns the start address of the reservation
+func (r *Reservation) Addr() uintptr {
+	return uintptr(unsafe.Pointer(unsafe.SliceData(r.buf)))
+}
+
+// Size returns the size of the reservation
+func (r *Reservation) Size() int64 {
+	return int64(len(r.buf))
+}
+
+// Map maps 'sz' bytes at offset 'off' of the file of 'm' (or anon
+// memory if 'm' is an anon mapping object) at offset 'at' of the
+// reservation; 'at' must be page aligned. The mapping must fit in the
+// reservation and not overlap the other live mappings in it.
+func (r *Reservation) Map(m *Mmap, at, sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+	if err := checkWX(prot); err != nil {
+		return nil, fmt.Errorf("mmap: reserve: map %d at %d: %w", sz, at, err)
+	}
+
+	pg := int64(os.Getpagesize())
+	if sz <= 0 || at < 0 || at%pg != 0 || at+sz > r.Size() {
+		return nil, fmt.Errorf("mmap: reserve: map %d at %d: out of bounds", sz, at)
+	}
+
+	t0 := m.start()
+	p, err := r.place(m, at, sz, off, prot, flags)
+
+	// outside r.mu: Unmap takes m.mu before restoring the pages to r
+	return m.mapped(p, err, t0)
+}
+
+// place maps at offset 'at' of the reservation and records the mapping
+func (r *Reservation) place(m *Mmap, at, sz, off int64, prot Prot, flags Flag) (*Mapping, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.buf == nil {
+		return nil, fmt.Errorf("mmap: reserve: map %d at %d: released", sz, at)
+	}
+
+	// MAP_FIXED silently replaces what's already there
+	start, end := r.Addr()+uintptr(at), r.Addr()+uintptr(pageRound(at+sz))
+	for q := range r.live {
+		if start < q.addr()+uintptr(pageRound(q.size())) && q.addr() < end {
+			return nil, fmt.Errorf("mmap: reserve: map %d at %d: overlaps mapping at %d", sz, at, q.addr()-r.Addr())
+		}
+	}
+
+	p, err := m.mapFixed(r, unsafe.Pointer(&r.buf[at]), sz, off, prot, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	r.live[p] = struct{}{}
+	return p, nil
+}
+
+// Release unmaps the reservation; the mappings placed in it must be
+// unmapped first.
+func (r *Reservation) Release() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.buf == nil {
+		return nil
+	}
+
+	if n := len(r.live); n > 0 {
+		return fmt.Errorf("mmap: reserve: release: %d mappings still live", n)
+	}
+
+	if err := unreserve(r.buf); err != nil {
+		return fmt.Errorf("mmap: reserve: release: %w", err)
+	}
+	r.buf = nil
+	return nil
+}
+
+// restore returns the pages of 'p' to the reservation
+func (r *Reservation) restore(p *Mapping) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// the pages may since have been given to another mapping
+	if _, ok := r.live[p]; !ok {
+		return fmt.Errorf("mmap: reserve: unmap %d at %d: not a live mapping", p.size(), p.addr()-r.Addr())
+	}
+
+	if err := rereserve(unsafe.Pointer(unsafe.SliceData(p.bytes())), pageRound(p.size())); err != nil {
+		return fmt.Errorf("mmap: reserve: unmap %d at %d: %w", p.size(), p.addr()-r.Addr(), err)
+	}
+
+	delete(r.live, p)
+	return nil
+}
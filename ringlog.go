@@ -0,0 +1,242 @@
+// ringlog.go - a fixed size circular log backed by a mapped file
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// The ring log file starts with a header:
+//
+//	magic    [8]byte
+//	capacity uint64 - size of the data region that follows the header
+//	head     uint64 - logical offset of the oldest record
+//	tail     uint64 - logical offset of the end of the newest record
+//
+// head and tail only ever grow; their value modulo the capacity is the
+// position in the data region. Each record is a little-endian uint32
+// length followed by the payload; records wrap around the end of the
+// data region.
+const (
+	_RingMagic  = "MMRLOG01"
+	_RingHdr    = 32
+	_RingRecHdr = 4
+)
+
+// RingLog is a fixed size log of variable length records over a mapped
+// file: when the file is full, Append overwrites the oldest records.
+// All methods are safe for concurrent use.
+type RingLog struct {
+	mu sync.Mutex
+
+	fd   *os.File
+	p    *Mapping
+	data []byte
+
+	head, tail uint64
+}
+
+// NewRingLog returns a ring log over the file 'fd' which must be opened
+// read-write; its size (less a 32 byte header) is the capacity of the
+// log. A file with a zeroed header (eg freshly truncated) is
+// initialized as an empty log; otherwise the existing log is opened.
+func NewRingLog(fd *os.File) (*RingLog, error) {
+	p, err := New(fd).Map(0, 0, PROT_RW, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	b := p.bytes()
+	if len(b) <= _RingHdr+_RingRecHdr {
+		p.Unmap()
+		return nil, fmt.Errorf("mmap: %s: ring log: file too small (%d bytes)", fd.Name(), len(b))
+	}
+
+	r := &RingLog{
+		fd:   fd,
+		p:    p,
+		data: b[_RingHdr:],
+	}
+
+	if err := r.load(); err != nil {
+		p.Unmap()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Cap returns the size of the data region of the log; a record
+// occupies 4 bytes more than its length.
+func (r *RingLog) Cap() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.data)
+}
+
+// Append adds 'rec' to the log, overwriting as many of the oldest
+// records as needed to make room.
+func (r *RingLog) Append(rec []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.p == nil {
+		return fmt.Errorf("mmap: %s: ring log: closed", r.fd.Name())
+	}
+
+	need := uint64(_RingRecHdr + len(rec))
+	if need > uint64(len(r.data)) {
+		return fmt.Errorf("mmap: %s: ring log: record of %d bytes exceeds capacity %d",
+			r.fd.Name(), len(rec), len(r.data)-_RingRecHdr)
+	}
+
+	head := r.head
+	for r.tail+need-head > uint64(len(r.data)) {
+		n, err := r.recLen(head)
+		if err != nil {
+			return err
+		}
+		head += _RingRecHdr + n
+	}
+
+	// drop the overwritten records before we clobber them
+	if head != r.head {
+		r.head = head
+		r.store()
+	}
+
+	var hdr [_RingRecHdr]byte
+	binary.LittleEndian.PutUint32(hdr[:], uint32(len(rec)))
+	r.put(r.tail, hdr[:])
+	r.put(r.tail+_RingRecHdr, rec)
+
+	r.tail += need
+	r.store()
+	return nil
+}
+
+// Records returns a copy of the records in the log, oldest first
+func (r *RingLog) Records() ([][]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.p == nil {
+		return nil, fmt.Errorf("mmap: %s: ring log: closed", r.fd.Name())
+	}
+
+	var recs [][]byte
+	for off := r.head; off < r.tail; {
+		n, err := r.recLen(off)
+		if err != nil {
+			return nil, err
+		}
+
+		rec := make([]byte, n)
+		r.get(rec, off+_RingRecHdr)
+		recs = append(recs, rec)
+		off += _RingRecHdr + n
+	}
+	return recs, nil
+}
+
+// Flush writes the changes to the backing file
+func (r *RingLog) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.p == nil {
+		return nil
+	}
+	return r.p.Flush()
+}
+
+// Close unmaps the log; the file itself is left open.
+func (r *RingLog) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.p == nil {
+		return nil
+	}
+
+	err := r.p.Unmap()
+	r.p, r.data = nil, nil
+	return err
+}
+
+// load reads and validates the header; a zeroed header is initialized
+func (r *RingLog) load() error {
+	hdr := r.p.bytes()[:_RingHdr]
+	le := binary.LittleEndian
+
+	if string(hdr[:8]) != _RingMagic {
+		for _, c := range hdr {
+			if c != 0 {
+				return fmt.Errorf("mmap: %s: ring log: bad magic", r.fd.Name())
+			}
+		}
+
+		copy(hdr, _RingMagic)
+		le.PutUint64(hdr[8:], uint64(len(r.data)))
+		r.store()
+		return nil
+	}
+
+	capacity := le.Uint64(hdr[8:])
+	r.head, r.tail = le.Uint64(hdr[16:]), le.Uint64(hdr[24:])
+	switch {
+	case capacity != uint64(len(r.data)):
+		return fmt.Errorf("mmap: %s: ring log: capacity %d doesn't match file size", r.fd.Name(), capacity)
+	case r.head > r.tail || r.tail-r.head > capacity:
+		return fmt.Errorf("mmap: %s: ring log: corrupt header (head %d, tail %d)", r.fd.Name(), r.head, r.tail)
+	}
+	return nil
+}
+
+// store writes head and tail to the header
+func (r *RingLog) store() {
+	hdr := r.p.bytes()[:_RingHdr]
+	binary.LittleEndian.PutUint64(hdr[16:], r.head)
+	binary.LittleEndian.PutUint64(hdr[24:], r.tail)
+}
+
+// recLen returns the length of the record at logical offset 'off'
+func (r *RingLog) recLen(off uint64) (uint64, error) {
+	var hdr [_RingRecHdr]byte
+	r.get(hdr[:], off)
+
+	n := uint64(binary.LittleEndian.Uint32(hdr[:]))
+	if off+_RingRecHdr+n > r.tail {
+		return 0, fmt.Errorf("mmap: %s: ring log: corrupt record at %d", r.fd.Name(), off)
+	}
+	return n, nil
+}
+
+// put copies 'b' to logical offset 'off', wrapping around the end of
+// the data region
+func (r *RingLog) put(off uint64, b []byte) {
+	i := int(off % uint64(len(r.data)))
+	n := copy(r.data[i:], b)
+	copy(r.data, b[n:])
+}
+
+// get fills 'b' from logical offset 'off', wrapping around the end of
+// the data region
+func (r *RingLog) get(b []byte, off uint64) {
+	i := int(off % uint64(len(r.data)))
+	n := copy(b, r.data[i:])
+	copy(b[n:], r.data)
+}
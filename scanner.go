@@ -0,0 +1,118 @@
+// scanner.go - windowed scans with a bounded memory footprint
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mmap
+
+import (
+	"errors"
+	"os"
+)
+
+// Scanner makes repeated read-only passes over a file while keeping
+// its memory footprint near one window: each window is discarded from
+// the mapping (and where possible, from the page cache) as soon as the
+// callback for it returns and only the next window is read ahead. This
+// suits long running services that scan large files repeatedly.
+type Scanner struct {
+	fd     *os.File
+	m      *Mmap
+	window int64
+
+	// current mapping; only valid during Each()
+	p *Mapping
+}
+
+// NewScanner returns a scanner over the contents of 'fd' that hands
+// out windows of 'window' bytes. The window is rounded up to a multiple
+// of the page size.
+func NewScanner(fd *os.File, window int64) *Scanner {
+	s := &Scanner{
+		fd:     fd,
+		m:      New(fd),
+		window: pageRound(window),
+	}
+	return s
+}
+
+// Each calls fn with successive windows of the file; 'off' is the file
+// offset of the window. The window is only valid for the duration of
+// the call to fn. If fn returns a non-nil error, the scan stops and the
+// error is returned.
+func (s *Scanner) Each(fn func(off int64, buf []byte) error) error {
+	fsz, err := fileSize(s.fd)
+	if err != nil {
+		return err
+	}
+
+	// each mapping is a whole number of windows
+	chunk := _MaxMmapSize - (_MaxMmapSize % s.window)
+
+	var off int64
+	for off < fsz {
+		sz := min(fsz-off, chunk)
+		p, err := s.m.mmap(sz, off, PROT_READ, 0)
+		if err != nil {
+			return err
+		}
+
+		s.p = p
+		err = s.scan(off, fn)
+		s.p = nil
+		p.unmap()
+		if err != nil {
+			return err
+		}
+		off += sz
+	}
+	return nil
+}
+
+// Resident returns the number of resident pages of the current mapping;
+// it is meant to be called from the callback of Each.
+func (s *Scanner) Resident() (int, error) {
+	if s.p == nil {
+		return 0, nil
+	}
+	return s.p.Resident()
+}
+
+// scan walks the windows of the current mapping which starts at file
+// offset 'base'. The kernel's readahead can run far ahead of the scan;
+// so we turn it off and instead prefetch just the next window.
+func (s *Scanner) scan(base int64, fn func(off int64, buf []byte) error) error {
+	b := s.p.bytes()
+	sz := int64(len(b))
+
+	s.p.noReadahead()
+	s.p.prefetch(0, min(s.window, sz))
+	for off := int64(0); off < sz; off += s.window {
+		n := min(s.window, sz-off)
+		if nx := off + n; nx < sz {
+			s.p.prefetch(nx, min(s.window, sz-nx))
+		}
+
+		if err := fn(base+off, b[off:off+n]); err != nil {
+			return err
+		}
+
+		err := s.p.Discard(off, n)
+		if err != nil && !errors.Is(err, ErrUnsupported) {
+			return err
+		}
+
+		if err = dropCache(s.fd, base+off, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
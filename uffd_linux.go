@@ -0,0 +1,184 @@
+// uffd_linux.go - demand paging via userfaultfd(2)
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// The ioctl numbers below use the asm-generic encoding.
+
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+
+package mmap
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"unsafe"
+)
+
+// userfaultfd(2) ABI; not in x/sys/unix
+const (
+	_UFFD_API             = 0xaa
+	_UFFD_USER_MODE_ONLY  = 1
+	_UFFD_FEATURE_UNMAP   = 1 << 6
+	_UFFD_EVENT_PAGEFAULT = 0x12
+	_UFFD_EVENT_UNMAP     = 0x16
+
+	_UFFDIO_REGISTER_MODE_MISSING = 1
+
+	// _IOWR(0xaa, nr, size)
+	_UFFDIO_API      = 3<<30 | 24<<16 | _UFFD_API<<8 | 0x3f
+	_UFFDIO_REGISTER = 3<<30 | 32<<16 | _UFFD_API<<8 | 0x00
+	_UFFDIO_COPY     = 3<<30 | 40<<16 | _UFFD_API<<8 | 0x03
+)
+
+type uffdioAPI struct {
+	api      uint64
+	features uint64
+	ioctls   uint64
+}
+
+type uffdioRegister struct {
+	start  uint64
+	len    uint64
+	mode   uint64
+	ioctls uint64
+}
+
+type uffdioCopy struct {
+	dst  uint64
+	src  uint64
+	len  uint64
+	mode uint64
+	copy int64
+}
+
+// uffdMsg is struct uffd_msg; both the pagefault and the unmap events
+// carry two addresses after the event type.
+type uffdMsg struct {
+	event uint8
+	_     [7]uint8
+	arg0  uint64
+	arg1  uint64
+	_     uint64
+}
+
+func newFaultHandler(sz int64, fill func(pageIdx int64, page []byte) error) (*Mapping, error) {
+	fd, err := userfaultfd()
+	if err != nil {
+		return nil, err
+	}
+
+	api := uffdioAPI{
+		api:      _UFFD_API,
+		features: _UFFD_FEATURE_UNMAP,
+	}
+	if err = uffdIoctl(fd, _UFFDIO_API, unsafe.Pointer(&api)); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("mmap: userfaultfd api: %w", err)
+	}
+
+	p, err := NewAnon().map_anon(sz, 0, PROT_RW, F_COW)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	reg := uffdioRegister{
+		start: uint64(p.addr()),
+		len:   uint64(sz),
+		mode:  _UFFDIO_REGISTER_MODE_MISSING,
+	}
+	if err = uffdIoctl(fd, _UFFDIO_REGISTER, unsafe.Pointer(&reg)); err != nil {
+		p.unmap()
+		unix.Close(fd)
+		return nil, fmt.Errorf("mmap: userfaultfd register: %w", err)
+	}
+
+	go serveFaults(fd, p.addr(), sz, fill)
+	return p, nil
+}
+
+// userfaultfd opens a userfaultfd; unprivileged processes may only
+// handle faults from user mode.
+func userfaultfd() (int, error) {
+	fl := uintptr(unix.O_CLOEXEC)
+	for _, mode := range []uintptr{_UFFD_USER_MODE_ONLY, 0} {
+		fd, _, errno := unix.Syscall(unix.SYS_USERFAULTFD, fl|mode, 0, 0)
+		switch errno {
+		case 0:
+			return int(fd), nil
+		case unix.EINVAL:
+			// kernels older than 5.11 don't know UFFD_USER_MODE_ONLY
+			continue
+		case unix.ENOSYS:
+			return -1, fmt.Errorf("mmap: userfaultfd: %w: %w", ErrUnsupported, errno)
+		default:
+			return -1, os.NewSyscallError("userfaultfd", errno)
+		}
+	}
+	return -1, fmt.Errorf("mmap: userfaultfd: %w", ErrUnsupported)
+}
+
+// serveFaults fills the missing pages of the region [base, base+sz) as
+// they are faulted; it returns once the region is unmapped. The
+// faulting thread is blocked until the page is filled; closing fd on
+// exit releases any such thread (and a pending munmap).
+func serveFaults(fd int, base uintptr, sz int64, fill func(pageIdx int64, page []byte) error) {
+	defer unix.Close(fd)
+
+	pg := int64(os.Getpagesize())
+	page := make([]byte, pg)
+
+	var msg uffdMsg
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(&msg)), unsafe.Sizeof(msg))
+	for {
+		if _, err := unix.Read(fd, buf); err != nil {
+			if err == unix.EINTR || err == unix.EAGAIN {
+				continue
+			}
+			return
+		}
+
+		switch msg.event {
+		case _UFFD_EVENT_PAGEFAULT:
+			addr := uintptr(msg.arg1) &^ uintptr(pg-1)
+			idx := int64(addr-base) / pg
+
+			// a failed fill leaves the page zeroed; the faulting
+			// thread can't be told.
+			clear(page)
+			if err := fill(idx, page); err != nil {
+				clear(page)
+			}
+
+			cp := uffdioCopy{
+				dst: uint64(addr),
+				src: uint64(uintptr(unsafe.Pointer(&page[0]))),
+				len: uint64(pg),
+			}
+			uffdIoctl(fd, _UFFDIO_COPY, unsafe.Pointer(&cp))
+
+		case _UFFD_EVENT_UNMAP:
+			if uintptr(msg.arg0) <= base && uintptr(msg.arg1) >= base+uintptr(sz) {
+				return
+			}
+		}
+	}
+}
+
+func uffdIoctl(fd int, req uint, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+// uffd_other.go - userfaultfd stub for other platforms
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux || !(386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+
+package mmap
+
+func newFaultHandler(sz int64, fill func(pageIdx int64, page []byte) error) (*Mapping, error) {
+	return nil, unsupported("userfaultfd")
+}
@@ -0,0 +1,110 @@
+// window.go - a sliding window over a file
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mmap
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// mapping offsets are aligned to this; it is the allocation granularity
+// on Windows and a multiple of the page size everywhere.
+const _WinAlign = 64 * 1024
+
+// Window is a read-only view of a fixed size window of a file that
+// slides over the file on demand. Accesses that fall within the current
+// window don't need any syscalls; the others remap the window - reusing
+// its virtual address where the platform allows. This suits random
+// access with locality.
+type Window struct {
+	m   *Mmap
+	fd  *os.File
+	win int64
+
+	// current mapping, its file offset and whether it reaches EOF
+	p    *Mapping
+	off  int64
+	tail bool
+}
+
+// NewWindow returns a window of 'winSz' bytes over the file 'fd'. The
+// window size is rounded up to a multiple of the page size.
+func NewWindow(fd *os.File, winSz int64) *Window {
+	w := &Window{
+		m:   New(fd),
+		fd:  fd,
+		win: pageRound(winSz),
+	}
+	return w
+}
+
+// At returns up to 'winSz' bytes of the file starting at 'off'; fewer
+// bytes are returned near the end of the file. The returned slice is
+// only valid until the next call to At or Close. At returns io.EOF if
+// off is at or past the end of the file.
+func (w *Window) At(off int64) ([]byte, error) {
+	if off < 0 {
+		return nil, fmt.Errorf("mmap: window: invalid offset %d", off)
+	}
+
+	if w.p != nil {
+		b := w.p.bytes()
+		end := w.off + int64(len(b))
+		if off >= w.off && off < end && (off+w.win <= end || w.tail) {
+			i := off - w.off
+			return b[i:min(i+w.win, int64(len(b)))], nil
+		}
+	}
+
+	fsz, err := fileSize(w.fd)
+	if err != nil {
+		return nil, err
+	}
+	if off >= fsz {
+		return nil, io.EOF
+	}
+
+	// the mapping has enough slack to cover a full window at off
+	base := off &^ (_WinAlign - 1)
+	sz := min(w.win+_WinAlign, fsz-base)
+
+	var hint unsafe.Pointer
+	if w.p != nil {
+		hint = unsafe.Pointer(unsafe.SliceData(w.p.bytes()))
+		w.p.unmap()
+		w.p = nil
+	}
+
+	p, err := w.m.mmap_hint(hint, sz, base, PROT_READ, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	w.p, w.off, w.tail = p, base, base+sz == fsz
+	i := off - base
+	return p.bytes()[i:min(i+w.win, sz)], nil
+}
+
+// Close unmaps the window
+func (w *Window) Close() error {
+	if w.p == nil {
+		return nil
+	}
+
+	err := w.p.unmap()
+	w.p = nil
+	return err
+}
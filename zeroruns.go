@@ -0,0 +1,77 @@
+// zeroruns.go - find runs of zero bytes in a mapping
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mmap
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Range describes the byte range [Off, Off+Len) of a mapping
+type Range struct {
+	Off int64
+	Len int64
+}
+
+// ZeroRuns returns the runs of consecutive zero bytes in the mapping
+// that are at least 'minLen' bytes long; this identifies sparse regions
+// and padding. Scanning a file mapping faults in all of it.
+func (p *Mapping) ZeroRuns(minLen int64) ([]Range, error) {
+	if minLen <= 0 {
+		return nil, fmt.Errorf("mmap: zero runs: invalid length %d", minLen)
+	}
+	return zeroRuns(p.bytes(), minLen), nil
+}
+
+// zeroRuns scans b a word at a time; only the words that aren't zero
+// are examined byte by byte. Mappings are page aligned; so are the
+// words.
+func zeroRuns(b []byte, minLen int64) []Range {
+	var r []Range
+	var w []uint64
+
+	n := int64(len(b))
+	if n >= 8 {
+		w = unsafe.Slice((*uint64)(unsafe.Pointer(&b[0])), n/8)
+	}
+
+	start := int64(-1)
+	run := func(end int64) {
+		if start >= 0 && end-start >= minLen {
+			r = append(r, Range{start, end - start})
+		}
+		start = -1
+	}
+
+	for i := int64(0); i < n; {
+		if i%8 == 0 && i/8 < int64(len(w)) && w[i/8] == 0 {
+			if start < 0 {
+				start = i
+			}
+			i += 8
+			continue
+		}
+
+		if b[i] == 0 {
+			if start < 0 {
+				start = i
+			}
+		} else {
+			run(i)
+		}
+		i++
+	}
+	run(n)
+	return r
+}